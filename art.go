@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultArtSize is the largest width or height of a thumbnail when
+	// the request does not give a size
+	defaultArtSize = 300
+	// maxArtSize is the largest thumbnail size a request may ask for
+	maxArtSize = 1200
+	// artCacheBytes bounds the memory used by cached thumbnails
+	artCacheBytes = 32 << 20
+	// maxArtPixels is the largest cover image, in pixels, that is decoded
+	// to make a thumbnail. A 6000x4000 image decodes to about 100MB.
+	maxArtPixels = 6000 * 4000
+)
+
+// errArtTooLarge is returned for cover art with more than maxArtPixels
+var errArtTooLarge = errors.New("cover art is too large to scale")
+
+// folderImages are the cover image files looked for in a directory, in order
+// of preference. Matching ignores case.
+var folderImages = []string{"folder.jpg", "cover.jpg", "folder.jpeg", "cover.jpeg", "folder.png", "cover.png"}
+
+// albumArt caches the thumbnails served at /art/
+var albumArt = newArtCache(artCacheBytes)
+
+// coverSource finds the cover art of the file or directory at name: the
+// picture embedded in a file's ID3 tag, or else a folder image in its
+// directory. It reports whether the art is embedded, and false for ok if
+// there is none.
+func (l *Library) coverSource(name string) (source string, embedded bool, ok bool) {
+	fsys := l.FS()
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return "", false, false
+	}
+
+	dir := name
+	if !info.IsDir() {
+		tags, err := l.Tags(name)
+		if err == nil && tags.CoverMIME != "" {
+			return name, true, true
+		}
+		dir = path.Dir(name)
+	}
+
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return "", false, false
+	}
+	for _, candidate := range folderImages {
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.EqualFold(entry.Name(), candidate) {
+				return path.Join(dir, entry.Name()), false, true
+			}
+		}
+	}
+	return "", false, false
+}
+
+// cover reads the image at source as found by coverSource
+func (l *Library) cover(source string, embedded bool) (data []byte, mimeType string, err error) {
+	if !embedded {
+		data, err := fs.ReadFile(l.FS(), source)
+		if err != nil {
+			return nil, "", err
+		}
+		mimeType = "image/jpeg"
+		if strings.EqualFold(path.Ext(source), ".png") {
+			mimeType = "image/png"
+		}
+		return data, mimeType, nil
+	}
+
+	f, err := l.FS().Open(source)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		return nil, "", fmt.Errorf("%s does not support seeking", source)
+	}
+	tags, err := readTags(rs, info.Size(), true)
+	if err != nil {
+		return nil, "", err
+	}
+	if tags.Cover == nil {
+		return nil, "", fs.ErrNotExist
+	}
+	return tags.Cover, tags.CoverMIME, nil
+}
+
+// artURL returns the URL of the cover art of the file or directory at name,
+// or "" if it has none
+func (l *Library) artURL(baseURL, name string) string {
+	if _, _, ok := l.coverSource(name); !ok {
+		return ""
+	}
+	return baseURL + "/art/" + escapePath(name)
+}
+
+// artCache keeps recently served thumbnails, keyed by source image and
+// size, dropping the least recently used when over its size limit. Entries
+// are only used while the source file is unchanged.
+type artCache struct {
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List
+	size     int
+	maxBytes int
+}
+
+// artEntry is a cached thumbnail
+type artEntry struct {
+	key      string
+	stamp    fileStamp
+	mimeType string
+	data     []byte
+}
+
+// newArtCache returns an empty cache holding up to maxBytes of images
+func newArtCache(maxBytes int) *artCache {
+	return &artCache{
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		maxBytes: maxBytes,
+	}
+}
+
+// Thumbnail returns the cover art of the file or directory at name in
+// library, scaled to fit size pixels. It returns an error matching
+// fs.ErrNotExist if there is no cover art.
+func (c *artCache) Thumbnail(library *Library, name string, size int) ([]byte, string, error) {
+	source, embedded, ok := library.coverSource(name)
+	if !ok {
+		return nil, "", fs.ErrNotExist
+	}
+	info, err := fs.Stat(library.FS(), source)
+	if err != nil {
+		return nil, "", err
+	}
+	stamp := fileStamp{size: info.Size(), modTime: info.ModTime()}
+	key := fmt.Sprintf("%s@%d", source, size)
+
+	if entry, ok := c.get(key, stamp); ok {
+		return entry.data, entry.mimeType, nil
+	}
+
+	data, mimeType, err := library.cover(source, embedded)
+	if err != nil {
+		return nil, "", err
+	}
+	thumb, thumbType, err := thumbnail(data, mimeType, size)
+	if errors.Is(err, errArtTooLarge) {
+		return nil, "", fmt.Errorf("%s: %w", source, err)
+	}
+	if err != nil {
+		// Serve images we cannot decode as they are
+		log.Printf("Warning: failed to scale cover art %s: %v", source, err)
+		thumb, thumbType = data, mimeType
+	}
+	c.put(&artEntry{key: key, stamp: stamp, mimeType: thumbType, data: thumb})
+	return thumb, thumbType, nil
+}
+
+// Clear drops every cached thumbnail. It is registered with
+// Library.OnChange.
+func (c *artCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.size = 0
+}
+
+// get returns the entry for key if it was made from the stamped version of
+// its source
+func (c *artCache) get(key string, stamp fileStamp) (*artEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*artEntry)
+	if !entry.stamp.equal(stamp) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry, true
+}
+
+// put adds entry, evicting the least recently used entries to stay within
+// the size limit
+func (c *artCache) put(entry *artEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	if len(entry.data) > c.maxBytes {
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.size += len(entry.data)
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops elem from the cache. c.mu must be held.
+func (c *artCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*artEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.data)
+}
+
+// thumbnail scales a JPEG or PNG image down to fit within size pixels,
+// keeping its format. Images that already fit are returned unchanged, and
+// images larger than maxArtPixels are refused with errArtTooLarge before
+// they are decoded.
+func thumbnail(data []byte, mimeType string, size int) ([]byte, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width <= size && config.Height <= size {
+		return data, mimeType, nil
+	}
+	if config.Width*config.Height > maxArtPixels {
+		return nil, "", fmt.Errorf("%dx%d image: %w", config.Width, config.Height, errArtTooLarge)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var buf bytes.Buffer
+	scaled := scaleImage(src, size)
+	if format == "png" {
+		err = png.Encode(&buf, scaled)
+		mimeType = "image/png"
+	} else {
+		err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 85})
+		mimeType = "image/jpeg"
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mimeType, nil
+}
+
+// scaleImage shrinks src to fit within size pixels, keeping its aspect
+// ratio, by averaging the source pixels covered by each target pixel
+func scaleImage(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := size, size
+	if w > h {
+		dh = max(1, h*size/w)
+	} else {
+		dw = max(1, w*size/h)
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, max((y+1)*h/dh, y*h/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, max((x+1)*w/dw, x*w/dw+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// artHandler serves the cover art of a music file or directory, e.g.
+// /art/presets/5/01%20Song.mp3 or /art/presets/5, scaled to the size query
+// parameter
+func artHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/art/"), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	size := defaultArtSize
+	if s := r.URL.Query().Get("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxArtSize {
+			http.Error(w, fmt.Sprintf("size must be between 1 and %d", maxArtSize), http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+
+	data, mimeType, err := albumArt.Thumbnail(musicLibrary, name, size)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "No cover art", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errArtTooLarge) {
+		log.Printf("Refused cover art for %s: %v", name, err)
+		http.Error(w, "Cover art is too large to scale", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load cover art for %s: %v", name, err)
+		http.Error(w, "Failed to load cover art", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(data)
+}
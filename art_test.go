@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testImage encodes a w×h image filled with c as "png" or "jpeg"
+func testImage(t *testing.T, format string, w, h int, c color.Color) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	var err error
+	if format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// oversizedPNG returns a small PNG whose header claims it is w×h pixels
+func oversizedPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	data := testImage(t, "png", 1, 1, color.Black)
+	// The IHDR chunk follows the 8 byte signature: length, type, then the
+	// width and height, with a CRC of the type and data after its 13 bytes
+	binary.BigEndian.PutUint32(data[16:], uint32(w))
+	binary.BigEndian.PutUint32(data[20:], uint32(h))
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestThumbnail(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	tests := []struct {
+		name       string
+		data       []byte
+		mimeType   string
+		size       int
+		wantType   string
+		wantWidth  int
+		wantHeight int
+	}{
+		{"landscape png", testImage(t, "png", 600, 400, red), "image/png", 300, "image/png", 300, 200},
+		{"portrait jpeg", testImage(t, "jpeg", 200, 800, red), "image/jpeg", 100, "image/jpeg", 25, 100},
+		{"already small", testImage(t, "png", 64, 64, red), "image/png", 300, "image/png", 64, 64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, mimeType, err := thumbnail(tt.data, tt.mimeType, tt.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mimeType != tt.wantType {
+				t.Errorf("expected %s, got %s", tt.wantType, mimeType)
+			}
+			img, _, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := img.Bounds(); b.Dx() != tt.wantWidth || b.Dy() != tt.wantHeight {
+				t.Errorf("expected %dx%d, got %dx%d", tt.wantWidth, tt.wantHeight, b.Dx(), b.Dy())
+			}
+			if r, _, _, _ := img.At(tt.wantWidth/2, tt.wantHeight/2).RGBA(); r>>8 < 240 {
+				t.Errorf("expected the colour to survive scaling, got red %d", r>>8)
+			}
+		})
+	}
+
+	if _, _, err := thumbnail([]byte("not an image"), "image/jpeg", 300); err == nil {
+		t.Error("expected error for data that is not an image")
+	}
+	if _, _, err := thumbnail(oversizedPNG(t, 20000, 20000), "image/png", 300); !errors.Is(err, errArtTooLarge) {
+		t.Errorf("expected errArtTooLarge for a 20000x20000 image, got %v", err)
+	}
+}
+
+func TestArtCacheEviction(t *testing.T) {
+	cache := newArtCache(10)
+	stamp := fileStamp{size: 1, modTime: time.Unix(1, 0)}
+	cache.put(&artEntry{key: "a", stamp: stamp, data: make([]byte, 4)})
+	cache.put(&artEntry{key: "b", stamp: stamp, data: make([]byte, 4)})
+	// Using a makes b the least recently used
+	if _, ok := cache.get("a", stamp); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	cache.put(&artEntry{key: "c", stamp: stamp, data: make([]byte, 4)})
+
+	if _, ok := cache.get("b", stamp); ok {
+		t.Error("expected b to be evicted")
+	}
+	if _, ok := cache.get("a", stamp); !ok {
+		t.Error("expected a to be kept")
+	}
+	if _, ok := cache.get("a", fileStamp{size: 2}); ok {
+		t.Error("expected a changed source to miss")
+	}
+	if cache.size != 4 {
+		t.Errorf("expected 4 cached bytes, got %d", cache.size)
+	}
+}
+
+func TestArtHandler(t *testing.T) {
+	useFakeSpeaker(t)
+	albumArt.Clear()
+	t.Cleanup(albumArt.Clear)
+
+	blue := color.RGBA{B: 255, A: 255}
+	green := color.RGBA{G: 255, A: 255}
+	dir := t.TempDir()
+	writeMusicFile(t, dir, "presets/7/Folder.JPG", string(testImage(t, "jpeg", 800, 800, blue)))
+	writeMusicFile(t, dir, "presets/7/01 Plain.mp3", string(mpegFrames(38)))
+	embedded := append([]byte("\x00image/png\x00\x03\x00"), testImage(t, "png", 100, 50, green)...)
+	writeMusicFile(t, dir, "presets/8/01 Tagged.mp3", string(append(id3v2Tag(3,
+		id3v2Frame(3, "TIT2", []byte("\x00Tagged")),
+		id3v2Frame(3, "APIC", embedded),
+	), mpegFrames(38)...)))
+	writeMusicFile(t, dir, "presets/10/cover.png", string(oversizedPNG(t, 20000, 20000)))
+	useMusicDir(t, dir)
+
+	tests := []struct {
+		path       string
+		status     int
+		mimeType   string
+		wantWidth  int
+		wantHeight int
+	}{
+		{"/art/presets/7", http.StatusOK, "image/jpeg", 300, 300},
+		{"/art/presets/7/", http.StatusOK, "image/jpeg", 300, 300},
+		{"/art/presets/7?size=64", http.StatusOK, "image/jpeg", 64, 64},
+		// A track without a picture uses its folder image
+		{"/art/presets/7/01%20Plain.mp3", http.StatusOK, "image/jpeg", 300, 300},
+		{"/art/presets/8/01%20Tagged.mp3", http.StatusOK, "image/png", 100, 50},
+		{"/art/presets/8/01%20Tagged.mp3?size=20", http.StatusOK, "image/png", 20, 10},
+		{"/art/presets/8", http.StatusNotFound, "", 0, 0},
+		{"/art/presets/9", http.StatusNotFound, "", 0, 0},
+		{"/art/presets/7?size=5000", http.StatusBadRequest, "", 0, 0},
+		{"/art/presets/10", http.StatusUnprocessableEntity, "", 0, 0},
+	}
+	for _, tt := range tests {
+		rr := serve(t, "GET", tt.path, "")
+		if rr.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.path, tt.status, rr.Code, rr.Body.String())
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != tt.mimeType {
+			t.Errorf("%s: expected %s, got %s", tt.path, tt.mimeType, ct)
+		}
+		img, _, err := image.Decode(rr.Body)
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+			continue
+		}
+		if b := img.Bounds(); b.Dx() != tt.wantWidth || b.Dy() != tt.wantHeight {
+			t.Errorf("%s: expected %dx%d, got %dx%d", tt.path, tt.wantWidth, tt.wantHeight, b.Dx(), b.Dy())
+		}
+	}
+
+	// A replaced folder image is picked up despite the cached thumbnail
+	folder := filepath.Join(dir, "presets/7/Folder.JPG")
+	if err := os.WriteFile(folder, testImage(t, "jpeg", 400, 200, green), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(folder, later, later); err != nil {
+		t.Fatal(err)
+	}
+	rr := serve(t, "GET", "/art/presets/7", "")
+	img, _, err := image.Decode(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 300 || b.Dy() != 150 {
+		t.Errorf("expected the new image at 300x150, got %dx%d", b.Dx(), b.Dy())
+	}
+
+	// Preset JSON and queue metadata point at the art
+	rr = serve(t, "GET", "/sonos/preset/8", "")
+	var response struct {
+		AlbumArtURI   string     `json:"album_art_uri"`
+		PlaylistItems []ListItem `json:"playlist_items"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	want := "http://192.168.4.88:8080/art/presets/8/01%20Tagged.mp3"
+	if response.AlbumArtURI != want || len(response.PlaylistItems) != 1 || response.PlaylistItems[0].AlbumArtURI != want {
+		t.Errorf("expected album art %s, got %+v", want, response)
+	}
+
+	rr = serve(t, "GET", "/sonos/preset/7", "")
+	if !strings.Contains(rr.Body.String(), `"album_art_uri":"http://192.168.4.88:8080/art/presets/7"`) {
+		t.Errorf("expected the folder image as preset art, got %s", rr.Body.String())
+	}
+}
+
+func TestArtEnqueued(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writeMusicFile(t, dir, "presets/7/cover.png", string(testImage(t, "png", 10, 10, color.Black)))
+	writeMusicFile(t, dir, "presets/7/01 Song.mp3", string(mpegFrames(38)))
+	useMusicDir(t, dir)
+
+	rr := serve(t, "POST", "/sonos/preset/7", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	queue := fake.Queue()
+	want := "<upnp:albumArtURI>http://192.168.4.88:8080/art/presets/7/01%20Song.mp3</upnp:albumArtURI>"
+	if len(queue) != 1 || !strings.Contains(queue[0].Metadata, want) {
+		t.Errorf("expected %s in queued metadata, got %+v", want, queue)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Error codes returned in the error field of a commandResponse
+const (
+	codeInvalidRequest     = "invalid_request"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeNotFound           = "not_found"
+	codeSpeakerNotFound    = "speaker_not_found"
+	codeSpeakerUnreachable = "speaker_unreachable"
+	codeSpeakerError       = "speaker_error"
+	codeInvalidPreset      = "invalid_preset"
+	codePresetEmpty        = "preset_empty"
+)
+
+// commandRequest is the JSON body accepted by every speaker command. The body
+// is optional; an empty body or an empty speaker selects the speaker in the
+// speaker query parameter, if any, and otherwise the default speaker.
+type commandRequest struct {
+	Speaker string `json:"speaker"`
+}
+
+// commandResponse is the JSON envelope returned by the /sonos endpoints.
+// Error is one of the code constants and is only set when OK is false.
+// FailedTracks lists the files that could not be queued, if any.
+type commandResponse struct {
+	OK           bool          `json:"ok"`
+	Action       string        `json:"action"`
+	Speaker      string        `json:"speaker,omitempty"`
+	Message      string        `json:"message"`
+	State        *speakerState `json:"state,omitempty"`
+	FailedTracks []string      `json:"failed_tracks,omitempty"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// speakerState is the speaker state resulting from a command. Only the
+// fields a command affects are set.
+type speakerState struct {
+	TransportState string           `json:"transport_state,omitempty"`
+	Track          *trackState      `json:"track,omitempty"`
+	Volume         *uint16          `json:"volume,omitempty"`
+	Mute           *bool            `json:"mute,omitempty"`
+	PlayMode       string           `json:"play_mode,omitempty"`
+	SleepTimer     *sleepTimerState `json:"sleep_timer,omitempty"`
+	QueueFill      *queueFillState  `json:"queue_fill,omitempty"`
+}
+
+// speakerCommand is an action run against a single speaker by
+// commandHandler
+type speakerCommand struct {
+	// method is the HTTP method the command accepts, POST if empty
+	method string
+	// name identifies the command in log messages, e.g. "Pause"
+	name string
+	// action identifies the command in responses, e.g. "pause"
+	action string
+	// speaker is used when the request does not name a speaker, in place
+	// of the default speaker
+	speaker string
+	// services are the go-sonos services the action uses, e.g.
+	// sonos.SVC_AV_TRANSPORT
+	services int
+	// run performs the action and writes the response with reply or
+	// replyJSON. Returning an error writes an error response instead.
+	run func(c *commandContext) error
+}
+
+// commandContext is what a speakerCommand action works with: the resolved
+// speaker, a connection to it and the request.
+type commandContext struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	body    []byte
+	action  string
+	speaker Speaker
+	s       SpeakerController
+
+	// state is reported in the response; actions set the fields they change
+	state speakerState
+	// failedTracks are the files an action could not add to the queue
+	failedTracks []string
+}
+
+// decode unmarshals the request body into v for actions that accept more
+// than the speaker. An empty body leaves v unchanged.
+func (c *commandContext) decode(v any) error {
+	if len(bytes.TrimSpace(c.body)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(c.body, v)
+}
+
+// response returns a success envelope with the resulting state
+func (c *commandContext) response(message string) commandResponse {
+	resp := commandResponse{
+		OK:           true,
+		Action:       c.action,
+		Speaker:      c.speaker.Name,
+		Message:      message,
+		FailedTracks: c.failedTracks,
+	}
+	if c.state != (speakerState{}) {
+		state := c.state
+		resp.State = &state
+	}
+	return resp
+}
+
+// reply writes a success response, as JSON or as a plain-text message line
+// depending on the Accept header
+func (c *commandContext) reply(format string, args ...any) error {
+	writeResponse(c.w, c.r, http.StatusOK, c.response(fmt.Sprintf(format, args...)))
+	return nil
+}
+
+// replyJSON writes v as a JSON success response regardless of the Accept
+// header, for commands that return data rather than a message
+func (c *commandContext) replyJSON(v any) error {
+	writeJSON(c.w, http.StatusOK, v)
+	return nil
+}
+
+// commandError is a failed action, carrying the status, code and message sent
+// to the client and the underlying error, which is only logged
+type commandError struct {
+	status  int
+	code    string
+	message string
+	err     error
+	// failedTracks are the files that could not be queued, if any
+	failedTracks []string
+}
+
+func (e *commandError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// commandFailed reports that a speaker call failed with a 500
+func commandFailed(message string, err error) error {
+	return &commandError{status: http.StatusInternalServerError, code: codeSpeakerError, message: message, err: err}
+}
+
+// commandRejected reports a request that cannot be carried out, such as a
+// missing playlist, with the given status and error code
+func commandRejected(status int, code, message string) error {
+	return &commandError{status: status, code: code, message: message}
+}
+
+// commandHandler returns a handler running cmd. Every command shares the same
+// request handling: a single method, POST unless the command says otherwise,
+// an optional JSON body naming the speaker, falling back to the default
+// speaker, 404 for an unknown speaker and 500 when the speaker does not
+// answer.
+func commandHandler(cmd speakerCommand) http.HandlerFunc {
+	method := cmd.method
+	if method == "" {
+		method = http.MethodPost
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeError(w, r, cmd.action, "", commandRejected(http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed"))
+			return
+		}
+		runCommand(w, r, cmd)
+	}
+}
+
+// runCommand resolves the speaker named in the request and runs cmd on it
+func runCommand(w http.ResponseWriter, r *http.Request, cmd speakerCommand) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Failed to read request body: %v", err)
+		writeError(w, r, cmd.action, "", commandRejected(http.StatusBadRequest, codeInvalidRequest, "Failed to read request"))
+		return
+	}
+
+	var req commandRequest
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			log.Printf("Error decoding JSON request: %v", err)
+			writeError(w, r, cmd.action, "", commandRejected(http.StatusBadRequest, codeInvalidRequest, "Invalid JSON request"))
+			return
+		}
+	}
+
+	if req.Speaker == "" {
+		req.Speaker = r.URL.Query().Get("speaker")
+	}
+	if req.Speaker == "" {
+		req.Speaker = cmd.speaker
+	}
+	if req.Speaker == "" {
+		req.Speaker = defaultSpeaker
+	}
+
+	log.Printf("%s requested for speaker: %s", cmd.name, req.Speaker)
+
+	// Find the speaker in the registry
+	speaker, exists := speakerRegistry.Lookup(req.Speaker)
+	if !exists {
+		writeError(w, r, cmd.action, req.Speaker, commandRejected(http.StatusNotFound, codeSpeakerNotFound, fmt.Sprintf("Speaker '%s' not found", req.Speaker)))
+		return
+	}
+
+	s, err := openSpeaker(speaker, cmd.services)
+	if err != nil {
+		log.Printf("Failed to connect to Sonos device: %v", err)
+		writeError(w, r, cmd.action, speaker.Name, &commandError{
+			status:  http.StatusInternalServerError,
+			code:    codeSpeakerUnreachable,
+			message: "Failed to connect to speaker",
+			err:     err,
+		})
+		return
+	}
+
+	c := &commandContext{w: w, r: r, body: body, action: cmd.action, speaker: speaker, s: s}
+	if err := cmd.run(c); err != nil {
+		log.Printf("%s on %s: %v", cmd.name, speaker.Name, err)
+		writeError(w, r, cmd.action, speaker.Name, err)
+	}
+}
+
+// writeError writes an error response for err. Errors other than a
+// commandError are reported as a failed speaker call.
+func writeError(w http.ResponseWriter, r *http.Request, action, speaker string, err error) {
+	var cmdErr *commandError
+	if !errors.As(err, &cmdErr) {
+		cmdErr = &commandError{status: http.StatusInternalServerError, code: codeSpeakerError, message: "Speaker command failed", err: err}
+	}
+	writeResponse(w, r, cmdErr.status, commandResponse{
+		Action:       action,
+		Speaker:      speaker,
+		Message:      cmdErr.message,
+		FailedTracks: cmdErr.failedTracks,
+		Error:        cmdErr.code,
+	})
+}
+
+// writeResponse writes resp as JSON when the client asks for it and as the
+// plain-text message otherwise, so curl users and the CardPuter keep getting
+// a readable line
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, resp commandResponse) {
+	if wantsJSON(r) {
+		writeJSON(w, status, resp)
+		return
+	}
+	if !resp.OK {
+		http.Error(w, resp.Message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, resp.Message)
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+// wantsJSON reports whether the Accept header prefers application/json over
+// text/plain. Ties and wildcards such as curl's default */* select plain
+// text.
+func wantsJSON(r *http.Request) bool {
+	jsonQ, textQ := 0.0, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch mediaType {
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case "text/plain":
+			textQ = max(textQ, q)
+		}
+	}
+	return jsonQ > textQ
+}
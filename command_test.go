@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ianr0bkny/go-sonos"
+)
+
+// runTestCommand sends a request to a handler running action against the
+// fake speaker
+func runTestCommand(t *testing.T, method, accept, body string, action func(c *commandContext) error) *httptest.ResponseRecorder {
+	t.Helper()
+	handler := commandHandler(speakerCommand{
+		name:     "Test",
+		action:   "test",
+		services: sonos.SVC_RENDERING_CONTROL,
+		run:      action,
+	})
+	req := httptest.NewRequest(method, "/sonos/test", strings.NewReader(body))
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCommandHandler(t *testing.T) {
+	fake := useFakeSpeaker(t)
+
+	var got Speaker
+	rr := runTestCommand(t, "POST", "", `{"speaker":"`+fake.UUID()+`"}`, func(c *commandContext) error {
+		got = c.speaker
+		return c.reply("ok %s", c.speaker.Name)
+	})
+	if rr.Code != http.StatusOK || rr.Body.String() != "ok Kids Room\n" {
+		t.Errorf("expected 200 ok Kids Room, got %d: %q", rr.Code, rr.Body.String())
+	}
+	if got.UUID != fake.UUID() {
+		t.Errorf("expected speaker resolved by UUID, got %+v", got)
+	}
+
+	if rr := runTestCommand(t, "GET", "", "", nil); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 for GET, got %d", rr.Code)
+	}
+}
+
+func TestCommandHandlerDecode(t *testing.T) {
+	useFakeSpeaker(t)
+
+	var req struct {
+		Speaker string `json:"speaker"`
+		Level   int    `json:"level"`
+	}
+	rr := runTestCommand(t, "POST", "", `{"level": 7}`, func(c *commandContext) error {
+		if err := c.decode(&req); err != nil {
+			return err
+		}
+		return c.replyJSON(req)
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if req.Level != 7 || req.Speaker != "" {
+		t.Errorf("expected level 7 and no speaker, got %+v", req)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON response, got %q", ct)
+	}
+}
+
+func TestCommandHandlerErrors(t *testing.T) {
+	useFakeSpeaker(t)
+
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		message string
+	}{
+		{"failed", commandFailed("Failed to set volume", errors.New("UPnP error 701")), http.StatusInternalServerError, "Failed to set volume"},
+		{"rejected", commandRejected(http.StatusNotFound, codeNotFound, "No songs available"), http.StatusNotFound, "No songs available"},
+		{"plain error", errors.New("boom"), http.StatusInternalServerError, "Speaker command failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := runTestCommand(t, "POST", "", "", func(c *commandContext) error { return tt.err })
+			if rr.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, rr.Code)
+			}
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.message {
+				t.Errorf("expected message %q, got %q", tt.message, body)
+			}
+		})
+	}
+}
+
+func TestCommandHandlerJSONResponse(t *testing.T) {
+	useFakeSpeaker(t)
+
+	volume := uint16(25)
+	rr := runTestCommand(t, "POST", "application/json", "", func(c *commandContext) error {
+		c.state.Volume = &volume
+		return c.reply("Volume set to %d", volume)
+	})
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON response, got %q", ct)
+	}
+	var resp commandResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.OK || resp.Action != "test" || resp.Speaker != "Kids Room" || resp.Message != "Volume set to 25" || resp.Error != "" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if resp.State == nil || resp.State.Volume == nil || *resp.State.Volume != 25 || resp.State.Mute != nil {
+		t.Errorf("expected state with only volume 25, got %+v", resp.State)
+	}
+
+	rr = runTestCommand(t, "POST", "application/json", `{"speaker":"Garage"}`, nil)
+	resp = commandResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusNotFound || resp.OK || resp.Error != codeSpeakerNotFound || resp.Speaker != "Garage" {
+		t.Errorf("expected speaker_not_found error, got %d %+v", rr.Code, resp)
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", true},
+		{"application/json, text/plain", false},
+		{"text/plain;q=0.5, application/json", true},
+		{"application/json;q=0.2, text/plain", false},
+		{"text/html, application/json;q=0.9, */*;q=0.8", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/sonos/pause", nil)
+		req.Header.Set("Accept", tt.accept)
+		if got := wantsJSON(req); got != tt.want {
+			t.Errorf("wantsJSON(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
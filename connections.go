@@ -0,0 +1,218 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ianr0bkny/go-sonos/upnp"
+)
+
+// speakerConnections caches the described services of every speaker used by
+// the HTTP handlers
+var speakerConnections = newConnectionCache(describeSpeaker)
+
+// connectionCache keeps the described services of each speaker so commands
+// skip fetching device_description.xml and the SCPD documents, which takes
+// longer than the SOAP action itself. An entry is dropped when a call cannot
+// reach the speaker, when the speaker's address changes and when discovery
+// removes it.
+type connectionCache struct {
+	describe func(address string) (upnp.ServiceMap, error)
+
+	mu      sync.Mutex
+	entries map[string]*connectionEntry
+
+	hits          int
+	misses        int
+	invalidations int
+	hitTime       time.Duration
+	missTime      time.Duration
+}
+
+// connectionEntry is the cached description of one speaker. mu serializes
+// describing the device and its services, which go-sonos does not guard;
+// describedAt and hits are guarded by the cache mutex.
+type connectionEntry struct {
+	mu      sync.Mutex
+	address string
+	svcMap  upnp.ServiceMap
+
+	describedAt time.Time
+	hits        int
+}
+
+// ConnectionStats reports how much connection caching is saving
+type ConnectionStats struct {
+	Hits                 int              `json:"hits"`
+	Misses               int              `json:"misses"`
+	Invalidations        int              `json:"invalidations"`
+	AverageHitMillis     float64          `json:"average_hit_ms"`
+	AverageMissMillis    float64          `json:"average_miss_ms"`
+	EstimatedSavedMillis float64          `json:"estimated_saved_ms"`
+	Speakers             []ConnectionInfo `json:"speakers"`
+}
+
+// ConnectionInfo describes one cached speaker connection
+type ConnectionInfo struct {
+	UUID        string    `json:"uuid"`
+	Address     string    `json:"address"`
+	DescribedAt time.Time `json:"described_at"`
+	Hits        int       `json:"hits"`
+}
+
+// newConnectionCache returns an empty cache that describes speakers with
+// describe
+func newConnectionCache(describe func(address string) (upnp.ServiceMap, error)) *connectionCache {
+	return &connectionCache{
+		describe: describe,
+		entries:  make(map[string]*connectionEntry),
+	}
+}
+
+// Connect returns a controller for the requested services of speaker,
+// describing the speaker only if it is not cached at its current address.
+// failed, if not nil, is called after the entry is dropped when a call cannot
+// reach the speaker.
+func (c *connectionCache) Connect(speaker Speaker, services int, failed func(error)) (SpeakerController, error) {
+	start := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[speaker.UUID]
+	if !ok || entry.address != speaker.Address {
+		entry = &connectionEntry{address: speaker.Address}
+		c.entries[speaker.UUID] = entry
+	}
+	c.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	hit := entry.svcMap != nil
+	if !hit {
+		svcMap, err := c.describe(speaker.Address)
+		if err != nil {
+			c.drop(speaker.UUID, entry)
+			return nil, err
+		}
+		entry.svcMap = svcMap
+	}
+
+	// MakeSonos fetches the SCPD documents of services not used before
+	s, err := newSonosController(entry.svcMap, services, func(err error) {
+		log.Printf("Dropping cached connection to %s at %s: %v", speaker.Name, speaker.Address, err)
+		c.drop(speaker.UUID, entry)
+		if failed != nil {
+			failed(err)
+		}
+	})
+	if err != nil {
+		c.drop(speaker.UUID, entry)
+		return nil, err
+	}
+
+	elapsed := time.Since(start)
+	c.mu.Lock()
+	if hit {
+		c.hits++
+		c.hitTime += elapsed
+		entry.hits++
+	} else {
+		c.misses++
+		c.missTime += elapsed
+		entry.describedAt = time.Now()
+	}
+	c.mu.Unlock()
+
+	if hit {
+		log.Printf("Connected to %s in %s using cached description", speaker.Name, elapsed)
+	} else {
+		log.Printf("Connected to %s in %s after describing device", speaker.Name, elapsed)
+	}
+	return s, nil
+}
+
+// drop removes entry if it is still the cached entry for uuid
+func (c *connectionCache) drop(uuid string, entry *connectionEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[uuid] == entry {
+		delete(c.entries, uuid)
+		c.invalidations++
+	}
+}
+
+// Invalidate drops the cached connection to the speaker with the given UUID
+func (c *connectionCache) Invalidate(uuid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[uuid]; ok {
+		delete(c.entries, uuid)
+		c.invalidations++
+	}
+}
+
+// InvalidateChanges drops the cached connections of speakers that discovery
+// found removed or moved. It is registered with Discoverer.OnChange.
+func (c *connectionCache) InvalidateChanges(changes []SpeakerChange) {
+	for _, change := range changes {
+		if change.Kind == SpeakerRemoved || change.Kind == SpeakerMoved {
+			c.Invalidate(change.Speaker.UUID)
+		}
+	}
+}
+
+// Stats returns the cache counters and the latency saved by cache hits,
+// estimated from the average time taken by hits and misses
+func (c *connectionCache) Stats() ConnectionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := ConnectionStats{
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Invalidations: c.invalidations,
+		Speakers:      make([]ConnectionInfo, 0, len(c.entries)),
+	}
+	if c.hits > 0 {
+		stats.AverageHitMillis = millis(c.hitTime) / float64(c.hits)
+	}
+	if c.misses > 0 {
+		stats.AverageMissMillis = millis(c.missTime) / float64(c.misses)
+	}
+	if c.hits > 0 && c.misses > 0 && stats.AverageMissMillis > stats.AverageHitMillis {
+		stats.EstimatedSavedMillis = float64(c.hits) * (stats.AverageMissMillis - stats.AverageHitMillis)
+	}
+
+	for uuid, entry := range c.entries {
+		if entry.describedAt.IsZero() {
+			continue
+		}
+		stats.Speakers = append(stats.Speakers, ConnectionInfo{
+			UUID:        uuid,
+			Address:     entry.address,
+			DescribedAt: entry.describedAt,
+			Hits:        entry.hits,
+		})
+	}
+	sort.Slice(stats.Speakers, func(i, j int) bool {
+		return stats.Speakers[i].UUID < stats.Speakers[j].UUID
+	})
+	return stats
+}
+
+// millis converts d to fractional milliseconds
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// connectionsHandler reports connection cache statistics
+func connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, speakerConnections.Stats())
+}
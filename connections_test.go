@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ianr0bkny/go-sonos"
+	"github.com/ianr0bkny/go-sonos/upnp"
+)
+
+func TestConnectionCacheReusesDescription(t *testing.T) {
+	fake := newFakeSonos(t, "Kids Room")
+	cache := newConnectionCache(describeSpeaker)
+
+	for i := 0; i < 3; i++ {
+		s, err := cache.Connect(fake.Speaker(), sonos.SVC_RENDERING_CONTROL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetVolume(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A service not used before is described on the cached device
+	s, err := cache.Connect(fake.Speaker(), sonos.SVC_AV_TRANSPORT, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetTransportInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := fake.Describes(); n != 1 {
+		t.Errorf("expected device to be described once, got %d", n)
+	}
+	stats := cache.Stats()
+	if stats.Hits != 3 || stats.Misses != 1 || stats.Invalidations != 0 {
+		t.Errorf("expected 3 hits and 1 miss, got %+v", stats)
+	}
+	if len(stats.Speakers) != 1 || stats.Speakers[0].UUID != fake.UUID() || stats.Speakers[0].Hits != 3 {
+		t.Errorf("expected one cached speaker with 3 hits, got %+v", stats.Speakers)
+	}
+}
+
+func TestConnectionCacheAddressChange(t *testing.T) {
+	fake := newFakeSonos(t, "Kids Room")
+	moved := newFakeSonos(t, "Kids Room")
+	cache := newConnectionCache(describeSpeaker)
+
+	speaker := fake.Speaker()
+	if _, err := cache.Connect(speaker, sonos.SVC_RENDERING_CONTROL, nil); err != nil {
+		t.Fatal(err)
+	}
+	speaker.Address = moved.Address()
+	if _, err := cache.Connect(speaker, sonos.SVC_RENDERING_CONTROL, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := moved.Describes(); n != 1 {
+		t.Errorf("expected new address to be described, got %d", n)
+	}
+	if stats := cache.Stats(); stats.Misses != 2 || len(stats.Speakers) != 1 || stats.Speakers[0].Address != moved.Address() {
+		t.Errorf("expected the entry to follow the new address, got %+v", stats)
+	}
+}
+
+func TestConnectionCacheDropsUnreachableSpeaker(t *testing.T) {
+	fake := newFakeSonos(t, "Kids Room")
+	cache := newConnectionCache(describeSpeaker)
+
+	var failures int
+	s, err := cache.Connect(fake.Speaker(), sonos.SVC_RENDERING_CONTROL, func(error) { failures++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A SOAP fault means the speaker answered, so the entry is kept
+	fake.Fail("GetVolume", 1)
+	if _, err := s.GetVolume(); err == nil {
+		t.Fatal("expected SOAP fault")
+	}
+	if stats := cache.Stats(); stats.Invalidations != 0 || failures != 0 {
+		t.Errorf("expected entry kept after SOAP fault, got %+v and %d failures", stats, failures)
+	}
+
+	fake.server.Close()
+	if _, err := s.GetVolume(); err == nil {
+		t.Fatal("expected error from closed speaker")
+	}
+	if failures != 1 {
+		t.Errorf("expected failure callback once, got %d", failures)
+	}
+	if stats := cache.Stats(); stats.Invalidations != 1 || len(stats.Speakers) != 0 {
+		t.Errorf("expected entry dropped, got %+v", stats)
+	}
+}
+
+func TestConnectionCacheDescribeError(t *testing.T) {
+	cache := newConnectionCache(func(address string) (upnp.ServiceMap, error) {
+		return nil, errors.New("timeout")
+	})
+
+	speaker := Speaker{UUID: "RINCON_GONE", Name: "Garage", Address: "192.168.4.99"}
+	if _, err := cache.Connect(speaker, sonos.SVC_AV_TRANSPORT, nil); err == nil {
+		t.Fatal("expected describe error")
+	}
+	if stats := cache.Stats(); stats.Misses != 0 || len(stats.Speakers) != 0 {
+		t.Errorf("expected nothing cached, got %+v", stats)
+	}
+}
+
+func TestConnectionCacheInvalidateChanges(t *testing.T) {
+	kitchen := newFakeSonos(t, "Kitchen")
+	office := newFakeSonos(t, "Office")
+	cache := newConnectionCache(describeSpeaker)
+
+	for _, fake := range []*fakeSonos{kitchen, office} {
+		if _, err := cache.Connect(fake.Speaker(), sonos.SVC_RENDERING_CONTROL, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache.InvalidateChanges([]SpeakerChange{
+		{Kind: SpeakerAdded, Speaker: office.Speaker()},
+		{Kind: SpeakerRemoved, Speaker: kitchen.Speaker()},
+	})
+
+	stats := cache.Stats()
+	if len(stats.Speakers) != 1 || stats.Speakers[0].UUID != office.UUID() {
+		t.Errorf("expected only Office cached, got %+v", stats.Speakers)
+	}
+}
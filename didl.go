@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+)
+
+// DIDL-Lite namespaces used by Sonos
+const (
+	didlNamespace  = "urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/"
+	dcNamespace    = "http://purl.org/dc/elements/1.1/"
+	upnpNamespace  = "urn:schemas-upnp-org:metadata-1-0/upnp/"
+	sonosNamespace = "urn:schemas-rinconnetworks-com:metadata-1-0/"
+)
+
+// musicTrackClass is the UPnP class of a queued audio file
+const musicTrackClass = "object.item.audioItem.musicTrack"
+
+// didlLite is a DIDL-Lite document. encoding/xml does not write namespace
+// prefixes itself, so the prefixed names are spelled out in the tags and the
+// prefixes declared on the root element.
+type didlLite struct {
+	XMLName   xml.Name   `xml:"DIDL-Lite"`
+	Namespace string     `xml:"xmlns,attr"`
+	DC        string     `xml:"xmlns:dc,attr"`
+	UPnP      string     `xml:"xmlns:upnp,attr"`
+	Sonos     string     `xml:"xmlns:r,attr"`
+	Items     []didlItem `xml:"item"`
+}
+
+// didlItem is an item in a DIDL-Lite document
+type didlItem struct {
+	ID                  string  `xml:"id,attr"`
+	ParentID            string  `xml:"parentID,attr"`
+	Restricted          bool    `xml:"restricted,attr"`
+	Title               string  `xml:"dc:title"`
+	Class               string  `xml:"upnp:class"`
+	Creator             string  `xml:"dc:creator,omitempty"`
+	Album               string  `xml:"upnp:album,omitempty"`
+	OriginalTrackNumber int     `xml:"upnp:originalTrackNumber,omitempty"`
+	AlbumArtURI         string  `xml:"upnp:albumArtURI,omitempty"`
+	Res                 didlRes `xml:"res"`
+}
+
+// didlRes is the resource of an item: its URL and how to fetch it
+type didlRes struct {
+	ProtocolInfo string `xml:"protocolInfo,attr"`
+	Duration     string `xml:"duration,attr,omitempty"`
+	URL          string `xml:",chardata"`
+}
+
+// newDIDLLite returns a document holding items with the Sonos namespaces
+// declared
+func newDIDLLite(items ...didlItem) didlLite {
+	return didlLite{
+		Namespace: didlNamespace,
+		DC:        dcNamespace,
+		UPnP:      upnpNamespace,
+		Sonos:     sonosNamespace,
+		Items:     items,
+	}
+}
+
+// String encodes the document. Text is escaped by encoding/xml, so titles
+// such as "Tom & Jerry <Live>" stay well formed.
+func (d didlLite) String() string {
+	data, err := xml.Marshal(d)
+	if err != nil {
+		log.Printf("Failed to encode DIDL-Lite metadata: %v", err)
+		return ""
+	}
+	return string(data)
+}
+
+// trackMetadata returns the DIDL-Lite document describing item, sent as
+// EnqueuedURIMetaData so the Sonos app shows the title, artist, album and
+// cover art of each queued track
+func trackMetadata(item ListItem) string {
+	return newDIDLLite(trackDIDL(item)).String()
+}
+
+// trackDIDL returns the DIDL-Lite item describing item, served over HTTP as
+// its MIME type or else as MP3
+func trackDIDL(item ListItem) didlItem {
+	track := didlItem{
+		ID:                  "-1",
+		ParentID:            "-1",
+		Restricted:          true,
+		Title:               item.Title,
+		Class:               musicTrackClass,
+		Creator:             item.Artist,
+		Album:               item.Album,
+		OriginalTrackNumber: item.TrackNumber,
+		AlbumArtURI:         item.AlbumArtURI,
+		Res: didlRes{
+			ProtocolInfo: formatMP3.protocolInfo(),
+			URL:          item.URL,
+		},
+	}
+	if item.MIMEType != "" {
+		track.Res.ProtocolInfo = "http-get:*:" + item.MIMEType + ":*"
+	}
+	if item.DurationSeconds > 0 {
+		track.Res.Duration = formatTrackTime(item.DurationSeconds)
+	}
+	return track
+}
+
+// formatTrackTime formats seconds as the H:MM:SS track time Sonos uses, the
+// inverse of parseTrackTime
+func formatTrackTime(seconds int) string {
+	return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
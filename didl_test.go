@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// parsedTrack is a DIDL-Lite item decoded by namespace rather than prefix,
+// as a speaker would read it
+type parsedTrack struct {
+	Title       string `xml:"http://purl.org/dc/elements/1.1/ title"`
+	Creator     string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Album       string `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ album"`
+	Class       string `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ class"`
+	AlbumArtURI string `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ albumArtURI"`
+	TrackNumber int    `xml:"urn:schemas-upnp-org:metadata-1-0/upnp/ originalTrackNumber"`
+	Res         struct {
+		ProtocolInfo string `xml:"protocolInfo,attr"`
+		Duration     string `xml:"duration,attr"`
+		URL          string `xml:",chardata"`
+	} `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ res"`
+}
+
+func parseTrackMetadata(t *testing.T, metadata string) parsedTrack {
+	t.Helper()
+	var doc struct {
+		XMLName xml.Name
+		Items   []parsedTrack `xml:"urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/ item"`
+	}
+	if err := xml.Unmarshal([]byte(metadata), &doc); err != nil {
+		t.Fatalf("malformed metadata: %v\n%s", err, metadata)
+	}
+	if doc.XMLName.Space != didlNamespace || doc.XMLName.Local != "DIDL-Lite" {
+		t.Fatalf("expected DIDL-Lite root, got %v", doc.XMLName)
+	}
+	if len(doc.Items) != 1 {
+		t.Fatalf("expected 1 item, got %d in %s", len(doc.Items), metadata)
+	}
+	return doc.Items[0]
+}
+
+func TestTrackMetadata(t *testing.T) {
+	tests := []struct {
+		name  string
+		item  ListItem
+		texts []string
+	}{
+		{
+			name: "ampersand",
+			item: ListItem{
+				Title:  "Tom & Jerry",
+				Artist: "Simon & Garfunkel",
+				URL:    "http://192.168.4.88:8080/music/presets/5/Tom%20&%20Jerry.mp3?a=1&b=2",
+			},
+			texts: []string{
+				`<dc:title>Tom &amp; Jerry</dc:title>`,
+				`<dc:creator>Simon &amp; Garfunkel</dc:creator>`,
+				`>http://192.168.4.88:8080/music/presets/5/Tom%20&amp;%20Jerry.mp3?a=1&amp;b=2</res>`,
+			},
+		},
+		{
+			name: "angle brackets",
+			item: ListItem{
+				Title: "Tom & Jerry <Live>",
+				Album: "</upnp:album><evil/>",
+				URL:   "http://192.168.4.88:8080/music/presets/5/live.mp3",
+			},
+			texts: []string{
+				`<dc:title>Tom &amp; Jerry &lt;Live&gt;</dc:title>`,
+				`<upnp:album>&lt;/upnp:album&gt;&lt;evil/&gt;</upnp:album>`,
+			},
+		},
+		{
+			name: "quotes",
+			item: ListItem{
+				Title:  `Don't Stop "Believin'"`,
+				Artist: `The "Band"`,
+				URL:    `http://192.168.4.88:8080/music/presets/5/"quoted".mp3`,
+			},
+			texts: []string{
+				`<dc:title>Don&#39;t Stop &#34;Believin&#39;&#34;</dc:title>`,
+				`<dc:creator>The &#34;Band&#34;</dc:creator>`,
+			},
+		},
+		{
+			name: "non-ascii",
+			item: ListItem{
+				Title:  "Schöne Grüße – 子守唄 🎵",
+				Artist: "Ñandú",
+				URL:    "http://192.168.4.88:8080/music/presets/5/Sch%C3%B6ne%20Gr%C3%BC%C3%9Fe.mp3",
+			},
+			texts: []string{
+				`<dc:title>Schöne Grüße – 子守唄 🎵</dc:title>`,
+				`<dc:creator>Ñandú</dc:creator>`,
+			},
+		},
+		{
+			name: "all fields",
+			item: ListItem{
+				Title:           "Rock",
+				Artist:          "Artist",
+				Album:           "Greatest Hits",
+				TrackNumber:     4,
+				DurationSeconds: 3725,
+				AlbumArtURI:     "http://192.168.4.88:8080/art/presets/5/04%20Rock.mp3",
+				URL:             "http://192.168.4.88:8080/music/presets/5/04%20Rock.mp3",
+			},
+			texts: []string{
+				`<upnp:class>object.item.audioItem.musicTrack</upnp:class>`,
+				`<upnp:album>Greatest Hits</upnp:album>`,
+				`<upnp:originalTrackNumber>4</upnp:originalTrackNumber>`,
+				`<upnp:albumArtURI>http://192.168.4.88:8080/art/presets/5/04%20Rock.mp3</upnp:albumArtURI>`,
+				`<res protocolInfo="http-get:*:audio/mpeg:*" duration="1:02:05">`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := trackMetadata(tt.item)
+			for _, want := range append(tt.texts,
+				`xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/"`,
+				`xmlns:dc="http://purl.org/dc/elements/1.1/"`,
+				`xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/"`,
+				`xmlns:r="urn:schemas-rinconnetworks-com:metadata-1-0/"`,
+				`<item id="-1" parentID="-1" restricted="true">`,
+			) {
+				if !strings.Contains(metadata, want) {
+					t.Errorf("expected %s in %s", want, metadata)
+				}
+			}
+
+			// The document parses back to the same values
+			got := parseTrackMetadata(t, metadata)
+			if got.Title != tt.item.Title || got.Creator != tt.item.Artist || got.Album != tt.item.Album ||
+				got.TrackNumber != tt.item.TrackNumber || got.AlbumArtURI != tt.item.AlbumArtURI ||
+				got.Res.URL != tt.item.URL || got.Class != musicTrackClass {
+				t.Errorf("expected %+v, got %+v", tt.item, got)
+			}
+			if title := didlTitle(metadata); title != tt.item.Title {
+				t.Errorf("expected didlTitle %q, got %q", tt.item.Title, title)
+			}
+		})
+	}
+}
+
+func TestTrackMetadataOmitsEmptyFields(t *testing.T) {
+	metadata := trackMetadata(ListItem{Title: "Plain", URL: "http://192.168.4.88:8080/music/plain.mp3"})
+	for _, unwanted := range []string{"dc:creator", "upnp:album", "originalTrackNumber", "albumArtURI", "duration="} {
+		if strings.Contains(metadata, unwanted) {
+			t.Errorf("expected no %s in %s", unwanted, metadata)
+		}
+	}
+}
+
+func TestSpecialFilenamesEnqueued(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writeMusicFile(t, dir, "presets/7/01 Tom & Jerry <Live>.mp3", "a")
+	writeMusicFile(t, dir, "presets/7/02 Schöne Grüße \"Mix\".mp3", "b")
+	useMusicDir(t, dir)
+
+	rr := serve(t, "POST", "/sonos/preset/7", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	queue := fake.Queue()
+	if len(queue) != 2 {
+		t.Fatalf("expected 2 queued tracks, got %d", len(queue))
+	}
+	for i, want := range []struct{ title, url string }{
+		{"01 Tom & Jerry <Live>", "http://192.168.4.88:8080/music/presets/7/01%20Tom%20&%20Jerry%20%3CLive%3E.mp3"},
+		{"02 Schöne Grüße \"Mix\"", "http://192.168.4.88:8080/music/presets/7/02%20Sch%C3%B6ne%20Gr%C3%BC%C3%9Fe%20%22Mix%22.mp3"},
+	} {
+		got := parseTrackMetadata(t, queue[i].Metadata)
+		if got.Title != want.title {
+			t.Errorf("expected title %q, got %q", want.title, got.Title)
+		}
+		if got.Res.URL != want.url || queue[i].URI != want.url {
+			t.Errorf("expected URL %s, got %s and %s", want.url, got.Res.URL, queue[i].URI)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Kinds of SpeakerChange
+const (
+	SpeakerAdded   = "added"
+	SpeakerRemoved = "removed"
+	SpeakerMoved   = "moved"
+)
+
+// SpeakerChange describes how a speaker differs between two discovery sweeps
+type SpeakerChange struct {
+	Kind       string  `json:"kind"`
+	Speaker    Speaker `json:"speaker"`
+	OldAddress string  `json:"old_address,omitempty"`
+}
+
+// Discoverer runs discovery sweeps against a registry, serializing them so
+// the startup sweep, the periodic loop and /api/sonos/discover never run SSDP
+// concurrently, and reports what changed after each sweep.
+type Discoverer struct {
+	registry *SpeakerRegistry
+	discover func() ([]SpeakerInfo, error)
+
+	// cooldown is the minimum time between sweeps requested with Trigger
+	cooldown time.Duration
+
+	sweepMu   sync.Mutex
+	mu        sync.Mutex
+	lastSweep time.Time
+	listeners []func([]SpeakerChange)
+	trigger   chan struct{}
+}
+
+// NewDiscoverer returns a Discoverer that updates registry using discover
+func NewDiscoverer(registry *SpeakerRegistry, discover func() ([]SpeakerInfo, error)) *Discoverer {
+	return &Discoverer{
+		registry: registry,
+		discover: discover,
+		cooldown: 30 * time.Second,
+		trigger:  make(chan struct{}, 1),
+	}
+}
+
+// OnChange registers fn to be called with the changes from every sweep that
+// changed the registry
+func (d *Discoverer) OnChange(fn func([]SpeakerChange)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.listeners = append(d.listeners, fn)
+}
+
+// Sweep runs one discovery pass, logs and publishes any changes to the
+// registry and returns the speakers found.
+func (d *Discoverer) Sweep() ([]SpeakerInfo, []SpeakerChange, error) {
+	d.sweepMu.Lock()
+	defer d.sweepMu.Unlock()
+
+	before := d.registry.List()
+	speakers, err := d.discover()
+
+	d.mu.Lock()
+	d.lastSweep = time.Now()
+	listeners := make([]func([]SpeakerChange), len(d.listeners))
+	copy(listeners, d.listeners)
+	d.mu.Unlock()
+
+	changes := diffSpeakers(before, d.registry.List())
+	for _, change := range changes {
+		switch change.Kind {
+		case SpeakerAdded:
+			log.Printf("Speaker added: %s (%s) at %s", change.Speaker.Name, change.Speaker.UUID, change.Speaker.Address)
+		case SpeakerRemoved:
+			log.Printf("Speaker removed: %s (%s) last seen at %s", change.Speaker.Name, change.Speaker.UUID, change.Speaker.Address)
+		case SpeakerMoved:
+			log.Printf("Speaker moved: %s (%s) from %s to %s", change.Speaker.Name, change.Speaker.UUID, change.OldAddress, change.Speaker.Address)
+		}
+	}
+	if len(changes) > 0 {
+		for _, fn := range listeners {
+			fn(changes)
+		}
+	}
+
+	return speakers, changes, err
+}
+
+// Trigger requests a sweep from the Run loop without waiting for it. Requests
+// made while one is already pending are coalesced.
+func (d *Discoverer) Trigger(reason string) {
+	select {
+	case d.trigger <- struct{}{}:
+		log.Printf("Rediscovery requested: %s", reason)
+	default:
+	}
+}
+
+// Run sweeps every interval and whenever Trigger is called until ctx is done.
+// An interval of zero or less disables periodic sweeps; triggered sweeps still
+// run, but no more often than the cooldown allows. A trigger during the
+// cooldown runs one sweep when it ends, unless another sweep has run by then.
+func (d *Discoverer) Run(ctx context.Context, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// pending fires when the cooldown ends after a trigger during it
+	var pending <-chan time.Time
+	var pendingSince time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			log.Println("Running periodic Sonos discovery...")
+		case <-d.trigger:
+			d.mu.Lock()
+			wait := d.cooldown - time.Since(d.lastSweep)
+			d.mu.Unlock()
+			if wait > 0 {
+				if pending == nil {
+					log.Printf("Deferring rediscovery for %s, last sweep was less than %s ago", wait.Round(time.Second), d.cooldown)
+					pending = time.After(wait)
+					pendingSince = time.Now()
+				}
+				continue
+			}
+			log.Println("Running triggered Sonos discovery...")
+		case <-pending:
+			pending = nil
+			d.mu.Lock()
+			swept := d.lastSweep.After(pendingSince)
+			d.mu.Unlock()
+			if swept {
+				continue
+			}
+			log.Println("Running deferred Sonos discovery...")
+		}
+
+		if _, _, err := d.Sweep(); err != nil {
+			log.Printf("Background discovery failed: %v", err)
+		}
+	}
+}
+
+// diffSpeakers compares registry snapshots taken before and after a sweep
+func diffSpeakers(before, after []Speaker) []SpeakerChange {
+	old := make(map[string]Speaker, len(before))
+	for _, speaker := range before {
+		old[speaker.UUID] = speaker
+	}
+
+	var changes []SpeakerChange
+	for _, speaker := range after {
+		prev, ok := old[speaker.UUID]
+		switch {
+		case !ok:
+			changes = append(changes, SpeakerChange{Kind: SpeakerAdded, Speaker: speaker})
+		case prev.Address != speaker.Address:
+			changes = append(changes, SpeakerChange{Kind: SpeakerMoved, Speaker: speaker, OldAddress: prev.Address})
+		}
+		delete(old, speaker.UUID)
+	}
+	for _, speaker := range before {
+		if _, ok := old[speaker.UUID]; ok {
+			changes = append(changes, SpeakerChange{Kind: SpeakerRemoved, Speaker: speaker})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiffSpeakers(t *testing.T) {
+	before := []Speaker{
+		{UUID: "RINCON_A", Name: "Kids Room", Address: "192.168.4.129"},
+		{UUID: "RINCON_B", Name: "Kitchen", Address: "192.168.4.130"},
+		{UUID: "RINCON_C", Name: "Garage", Address: "192.168.4.131"},
+	}
+	after := []Speaker{
+		{UUID: "RINCON_A", Name: "Kids Room", Address: "192.168.4.200"},
+		{UUID: "RINCON_B", Name: "Kitchen", Address: "192.168.4.130"},
+		{UUID: "RINCON_D", Name: "Office", Address: "192.168.4.132"},
+	}
+
+	changes := diffSpeakers(before, after)
+	want := []SpeakerChange{
+		{Kind: SpeakerMoved, Speaker: after[0], OldAddress: "192.168.4.129"},
+		{Kind: SpeakerAdded, Speaker: after[2]},
+		{Kind: SpeakerRemoved, Speaker: before[2]},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("expected %d changes, got %d: %+v", len(want), len(changes), changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("change %d: expected %+v, got %+v", i, want[i], changes[i])
+		}
+	}
+
+	if changes := diffSpeakers(before, before); len(changes) != 0 {
+		t.Errorf("expected no changes for identical snapshots, got %+v", changes)
+	}
+}
+
+func TestDiscovererSweepNotifiesChanges(t *testing.T) {
+	registry := NewSpeakerRegistry()
+	registry.Put(Speaker{UUID: "RINCON_A", Name: "Kids Room", Address: "192.168.4.129"})
+
+	d := NewDiscoverer(registry, func() ([]SpeakerInfo, error) {
+		registry.Put(Speaker{UUID: "RINCON_A", Name: "Kids Room", Address: "192.168.4.200"})
+		return []SpeakerInfo{{Name: "Kids Room", IP: "192.168.4.200"}}, nil
+	})
+
+	var notified []SpeakerChange
+	d.OnChange(func(changes []SpeakerChange) {
+		notified = append(notified, changes...)
+	})
+
+	speakers, changes, err := d.Sweep()
+	if err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+	if len(speakers) != 1 {
+		t.Errorf("expected 1 speaker, got %d", len(speakers))
+	}
+	if len(changes) != 1 || changes[0].Kind != SpeakerMoved || changes[0].OldAddress != "192.168.4.129" {
+		t.Errorf("expected a single move from 192.168.4.129, got %+v", changes)
+	}
+	if len(notified) != 1 {
+		t.Errorf("expected listener to receive 1 change, got %d", len(notified))
+	}
+
+	// A sweep that changes nothing does not notify
+	notified = nil
+	if _, _, err := d.Sweep(); err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+	if len(notified) != 0 {
+		t.Errorf("expected no notification, got %+v", notified)
+	}
+}
+
+func TestDiscovererRunTriggeredSweep(t *testing.T) {
+	var sweeps atomic.Int32
+	swept := make(chan struct{}, 10)
+	d := NewDiscoverer(NewSpeakerRegistry(), func() ([]SpeakerInfo, error) {
+		sweeps.Add(1)
+		swept <- struct{}{}
+		return nil, errors.New("no suitable network interfaces found")
+	})
+	d.cooldown = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx, 0)
+		close(done)
+	}()
+
+	d.Trigger("test")
+	select {
+	case <-swept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("triggered sweep did not run")
+	}
+
+	cancel()
+	<-done
+	if n := sweeps.Load(); n != 1 {
+		t.Errorf("expected 1 sweep, got %d", n)
+	}
+}
+
+func TestDiscovererTriggerCooldown(t *testing.T) {
+	swept := make(chan struct{}, 10)
+	d := NewDiscoverer(NewSpeakerRegistry(), func() ([]SpeakerInfo, error) {
+		swept <- struct{}{}
+		return nil, nil
+	})
+	d.cooldown = time.Hour
+	d.Sweep()
+	<-swept
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx, 0)
+
+	d.Trigger("test")
+	select {
+	case <-swept:
+		t.Error("expected trigger within the cooldown to be skipped")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDiscovererTriggerAfterCooldown(t *testing.T) {
+	swept := make(chan struct{}, 10)
+	d := NewDiscoverer(NewSpeakerRegistry(), func() ([]SpeakerInfo, error) {
+		swept <- struct{}{}
+		return nil, nil
+	})
+	d.cooldown = 200 * time.Millisecond
+	d.Sweep()
+	<-swept
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx, 0)
+
+	// Both triggers fall within the cooldown and run a single sweep once it
+	// is over
+	d.Trigger("test")
+	d.Trigger("test")
+	select {
+	case <-swept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the deferred trigger to sweep after the cooldown")
+	}
+	select {
+	case <-swept:
+		t.Error("expected triggers within the cooldown to run one sweep")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestOpenSpeakerTriggersRediscovery(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	fake.server.Close()
+
+	oldDiscoverer := speakerDiscoverer
+	speakerDiscoverer = NewDiscoverer(speakerRegistry, func() ([]SpeakerInfo, error) { return nil, nil })
+	t.Cleanup(func() { speakerDiscoverer = oldDiscoverer })
+
+	if rr := serve(t, "POST", "/sonos/pause", ""); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", rr.Code)
+	}
+	select {
+	case <-speakerDiscoverer.trigger:
+	default:
+		t.Error("expected failed connection to request rediscovery")
+	}
+}
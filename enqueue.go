@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ianr0bkny/go-sonos/upnp"
+)
+
+// queueFillers runs the background jobs that add the rest of a playlist to a
+// speaker's queue once playback has started with its first track
+var queueFillers = newQueueFiller()
+
+// queueFiller tracks at most one background enqueue per speaker, so starting
+// a new playlist stops the tracks of the previous one from being appended to
+// it
+type queueFiller struct {
+	mu   sync.Mutex
+	jobs map[string]*fillJob
+	// fills is the progress of the latest background enqueue of each
+	// speaker, kept after it finishes so failed tracks can be reported
+	fills map[string]*queueFillState
+	wg    sync.WaitGroup
+}
+
+// fillJob is a running background enqueue
+type fillJob struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// queueFillState reports the background enqueue of a playlist in a command's
+// state. Until Filling is false the rest of the queue is unverified.
+type queueFillState struct {
+	Filling      bool     `json:"filling"`
+	Added        int      `json:"added"`
+	Remaining    int      `json:"remaining"`
+	FailedTracks []string `json:"failed_tracks,omitempty"`
+}
+
+// newQueueFiller returns a queueFiller with no jobs
+func newQueueFiller() *queueFiller {
+	return &queueFiller{jobs: make(map[string]*fillJob), fills: make(map[string]*queueFillState)}
+}
+
+// Start adds items to the end of the queue of speaker with s in the
+// background. A track that fails to enqueue is skipped and reported by
+// Status.
+func (q *queueFiller) Start(speaker Speaker, s SpeakerController, items []ListItem) {
+	q.Stop(speaker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &fillJob{cancel: cancel, done: make(chan struct{})}
+	key := speakerKey(speaker)
+	fill := &queueFillState{Filling: true, Remaining: len(items)}
+
+	q.mu.Lock()
+	q.jobs[key] = job
+	q.fills[key] = fill
+	q.wg.Add(1)
+	q.mu.Unlock()
+
+	go func() {
+		defer q.wg.Done()
+		defer close(job.done)
+		defer func() {
+			q.mu.Lock()
+			if q.jobs[key] == job {
+				delete(q.jobs, key)
+			}
+			q.mu.Unlock()
+		}()
+
+		defer func() {
+			q.mu.Lock()
+			fill.Filling = false
+			q.mu.Unlock()
+		}()
+
+		added := 0
+		for _, item := range items {
+			if ctx.Err() != nil {
+				log.Printf("Stopped adding tracks to %s after %d of %d", speaker.Name, added, len(items))
+				return
+			}
+			err := enqueueTrack(s, item)
+			if err != nil {
+				log.Printf("Warning: failed to add track %s to %s: %v", item.URL, speaker.Name, err)
+			} else {
+				added++
+			}
+			q.mu.Lock()
+			fill.Remaining--
+			fill.Added = added
+			if err != nil {
+				fill.FailedTracks = append(fill.FailedTracks, item.Filename)
+			}
+			q.mu.Unlock()
+		}
+		log.Printf("Added %d remaining tracks to the queue of %s", added, speaker.Name)
+	}()
+}
+
+// Status returns the progress of the latest background enqueue of speaker,
+// if it had one
+func (q *queueFiller) Status(speaker Speaker) (*queueFillState, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fill, ok := q.fills[speakerKey(speaker)]
+	if !ok {
+		return nil, false
+	}
+	status := *fill
+	status.FailedTracks = append([]string(nil), fill.FailedTracks...)
+	return &status, true
+}
+
+// Stop cancels the background enqueue of speaker, if any, and waits for it
+// to finish its current track. Its status is dropped with the queue it was
+// filling.
+func (q *queueFiller) Stop(speaker Speaker) {
+	q.mu.Lock()
+	job := q.jobs[speakerKey(speaker)]
+	delete(q.fills, speakerKey(speaker))
+	q.mu.Unlock()
+	if job == nil {
+		return
+	}
+	job.cancel()
+	<-job.done
+}
+
+// Wait blocks until every background enqueue has finished
+func (q *queueFiller) Wait() {
+	q.wg.Wait()
+}
+
+// speakerKey identifies a speaker across connections
+func speakerKey(speaker Speaker) string {
+	if speaker.UUID != "" {
+		return speaker.UUID
+	}
+	return speaker.Name
+}
+
+// enqueueTrack adds item to the end of the queue with its metadata
+func enqueueTrack(s SpeakerController, item ListItem) error {
+	return enqueueURI(s, item.URL, trackMetadata(item))
+}
+
+// enqueueURI adds uri to the end of the queue with the DIDL-Lite metadata
+func enqueueURI(s SpeakerController, uri, metadata string) error {
+	log.Printf("Adding track to queue: %s", uri)
+	out, err := s.AddURIToQueue(&upnp.AddURIToQueueIn{
+		EnqueuedURI:         uri,
+		EnqueuedURIMetaData: metadata,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Added track %s at position %d", uri, out.FirstTrackNumberEnqueued)
+	return nil
+}
+
+// queueSnapshot is what a speaker was playing before its queue was replaced:
+// the queue, the transport source and the position in it
+type queueSnapshot struct {
+	tracks   []snapshotTrack
+	uri      string
+	metadata string
+	track    int
+	relTime  string
+	playing  bool
+	// volume is the volume before the new queue changed it, or nil when it
+	// was left alone
+	volume *uint16
+}
+
+// snapshotTrack is a queued track with the protocolInfo it was queued with,
+// so a file share or stream is queued again the way it was rather than as
+// an MP3 served over HTTP
+type snapshotTrack struct {
+	item         ListItem
+	protocolInfo string
+}
+
+// metadata returns the DIDL-Lite document to queue the track again with
+func (track snapshotTrack) metadata() string {
+	didl := trackDIDL(track.item)
+	if track.protocolInfo != "" {
+		didl.Res.ProtocolInfo = track.protocolInfo
+	}
+	return newDIDLLite(didl).String()
+}
+
+// restorable reports whether the track can be queued again from what the
+// queue reports. Tracks from music services such as Spotify need the
+// account details of the service, which the queue does not include.
+func (track snapshotTrack) restorable() bool {
+	return !strings.HasPrefix(track.item.URL, "x-sonos-") && !strings.HasPrefix(track.protocolInfo, "sonos.com-")
+}
+
+// takeQueueSnapshot records the queue, source and position of s so that
+// restore can put them back
+func takeQueueSnapshot(s SpeakerController) (*queueSnapshot, error) {
+	media, err := s.GetMediaInfo()
+	if err != nil {
+		return nil, fmt.Errorf("media info: %w", err)
+	}
+	items, err := s.GetQueueItems()
+	if err != nil {
+		return nil, fmt.Errorf("queue contents: %w", err)
+	}
+	snapshot := &queueSnapshot{uri: media.CurrentURI, metadata: media.CurrentURIMetaData}
+	for i, item := range items {
+		track := snapshotTrack{item: ListItem{Index: i}}
+		if len(item.Res) > 0 {
+			track.item.URL = item.Res[0].Value
+			track.protocolInfo = item.Res[0].ProtocolInfo
+		}
+		if len(item.Title) > 0 {
+			track.item.Title = item.Title[0].Value
+		}
+		if len(item.Creator) > 0 {
+			track.item.Artist = item.Creator[0].Value
+		}
+		if len(item.Album) > 0 {
+			track.item.Album = item.Album[0].Value
+		}
+		if len(item.OriginalTrackNumber) > 0 {
+			track.item.TrackNumber, _ = strconv.Atoi(item.OriginalTrackNumber[0].Value)
+		}
+		if len(item.AlbumArtURI) > 0 {
+			track.item.AlbumArtURI = item.AlbumArtURI[0].Value
+		}
+		snapshot.tracks = append(snapshot.tracks, track)
+	}
+
+	if position, err := s.GetPositionInfo(); err == nil {
+		snapshot.track = int(position.Track)
+		snapshot.relTime = position.RelTime
+	}
+	if info, err := s.GetTransportInfo(); err == nil {
+		snapshot.playing = info.CurrentTransportState == upnp.State_PLAYING
+	}
+	return snapshot, nil
+}
+
+// recordVolume adds the current volume of s to the snapshot, before a new
+// queue changes it. Without it the volume is not restored.
+func (snapshot *queueSnapshot) recordVolume(s SpeakerController) {
+	volume, err := s.GetVolume()
+	if err != nil {
+		log.Printf("Warning: failed to save the volume, it cannot be restored on failure: %v", err)
+		return
+	}
+	snapshot.volume = &volume
+}
+
+// restore puts the snapshot back on s: the queue, then the source, the
+// track and time within it, the volume, and playback if it was playing. Tracks that
+// cannot be queued again are skipped and returned in the error.
+func (snapshot *queueSnapshot) restore(s SpeakerController) error {
+	var errs []error
+	if snapshot.volume != nil {
+		if err := s.SetVolume(*snapshot.volume); err != nil {
+			errs = append(errs, fmt.Errorf("volume: %w", err))
+		}
+	}
+	if err := s.RemoveAllTracksFromQueue(); err != nil {
+		return errors.Join(append(errs, fmt.Errorf("clear queue: %w", err))...)
+	}
+	// Skipped tracks move the ones after them up the queue, so current is
+	// the number of the playing track once restored, and exact is set when
+	// that is the track itself rather than the one after it
+	queued, current, exact := 0, 0, false
+	for i, track := range snapshot.tracks {
+		var err error
+		if !track.restorable() {
+			err = errNotRestorable
+		} else {
+			err = enqueueURI(s, track.item.URL, track.metadata())
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("track %s: %w", track.item.URL, err))
+		} else {
+			queued++
+		}
+		if i+1 == snapshot.track {
+			current, exact = queued, err == nil
+			if !exact {
+				current++
+			}
+		}
+	}
+	current = min(current, queued)
+	if snapshot.uri == "" {
+		return errors.Join(errs...)
+	}
+
+	if err := s.SetAVTransportURI(snapshot.uri, snapshot.metadata); err != nil {
+		return errors.Join(append(errs, fmt.Errorf("set source: %w", err))...)
+	}
+	if strings.HasPrefix(snapshot.uri, "x-rincon-queue:") && current > 0 {
+		if err := s.Seek("TRACK_NR", strconv.Itoa(current)); err != nil {
+			errs = append(errs, fmt.Errorf("seek to track %d: %w", current, err))
+		} else if exact && parseTrackTime(snapshot.relTime) > 0 {
+			if err := s.Seek("REL_TIME", snapshot.relTime); err != nil {
+				errs = append(errs, fmt.Errorf("seek to %s: %w", snapshot.relTime, err))
+			}
+		}
+	}
+	if snapshot.playing {
+		if err := s.Play(); err != nil {
+			errs = append(errs, fmt.Errorf("play: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// errNotRestorable is returned for a track restore skips because it cannot
+// be queued again faithfully
+var errNotRestorable = errors.New("music service tracks cannot be queued again")
+
+// rollbackQueue restores snapshot after starting a new queue failed with
+// err, a commandError, and returns err with the tracks that failed and the
+// outcome of the restore
+func rollbackQueue(c *commandContext, snapshot *queueSnapshot, err error) error {
+	var cmdErr *commandError
+	if !errors.As(err, &cmdErr) {
+		cmdErr = commandFailed("Failed to start the queue", err).(*commandError)
+	}
+	cmdErr.failedTracks = c.failedTracks
+
+	if snapshot == nil {
+		cmdErr.message += "; the previous queue could not be restored"
+		return cmdErr
+	}
+	log.Printf("Restoring the previous queue of %s (%d tracks)", c.speaker.Name, len(snapshot.tracks))
+	if rerr := snapshot.restore(c.s); rerr != nil {
+		log.Printf("Failed to restore the queue of %s: %v", c.speaker.Name, rerr)
+		cmdErr.message += "; the previous queue could not be fully restored"
+		if errors.Is(rerr, errNotRestorable) {
+			cmdErr.message += " (" + errNotRestorable.Error() + ")"
+		}
+		return cmdErr
+	}
+	cmdErr.message += "; the previous queue was restored"
+	return cmdErr
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveNoWait sends a request through the full route table like serve, but
+// without waiting for background enqueues, failing the test if the response
+// takes longer than a few seconds. It asks for a JSON reply like serveJSON.
+func serveNoWait(t *testing.T, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		corsMiddleware(setupRoutes()).ServeHTTP(rr, req)
+		done <- rr
+	}()
+	select {
+	case rr := <-done:
+		return rr
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s %s did not respond", method, path)
+		return nil
+	}
+}
+
+// writePreset writes n silent tracks to preset num of the music dir at dir
+func writePreset(t *testing.T, dir, num string, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		writeMusicFile(t, dir, fmt.Sprintf("presets/%s/%02d Track.mp3", num, i), string(mpegFrames(1)))
+	}
+}
+
+func TestPresetPlaysBeforeQueueIsFull(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 5)
+	useMusicDir(t, dir)
+
+	// Every track after the first waits for release
+	release := fake.Hold("AddURIToQueue", 1)
+	t.Cleanup(release)
+
+	rr := serveNoWait(t, "POST", "/sonos/preset/7", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if queue := fake.Queue(); len(queue) != 1 || !strings.HasSuffix(queue[0].URI, "/01%20Track.mp3") {
+		t.Errorf("expected only the first track queued before responding, got %+v", queue)
+	}
+	if state, track, _, _ := fake.State(); state != "PLAYING" || track != 1 {
+		t.Errorf("expected playback of track 1, got %s track %d", state, track)
+	}
+
+	// A track that fails in the background is skipped
+	fake.Fail("AddURIToQueue", 1)
+	release()
+	queueFillers.Wait()
+
+	queue := fake.Queue()
+	var got []string
+	for _, track := range queue {
+		got = append(got, track.URI[strings.LastIndex(track.URI, "/")+1:])
+	}
+	want := []string{"01%20Track.mp3", "03%20Track.mp3", "04%20Track.mp3", "05%20Track.mp3"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("expected queue %v, got %v", want, got)
+	}
+}
+
+func TestNewPresetStopsBackgroundEnqueue(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 5)
+	writePreset(t, dir, "8", 2)
+	useMusicDir(t, dir)
+
+	release := fake.Hold("AddURIToQueue", 1)
+	t.Cleanup(release)
+	if rr := serveNoWait(t, "POST", "/sonos/preset/7", ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// The second preset waits for the first to finish its current track,
+	// then replaces the queue
+	second := make(chan *httptest.ResponseRecorder, 1)
+	go func() { second <- serve(t, "POST", "/sonos/preset/8", "") }()
+	time.Sleep(50 * time.Millisecond)
+	release()
+	rr := <-second
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	queue := fake.Queue()
+	if len(queue) != 2 {
+		t.Fatalf("expected the 2 tracks of preset 8, got %+v", queue)
+	}
+	for _, track := range queue {
+		if !strings.Contains(track.URI, "/presets/8/") {
+			t.Errorf("expected only preset 8 tracks, got %s", track.URI)
+		}
+	}
+}
+
+// queueFiles returns the file names of the queued tracks
+func queueFiles(queue []fakeTrack) []string {
+	var files []string
+	for _, track := range queue {
+		files = append(files, track.URI[strings.LastIndex(track.URI, "/")+1:])
+	}
+	return files
+}
+
+func TestFailedPresetRestoresQueue(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 2)
+	writePreset(t, dir, "8", 3)
+	useMusicDir(t, dir)
+
+	// Preset 8 is playing its second track
+	if rr := serve(t, "POST", "/sonos/preset/8", ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(t, "POST", "/sonos/next", ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	fake.SetPosition("0:01:30")
+	before := fake.Queue()
+	sourceBefore := fake.TransportURI()
+
+	_, _, volumeBefore, _ := fake.State()
+
+	// Every track of preset 7 fails
+	fake.Fail("AddURIToQueue", 2)
+	rr, response := serveJSON(t, "POST", "/sonos/preset/7", `{"volume": 60}`)
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if want := []string{"01 Track.mp3", "02 Track.mp3"}; strings.Join(response.FailedTracks, ",") != strings.Join(want, ",") {
+		t.Errorf("expected failed tracks %v, got %v", want, response.FailedTracks)
+	}
+	if !strings.Contains(response.Message, "the previous queue was restored") {
+		t.Errorf("expected the restore to be reported, got %q", response.Message)
+	}
+
+	if got, want := queueFiles(fake.Queue()), queueFiles(before); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("expected queue %v restored, got %v", want, got)
+	}
+	if uri := fake.TransportURI(); uri != sourceBefore {
+		t.Errorf("expected source %s restored, got %s", sourceBefore, uri)
+	}
+	state, track, volume, _ := fake.State()
+	if state != "PLAYING" || track != 2 {
+		t.Errorf("expected track 2 playing again, got %s track %d", state, track)
+	}
+	if volume != volumeBefore {
+		t.Errorf("expected volume %d restored, got %d", volumeBefore, volume)
+	}
+	if position := fake.Position(); position != "0:01:30" {
+		t.Errorf("expected the position restored, got %s", position)
+	}
+}
+
+func TestFailedPresetRestoresQueueSources(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 2)
+	useMusicDir(t, dir)
+
+	// Another controller queued a file from a share, a Spotify track and a
+	// stream, and is playing the stream
+	share := newDIDLLite(didlItem{Title: "Share", Res: didlRes{ProtocolInfo: "x-file-cifs:*:audio/flac:*", URL: "x-file-cifs://nas/music/a.flac"}}).String()
+	spotify := newDIDLLite(didlItem{Title: "Spotify", Res: didlRes{ProtocolInfo: "sonos.com-spotify:*:audio/x-spotify:*", URL: "x-sonos-spotify:spotify%3atrack%3a1"}}).String()
+	stream := newDIDLLite(didlItem{Title: "Stream", Res: didlRes{ProtocolInfo: "http-get:*:audio/aac:*", URL: "http://radio.example.com/a.aac"}}).String()
+	fake.SetQueue(3,
+		fakeTrack{URI: "x-file-cifs://nas/music/a.flac", Metadata: share},
+		fakeTrack{URI: "x-sonos-spotify:spotify%3atrack%3a1", Metadata: spotify},
+		fakeTrack{URI: "http://radio.example.com/a.aac", Metadata: stream},
+	)
+
+	fake.Fail("AddURIToQueue", 2)
+	rr, response := serveJSON(t, "POST", "/sonos/preset/7", "")
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(response.Message, "could not be fully restored (music service tracks cannot be queued again)") {
+		t.Errorf("expected the skipped track to be reported, got %q", response.Message)
+	}
+
+	queue := fake.Queue()
+	if len(queue) != 2 {
+		t.Fatalf("expected the share and the stream restored, got %+v", queue)
+	}
+	for i, want := range []string{"x-file-cifs:*:audio/flac:*", "http-get:*:audio/aac:*"} {
+		if got := fakeTrackProtocolInfo(queue[i].Metadata); got != want {
+			t.Errorf("track %d: expected protocolInfo %s, got %s", i+1, want, got)
+		}
+	}
+	// The stream moved up to track 2 with the Spotify track gone
+	if state, track, _, _ := fake.State(); state != "PLAYING" || track != 2 {
+		t.Errorf("expected track 2 playing again, got %s track %d", state, track)
+	}
+}
+
+func TestFailedSourceRestoresStream(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 2)
+	useMusicDir(t, dir)
+
+	radio := "x-rincon-mp3radio://radio.example.com/kids.mp3"
+	fake.SetSource(radio, "<DIDL-Lite/>")
+	fake.Fail("SetAVTransportURI", 1)
+
+	rr, response := serveJSON(t, "POST", "/sonos/preset/7", "")
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.HasPrefix(response.Message, "Failed to set queue for playback") || len(response.FailedTracks) != 0 {
+		t.Errorf("unexpected response %+v", response)
+	}
+	if uri := fake.TransportURI(); uri != radio {
+		t.Errorf("expected the stream restored, got %s", uri)
+	}
+	if state, _, _, _ := fake.State(); state != "PLAYING" {
+		t.Errorf("expected the stream playing again, got %s", state)
+	}
+	if queue := fake.Queue(); len(queue) != 0 {
+		t.Errorf("expected the empty queue restored, got %+v", queue)
+	}
+}
+
+func TestBackgroundFailedTracksAreReported(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 3)
+	useMusicDir(t, dir)
+
+	// Hold the background enqueue so the response sees it unfinished
+	release := fake.Hold("AddURIToQueue", 1)
+	defer release()
+	rr := serveNoWait(t, "POST", "/sonos/preset/7", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response commandResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", rr.Body.String(), err)
+	}
+	if fill := response.State.QueueFill; fill == nil || !fill.Filling || fill.Remaining != 2 {
+		t.Errorf("expected 2 tracks still to queue, got %+v", fill)
+	}
+
+	fake.Fail("AddURIToQueue", 1)
+	release()
+	queueFillers.Wait()
+
+	rr, response = serveJSON(t, "GET", "/sonos/status", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	fill := response.State.QueueFill
+	if fill == nil || fill.Filling || fill.Added != 1 || strings.Join(fill.FailedTracks, ",") != "02 Track.mp3" {
+		t.Errorf("expected the second track reported as failed, got %+v", fill)
+	}
+	if !strings.Contains(response.Message, "1 tracks failed to queue") {
+		t.Errorf("expected the failure in the status line, got %q", response.Message)
+	}
+}
+
+func TestFailedTrackIsSkipped(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 3)
+	useMusicDir(t, dir)
+
+	fake.Fail("AddURIToQueue", 1)
+	rr, response := serveJSON(t, "POST", "/sonos/preset/7", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(response.FailedTracks) != 1 || response.FailedTracks[0] != "01 Track.mp3" {
+		t.Errorf("expected the first track reported as failed, got %v", response.FailedTracks)
+	}
+	if got := queueFiles(fake.Queue()); strings.Join(got, " ") != "02%20Track.mp3 03%20Track.mp3" {
+		t.Errorf("expected the remaining tracks queued, got %v", got)
+	}
+}
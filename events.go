@@ -0,0 +1,585 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventServices are the Sonos services whose GENA events feed the live
+// speaker state, with the event subscription path Sonos serves them on
+var eventServices = []struct {
+	name string
+	path string
+}{
+	{"AVTransport", "/MediaRenderer/AVTransport/Event"},
+	{"RenderingControl", "/MediaRenderer/RenderingControl/Event"},
+}
+
+// eventCallbackPath is the route speakers send NOTIFY requests to, followed
+// by the speaker UUID and service name
+const eventCallbackPath = "/upnp/event/"
+
+// subscriptionTimeout is the subscription duration requested from speakers.
+// Subscriptions are renewed when less than a third of it remains.
+const subscriptionTimeout = 30 * time.Minute
+
+// speakerEvents tracks the live state of every registered speaker
+var speakerEvents = NewEventSubscriber(speakerRegistry, func() string { return resourceHost })
+
+// speakerEvent is the state of one speaker as sent to event stream clients
+type speakerEvent struct {
+	UUID    string       `json:"uuid"`
+	Speaker string       `json:"speaker"`
+	State   speakerState `json:"state"`
+}
+
+// subscription is a GENA subscription to one service of a speaker
+type subscription struct {
+	sid     string
+	speaker Speaker
+	service string
+	path    string
+	expires time.Time
+}
+
+// EventSubscriber subscribes to AVTransport and RenderingControl events of
+// the registered speakers, keeps their live state from the NOTIFY requests
+// the speakers send back, and streams state changes to Server-Sent Events
+// clients. It replaces the go-sonos reactor, which registers its callback
+// route on the default mux.
+type EventSubscriber struct {
+	registry     *SpeakerRegistry
+	callbackHost func() string
+	client       *http.Client
+
+	// reconcileMu keeps the Run loop and discovery changes from
+	// subscribing to the same speaker twice
+	reconcileMu sync.Mutex
+
+	mu       sync.Mutex
+	subs     map[string]*subscription // keyed by UUID and service
+	live     map[string]speakerState  // keyed by UUID
+	watchers map[chan speakerEvent]struct{}
+	// subscribing holds the keys of SUBSCRIBE requests awaiting their SID,
+	// since a speaker sends its first event before we have it
+	subscribing map[string]struct{}
+
+	// closed ends open event streams when the server shuts down
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewEventSubscriber returns a subscriber for the speakers in registry.
+// callbackHost returns the host:port speakers can reach this server on.
+func NewEventSubscriber(registry *SpeakerRegistry, callbackHost func() string) *EventSubscriber {
+	return &EventSubscriber{
+		registry:     registry,
+		callbackHost: callbackHost,
+		client:       &http.Client{Timeout: 3 * time.Second},
+		subs:         make(map[string]*subscription),
+		live:         make(map[string]speakerState),
+		watchers:     make(map[chan speakerEvent]struct{}),
+		subscribing:  make(map[string]struct{}),
+		closed:       make(chan struct{}),
+	}
+}
+
+// Close ends every open event stream so the HTTP server can shut down. It is
+// registered with http.Server.RegisterOnShutdown.
+func (e *EventSubscriber) Close() {
+	e.closeOnce.Do(func() { close(e.closed) })
+}
+
+// subscriptionKey identifies the subscription to one service of a speaker
+func subscriptionKey(uuid, service string) string {
+	return uuid + "/" + service
+}
+
+// Run keeps subscriptions current until ctx is done, then cancels them.
+// Subscriptions are reconciled with the registry every interval.
+func (e *EventSubscriber) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	e.Reconcile()
+	for {
+		select {
+		case <-ctx.Done():
+			e.UnsubscribeAll()
+			return
+		case <-ticker.C:
+			e.Reconcile()
+		}
+	}
+}
+
+// Reconcile subscribes to registered speakers that have no subscription,
+// renews subscriptions close to expiring and cancels subscriptions of
+// speakers that are gone or have moved.
+func (e *EventSubscriber) Reconcile() {
+	e.reconcileMu.Lock()
+	defer e.reconcileMu.Unlock()
+
+	speakers := make(map[string]Speaker)
+	for _, speaker := range e.registry.List() {
+		speakers[speaker.UUID] = speaker
+	}
+
+	e.mu.Lock()
+	var stale, renew []*subscription
+	for key, sub := range e.subs {
+		current, ok := speakers[sub.speaker.UUID]
+		switch {
+		case !ok || current.Address != sub.speaker.Address:
+			stale = append(stale, sub)
+			delete(e.subs, key)
+		case time.Until(sub.expires) < subscriptionTimeout/3:
+			renew = append(renew, sub)
+		}
+	}
+	var missing []Speaker
+	for _, speaker := range speakers {
+		for _, svc := range eventServices {
+			if _, ok := e.subs[subscriptionKey(speaker.UUID, svc.name)]; !ok {
+				missing = append(missing, speaker)
+				break
+			}
+		}
+	}
+	e.mu.Unlock()
+
+	for _, sub := range stale {
+		e.unsubscribe(sub)
+	}
+	for _, sub := range renew {
+		if err := e.renew(sub); err != nil {
+			log.Printf("Failed to renew %s subscription for %s, resubscribing: %v", sub.service, sub.speaker.Name, err)
+			e.mu.Lock()
+			delete(e.subs, subscriptionKey(sub.speaker.UUID, sub.service))
+			e.mu.Unlock()
+			missing = append(missing, sub.speaker)
+		}
+	}
+	for _, speaker := range missing {
+		if err := e.Subscribe(speaker); err != nil {
+			log.Printf("Failed to subscribe to events from %s: %v", speaker.Name, err)
+		}
+	}
+}
+
+// HandleChanges reconciles subscriptions after discovery changes the
+// registry. It is registered with Discoverer.OnChange.
+func (e *EventSubscriber) HandleChanges(changes []SpeakerChange) {
+	for _, change := range changes {
+		if change.Kind == SpeakerRemoved {
+			e.mu.Lock()
+			delete(e.live, change.Speaker.UUID)
+			e.mu.Unlock()
+		}
+	}
+	e.Reconcile()
+}
+
+// Subscribe subscribes to the event services of speaker that are not
+// already subscribed
+func (e *EventSubscriber) Subscribe(speaker Speaker) error {
+	for _, svc := range eventServices {
+		key := subscriptionKey(speaker.UUID, svc.name)
+		e.mu.Lock()
+		_, ok := e.subs[key]
+		e.mu.Unlock()
+		if ok {
+			continue
+		}
+
+		callback := fmt.Sprintf("http://%s%s%s/%s", e.callbackHost(), eventCallbackPath, speaker.UUID, svc.name)
+		req, err := http.NewRequest("SUBSCRIBE", eventURL(speaker, svc.path), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("CALLBACK", "<"+callback+">")
+		req.Header.Set("NT", "upnp:event")
+		req.Header.Set("TIMEOUT", formatSubscriptionTimeout(subscriptionTimeout))
+
+		e.mu.Lock()
+		e.subscribing[key] = struct{}{}
+		e.mu.Unlock()
+		sid, timeout, err := e.sendSubscription(req)
+		if err != nil {
+			e.mu.Lock()
+			delete(e.subscribing, key)
+			e.mu.Unlock()
+			return fmt.Errorf("%s: %w", svc.name, err)
+		}
+
+		e.mu.Lock()
+		delete(e.subscribing, key)
+		e.subs[key] = &subscription{
+			sid:     sid,
+			speaker: speaker,
+			service: svc.name,
+			path:    svc.path,
+			expires: time.Now().Add(timeout),
+		}
+		e.mu.Unlock()
+		log.Printf("Subscribed to %s events from %s (%s)", svc.name, speaker.Name, sid)
+	}
+	return nil
+}
+
+// renew extends an existing subscription
+func (e *EventSubscriber) renew(sub *subscription) error {
+	req, err := http.NewRequest("SUBSCRIBE", eventURL(sub.speaker, sub.path), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("SID", sub.sid)
+	req.Header.Set("TIMEOUT", formatSubscriptionTimeout(subscriptionTimeout))
+
+	_, timeout, err := e.sendSubscription(req)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	sub.expires = time.Now().Add(timeout)
+	e.mu.Unlock()
+	return nil
+}
+
+// sendSubscription sends a SUBSCRIBE request and returns the subscription
+// ID and duration granted by the speaker
+func (e *EventSubscriber) sendSubscription(req *http.Request) (string, time.Duration, error) {
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	sid := resp.Header.Get("SID")
+	if sid == "" {
+		return "", 0, fmt.Errorf("no SID in response")
+	}
+	return sid, parseSubscriptionTimeout(resp.Header.Get("TIMEOUT")), nil
+}
+
+// unsubscribe cancels a subscription, ignoring errors since the speaker may
+// already be gone
+func (e *EventSubscriber) unsubscribe(sub *subscription) {
+	req, err := http.NewRequest("UNSUBSCRIBE", eventURL(sub.speaker, sub.path), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("SID", sub.sid)
+	if resp, err := e.client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+	log.Printf("Unsubscribed from %s events from %s", sub.service, sub.speaker.Name)
+}
+
+// UnsubscribeAll cancels every subscription
+func (e *EventSubscriber) UnsubscribeAll() {
+	e.mu.Lock()
+	subs := make([]*subscription, 0, len(e.subs))
+	for key, sub := range e.subs {
+		subs = append(subs, sub)
+		delete(e.subs, key)
+	}
+	e.mu.Unlock()
+
+	for _, sub := range subs {
+		e.unsubscribe(sub)
+	}
+}
+
+// eventURL returns the event subscription URL of a speaker service
+func eventURL(speaker Speaker, path string) string {
+	return strings.TrimSuffix(string(speakerLocation(speaker.Address)), "/xml/device_description.xml") + path
+}
+
+// formatSubscriptionTimeout formats d as a GENA TIMEOUT header value
+func formatSubscriptionTimeout(d time.Duration) string {
+	return fmt.Sprintf("Second-%d", int(d.Seconds()))
+}
+
+// parseSubscriptionTimeout parses a GENA TIMEOUT header value such as
+// Second-1800, falling back to the requested timeout
+func parseSubscriptionTimeout(value string) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimPrefix(value, "Second-"))
+	if err != nil || seconds <= 0 {
+		return subscriptionTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// ServeNotify handles the NOTIFY requests speakers send for subscribed
+// events, at eventCallbackPath followed by the speaker UUID and service name
+func (e *EventSubscriber) ServeNotify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "NOTIFY" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	uuid, service, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, eventCallbackPath), "/")
+	speaker, ok := e.registry.Get(uuid)
+	if !ok || !e.currentSID(uuid, service, r.Header.Get("SID")) {
+		// Tells the speaker to drop a subscription we no longer want
+		http.Error(w, "Unknown subscription", http.StatusPreconditionFailed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read event", http.StatusBadRequest)
+		return
+	}
+	lastChange, err := parsePropertySet(body)
+	if err != nil {
+		log.Printf("Invalid %s event from %s: %v", service, speaker.Name, err)
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if lastChange == "" {
+		return
+	}
+	update, err := parseLastChange(lastChange)
+	if err != nil {
+		log.Printf("Invalid %s LastChange from %s: %v", service, speaker.Name, err)
+		return
+	}
+	e.apply(speaker, update)
+}
+
+// currentSID reports whether sid is the current subscription to service of
+// the speaker with the given UUID, so events from an expired or replaced
+// subscription are rejected. While a SUBSCRIBE is awaiting its SID any SID
+// is accepted, since the speaker sends the first event before replying.
+func (e *EventSubscriber) currentSID(uuid, service, sid string) bool {
+	key := subscriptionKey(uuid, service)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if sub, ok := e.subs[key]; ok {
+		return sid != "" && sid == sub.sid
+	}
+	_, pending := e.subscribing[key]
+	return pending && sid != ""
+}
+
+// apply merges an event into the live state of speaker and sends the result
+// to the event stream clients
+func (e *EventSubscriber) apply(speaker Speaker, update speakerState) {
+	e.mu.Lock()
+	state := mergeSpeakerState(e.live[speaker.UUID], update)
+	e.live[speaker.UUID] = state
+	event := speakerEvent{UUID: speaker.UUID, Speaker: speaker.Name, State: state}
+	for ch := range e.watchers {
+		select {
+		case ch <- event:
+		default:
+			// Drop the event for a client that is not keeping up
+		}
+	}
+	e.mu.Unlock()
+}
+
+// State returns the live state of the speaker with the given UUID
+func (e *EventSubscriber) State(uuid string) (speakerState, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	state, ok := e.live[uuid]
+	return state, ok
+}
+
+// watch registers a channel receiving every state change and returns it with
+// the current state of every speaker
+func (e *EventSubscriber) watch() (chan speakerEvent, []speakerEvent) {
+	ch := make(chan speakerEvent, 16)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.watchers[ch] = struct{}{}
+
+	var snapshot []speakerEvent
+	for uuid, state := range e.live {
+		name := uuid
+		if speaker, ok := e.registry.Get(uuid); ok {
+			name = speaker.Name
+		}
+		snapshot = append(snapshot, speakerEvent{UUID: uuid, Speaker: name, State: state})
+	}
+	return ch, snapshot
+}
+
+// unwatch removes a channel registered with watch
+func (e *EventSubscriber) unwatch(ch chan speakerEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.watchers, ch)
+}
+
+// ServeEvents streams speaker state to the client as Server-Sent Events,
+// starting with the current state of every speaker
+func (e *EventSubscriber) ServeEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch, snapshot := e.watch()
+	defer e.unwatch(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range snapshot {
+		writeServerEvent(w, event)
+	}
+	flusher.Flush()
+
+	// Comments keep proxies from closing an idle stream
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-e.closed:
+			return
+		case event := <-ch:
+			writeServerEvent(w, event)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// writeServerEvent writes event as a Server-Sent Event of type state
+func writeServerEvent(w io.Writer, event speakerEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+}
+
+// mergeSpeakerState returns state updated with the fields set in update
+func mergeSpeakerState(state, update speakerState) speakerState {
+	if update.TransportState != "" {
+		state.TransportState = update.TransportState
+	}
+	if update.Track != nil {
+		track := *update.Track
+		state.Track = &track
+	}
+	if update.Volume != nil {
+		volume := *update.Volume
+		state.Volume = &volume
+	}
+	if update.Mute != nil {
+		mute := *update.Mute
+		state.Mute = &mute
+	}
+	return state
+}
+
+// parsePropertySet returns the LastChange value of a GENA event body, or ""
+// if the event does not carry one
+func parsePropertySet(body []byte) (string, error) {
+	var set struct {
+		Properties []struct {
+			LastChange string `xml:"LastChange"`
+		} `xml:"property"`
+	}
+	if err := xml.Unmarshal(body, &set); err != nil {
+		return "", err
+	}
+	for _, property := range set.Properties {
+		if property.LastChange != "" {
+			return property.LastChange, nil
+		}
+	}
+	return "", nil
+}
+
+// eventValue is an element of a LastChange document carrying its value in
+// the val attribute
+type eventValue struct {
+	Channel string `xml:"channel,attr"`
+	Val     string `xml:"val,attr"`
+}
+
+// parseLastChange converts an AVTransport or RenderingControl LastChange
+// document into the state fields it reports
+func parseLastChange(lastChange string) (speakerState, error) {
+	var doc struct {
+		Instance struct {
+			TransportState       *eventValue  `xml:"TransportState"`
+			CurrentTrack         *eventValue  `xml:"CurrentTrack"`
+			CurrentTrackURI      *eventValue  `xml:"CurrentTrackURI"`
+			CurrentTrackDuration *eventValue  `xml:"CurrentTrackDuration"`
+			CurrentTrackMetaData *eventValue  `xml:"CurrentTrackMetaData"`
+			Volume               []eventValue `xml:"Volume"`
+			Mute                 []eventValue `xml:"Mute"`
+		} `xml:"InstanceID"`
+	}
+	if err := xml.Unmarshal([]byte(lastChange), &doc); err != nil {
+		return speakerState{}, err
+	}
+
+	var state speakerState
+	instance := doc.Instance
+	if instance.TransportState != nil {
+		state.TransportState = instance.TransportState.Val
+	}
+	if instance.CurrentTrack != nil {
+		index, _ := strconv.Atoi(instance.CurrentTrack.Val)
+		track := &trackState{Index: index}
+		if instance.CurrentTrackURI != nil {
+			track.URI = instance.CurrentTrackURI.Val
+		}
+		if instance.CurrentTrackDuration != nil {
+			track.Duration = instance.CurrentTrackDuration.Val
+			track.DurationSeconds = parseTrackTime(track.Duration)
+		}
+		if instance.CurrentTrackMetaData != nil {
+			track.Title = didlTitle(instance.CurrentTrackMetaData.Val)
+		}
+		state.Track = track
+	}
+	for _, v := range instance.Volume {
+		if v.Channel == "Master" {
+			if volume, err := strconv.ParseUint(v.Val, 10, 16); err == nil {
+				volume := uint16(volume)
+				state.Volume = &volume
+			}
+		}
+	}
+	for _, v := range instance.Mute {
+		if v.Channel == "Master" {
+			mute := v.Val == "1"
+			state.Mute = &mute
+		}
+	}
+	return state, nil
+}
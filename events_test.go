@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLastChange(t *testing.T) {
+	avTransport := `<Event xmlns="urn:schemas-upnp-org:metadata-1-0/AVT/"><InstanceID val="0">` +
+		`<TransportState val="PLAYING"/><CurrentTrack val="3"/>` +
+		`<CurrentTrackURI val="http://192.168.4.88:8080/music/presets/5/03.mp3"/>` +
+		`<CurrentTrackDuration val="0:02:30"/>` +
+		`<CurrentTrackMetaData val="&lt;DIDL-Lite&gt;&lt;item&gt;&lt;dc:title&gt;Wheels on the Bus&lt;/dc:title&gt;&lt;/item&gt;&lt;/DIDL-Lite&gt;"/>` +
+		`</InstanceID></Event>`
+	state, err := parseLastChange(avTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.TransportState != "PLAYING" || state.Volume != nil || state.Mute != nil {
+		t.Errorf("unexpected state %+v", state)
+	}
+	want := trackState{
+		Index:           3,
+		Title:           "Wheels on the Bus",
+		URI:             "http://192.168.4.88:8080/music/presets/5/03.mp3",
+		Duration:        "0:02:30",
+		DurationSeconds: 150,
+	}
+	if state.Track == nil || *state.Track != want {
+		t.Errorf("expected track %+v, got %+v", want, state.Track)
+	}
+
+	renderingControl := `<Event xmlns="urn:schemas-upnp-org:metadata-1-0/RCS/"><InstanceID val="0">` +
+		`<Volume channel="Master" val="35"/><Volume channel="LF" val="100"/><Mute channel="Master" val="1"/>` +
+		`</InstanceID></Event>`
+	state, err = parseLastChange(renderingControl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.TransportState != "" || state.Track != nil || state.Volume == nil || *state.Volume != 35 || state.Mute == nil || !*state.Mute {
+		t.Errorf("unexpected state %+v", state)
+	}
+}
+
+func TestMergeSpeakerState(t *testing.T) {
+	volume, mute := uint16(20), false
+	state := speakerState{TransportState: "STOPPED", Volume: &volume, Mute: &mute}
+
+	newVolume := uint16(25)
+	merged := mergeSpeakerState(state, speakerState{Volume: &newVolume})
+	if merged.TransportState != "STOPPED" || *merged.Volume != 25 || *merged.Mute {
+		t.Errorf("unexpected merged state %+v", merged)
+	}
+	newVolume = 30
+	if *merged.Volume != 25 {
+		t.Error("merged state shares memory with the update")
+	}
+}
+
+// newTestEventSubscriber returns a subscriber for a registry holding fake,
+// with its callback routes served by a test server
+func newTestEventSubscriber(t *testing.T, fake *fakeSonos) (*EventSubscriber, *httptest.Server) {
+	t.Helper()
+	registry := NewSpeakerRegistry()
+	registry.Put(fake.Speaker())
+
+	mux := http.NewServeMux()
+	var events *EventSubscriber
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	events = NewEventSubscriber(registry, func() string { return server.Listener.Addr().String() })
+	t.Cleanup(events.Close)
+	mux.HandleFunc("/api/sonos/events", events.ServeEvents)
+	mux.HandleFunc(eventCallbackPath, events.ServeNotify)
+	return events, server
+}
+
+func TestEventSubscriberStreamsState(t *testing.T) {
+	fake := newFakeSonos(t, "Kids Room")
+	events, server := newTestEventSubscriber(t, fake)
+
+	events.Reconcile()
+	subs := fake.Subscriptions()
+	if len(subs) != 2 {
+		t.Fatalf("expected AVTransport and RenderingControl subscriptions, got %v", subs)
+	}
+	for service, sub := range subs {
+		want := server.URL + eventCallbackPath + fake.UUID() + "/" + service
+		if sub.Callback != want {
+			t.Errorf("expected callback %s, got %s", want, sub.Callback)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/api/sonos/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected event stream, got %q", ct)
+	}
+
+	fake.SetState("PLAYING", 0, 35, true)
+	if err := fake.Notify("AVTransport"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Notify("RenderingControl"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second event carries the merged state of both services
+	scanner := bufio.NewScanner(resp.Body)
+	var received []speakerEvent
+	for len(received) < 2 && scanner.Scan() {
+		line := scanner.Text()
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var event speakerEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatal(err)
+			}
+			received = append(received, event)
+		}
+	}
+	if len(received) != 2 {
+		t.Fatalf("expected 2 events, got %d: %v", len(received), scanner.Err())
+	}
+	last := received[1]
+	if last.UUID != fake.UUID() || last.Speaker != "Kids Room" {
+		t.Errorf("unexpected speaker in event %+v", last)
+	}
+	if last.State.TransportState != "PLAYING" || last.State.Volume == nil || *last.State.Volume != 35 || last.State.Mute == nil || !*last.State.Mute {
+		t.Errorf("unexpected state in event %+v", last.State)
+	}
+
+	if state, ok := events.State(fake.UUID()); !ok || state.TransportState != "PLAYING" {
+		t.Errorf("expected live state PLAYING, got %+v", state)
+	}
+}
+
+func TestEventSubscriberReconcile(t *testing.T) {
+	fake := newFakeSonos(t, "Kids Room")
+	events, _ := newTestEventSubscriber(t, fake)
+
+	events.Reconcile()
+	sid := fake.Subscriptions()["AVTransport"].SID
+
+	// Subscriptions close to expiring are renewed with the same SID
+	events.mu.Lock()
+	for _, sub := range events.subs {
+		sub.expires = time.Now()
+	}
+	events.mu.Unlock()
+	events.Reconcile()
+	if got := fake.Subscriptions()["AVTransport"].SID; got != sid {
+		t.Errorf("expected renewal of %s, got %s", sid, got)
+	}
+	events.mu.Lock()
+	for _, sub := range events.subs {
+		if time.Until(sub.expires) < time.Minute {
+			t.Errorf("expected %s subscription to be extended", sub.service)
+		}
+	}
+	events.mu.Unlock()
+
+	// Removed speakers are unsubscribed
+	events.registry.Remove(fake.UUID())
+	events.HandleChanges([]SpeakerChange{{Kind: SpeakerRemoved, Speaker: fake.Speaker()}})
+	if subs := fake.Subscriptions(); len(subs) != 0 {
+		t.Errorf("expected subscriptions cancelled, got %v", subs)
+	}
+}
+
+func TestEventSubscriberNotifyStaleSubscription(t *testing.T) {
+	fake := newFakeSonos(t, "Kids Room")
+	events, server := newTestEventSubscriber(t, fake)
+	events.Reconcile()
+
+	body := `<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0"><e:property><LastChange>` +
+		xmlEscape(`<Event><InstanceID val="0"><TransportState val="PLAYING"/></InstanceID></Event>`) +
+		`</LastChange></e:property></e:propertyset>`
+	for _, sid := range []string{"", "uuid:RINCON_OLD_sub0000000001"} {
+		req, _ := http.NewRequest("NOTIFY", server.URL+eventCallbackPath+fake.UUID()+"/AVTransport", strings.NewReader(body))
+		if sid != "" {
+			req.Header.Set("SID", sid)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("SID %q: expected status 412, got %d", sid, resp.StatusCode)
+		}
+	}
+	if state, ok := events.State(fake.UUID()); ok {
+		t.Errorf("expected no state from a stale subscription, got %+v", state)
+	}
+
+	// The current subscription is still accepted
+	if err := fake.Notify("AVTransport"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEventSubscriberNotifyUnknownSpeaker(t *testing.T) {
+	fake := newFakeSonos(t, "Kids Room")
+	_, server := newTestEventSubscriber(t, fake)
+
+	req, _ := http.NewRequest("NOTIFY", server.URL+eventCallbackPath+"RINCON_GONE/AVTransport", strings.NewReader("<e:propertyset/>"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("expected status 412, got %d", resp.StatusCode)
+	}
+}
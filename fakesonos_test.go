@@ -0,0 +1,735 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeSonos is an in-process UPnP/SOAP server that behaves enough like a
+// Sonos Play:1 for go-sonos to describe it and drive it. It records the
+// queue, transport state, volume and mute so tests can assert on the effect
+// of each handler.
+type fakeSonos struct {
+	server *httptest.Server
+
+	mu             sync.Mutex
+	roomName       string
+	udn            string
+	queue          []fakeTrack
+	transportURI   string
+	transportMeta  string
+	transportState string
+	playMode       string
+	sleepTimer     string
+	currentTrack   int
+	position       string
+	volume         uint16
+	mute           bool
+	actions        []string
+	failures       map[string]int
+	holds          map[string]*fakeHold
+	describes      int
+	subscriptions  map[string]fakeSubscription
+}
+
+// fakeSubscription is a GENA event subscription to one service
+type fakeSubscription struct {
+	SID      string
+	Callback string
+	Seq      int
+}
+
+// fakeHold blocks calls to an action until released
+type fakeHold struct {
+	skip    int
+	release chan struct{}
+}
+
+// fakeTrack is a queue entry as enqueued by AddURIToQueue
+type fakeTrack struct {
+	URI      string
+	Metadata string
+}
+
+// fakeService describes one UPnP service exposed by the fake device
+type fakeService struct {
+	Type       string
+	ControlURL string
+	EventURL   string
+	SCPDURL    string
+	Actions    []string
+}
+
+var fakeServices = []fakeService{
+	{
+		Type:       "DeviceProperties",
+		ControlURL: "/DeviceProperties/Control",
+		EventURL:   "/DeviceProperties/Event",
+		SCPDURL:    "/xml/DeviceProperties1.xml",
+		Actions:    []string{"GetZoneAttributes"},
+	},
+	{
+		Type:       "AVTransport",
+		ControlURL: "/MediaRenderer/AVTransport/Control",
+		EventURL:   "/MediaRenderer/AVTransport/Event",
+		SCPDURL:    "/xml/AVTransport1.xml",
+		Actions: []string{
+			"Play", "Pause", "Stop", "Next", "Previous", "Seek",
+			"GetTransportInfo", "GetPositionInfo", "SetAVTransportURI", "AddURIToQueue",
+			"RemoveAllTracksFromQueue", "GetTransportSettings", "SetPlayMode", "GetMediaInfo",
+			"ConfigureSleepTimer", "GetRemainingSleepTimerDuration",
+		},
+	},
+	{
+		Type:       "RenderingControl",
+		ControlURL: "/MediaRenderer/RenderingControl/Control",
+		EventURL:   "/MediaRenderer/RenderingControl/Event",
+		SCPDURL:    "/xml/RenderingControl1.xml",
+		Actions:    []string{"GetVolume", "SetVolume", "GetMute", "SetMute"},
+	},
+	{
+		Type:       "ContentDirectory",
+		ControlURL: "/MediaServer/ContentDirectory/Control",
+		EventURL:   "/MediaServer/ContentDirectory/Event",
+		SCPDURL:    "/xml/ContentDirectory1.xml",
+		Actions:    []string{"Browse"},
+	},
+}
+
+// fakeTrackDuration is the length GetPositionInfo reports for every track
+const fakeTrackDuration = "0:03:00"
+
+// fakeSonosCount numbers fake devices so each gets a unique UDN
+var fakeSonosCount atomic.Int32
+
+// newFakeSonos starts a fake speaker for the duration of the test
+func newFakeSonos(t *testing.T, roomName string) *fakeSonos {
+	t.Helper()
+	f := &fakeSonos{
+		roomName:       roomName,
+		udn:            fmt.Sprintf("RINCON_000E58FAKE%04d01400", fakeSonosCount.Add(1)),
+		transportState: "STOPPED",
+		playMode:       "NORMAL",
+		position:       "0:00:00",
+		volume:         20,
+		failures:       make(map[string]int),
+		holds:          make(map[string]*fakeHold),
+		subscriptions:  make(map[string]fakeSubscription),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// Address returns the host:port the fake speaker listens on
+func (f *fakeSonos) Address() string {
+	return f.server.Listener.Addr().String()
+}
+
+// UUID returns the speaker UUID, i.e. the UDN without the uuid: prefix
+func (f *fakeSonos) UUID() string {
+	return f.udn
+}
+
+// Speaker returns the registry entry describing the fake device
+func (f *fakeSonos) Speaker() Speaker {
+	return Speaker{UUID: f.udn, Name: f.roomName, Address: f.Address(), Room: f.roomName}
+}
+
+// Fail makes the named SOAP action return a UPnP error the next n times it
+// is called.
+func (f *fakeSonos) Fail(action string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[action] = n
+}
+
+// Hold makes calls to the named SOAP action block, after the next skip calls,
+// until release is called
+func (f *fakeSonos) Hold(action string, skip int) (release func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hold := &fakeHold{skip: skip, release: make(chan struct{})}
+	f.holds[action] = hold
+	var once sync.Once
+	return func() { once.Do(func() { close(hold.release) }) }
+}
+
+// Queue returns a copy of the current queue
+func (f *fakeSonos) Queue() []fakeTrack {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeTrack(nil), f.queue...)
+}
+
+// State returns the transport state, current track, volume and mute setting
+func (f *fakeSonos) State() (transportState string, track int, volume uint16, mute bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.transportState, f.currentTrack, f.volume, f.mute
+}
+
+// TransportURI returns the URI last set with SetAVTransportURI
+func (f *fakeSonos) TransportURI() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.transportURI
+}
+
+// SetSource sets the transport URI as if the speaker were playing something
+// other than its queue, such as a radio stream
+func (f *fakeSonos) SetSource(uri, metadata string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.transportURI = uri
+	f.transportMeta = metadata
+	f.transportState = "PLAYING"
+}
+
+// SetQueue replaces the queue with tracks and plays track number track of it,
+// as if another controller had queued them
+func (f *fakeSonos) SetQueue(track int, tracks ...fakeTrack) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queue = append([]fakeTrack(nil), tracks...)
+	f.transportURI = "x-rincon-queue:" + f.udn + "#0"
+	f.transportMeta = ""
+	f.transportState = "PLAYING"
+	f.currentTrack = track
+}
+
+// Actions returns the SOAP actions invoked so far, in order
+func (f *fakeSonos) Actions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.actions...)
+}
+
+// Describes returns how many times the device description was fetched
+func (f *fakeSonos) Describes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.describes
+}
+
+// SetPosition sets the elapsed time within the current track, as H:MM:SS
+func (f *fakeSonos) SetPosition(relTime string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.position = relTime
+}
+
+// Position returns the elapsed time within the current track, as H:MM:SS
+func (f *fakeSonos) Position() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.position
+}
+
+// Subscriptions returns the current event subscriptions keyed by service
+func (f *fakeSonos) Subscriptions() map[string]fakeSubscription {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	subs := make(map[string]fakeSubscription, len(f.subscriptions))
+	for service, sub := range f.subscriptions {
+		subs[service] = sub
+	}
+	return subs
+}
+
+// serveEvent handles GENA SUBSCRIBE and UNSUBSCRIBE requests
+func (f *fakeSonos) serveEvent(w http.ResponseWriter, r *http.Request, svc fakeService) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, subscribed := f.subscriptions[svc.Type]
+	switch {
+	case r.Method == "SUBSCRIBE" && r.Header.Get("SID") == "":
+		callback := strings.Trim(r.Header.Get("CALLBACK"), "<>")
+		if callback == "" || r.Header.Get("NT") != "upnp:event" {
+			http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
+		sub = fakeSubscription{
+			SID:      fmt.Sprintf("uuid:%s_sub%04d", f.udn, fakeSonosCount.Add(1)),
+			Callback: callback,
+		}
+		f.subscriptions[svc.Type] = sub
+	case r.Method == "SUBSCRIBE":
+		if !subscribed || r.Header.Get("SID") != sub.SID {
+			http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
+	case r.Method == "UNSUBSCRIBE":
+		if !subscribed || r.Header.Get("SID") != sub.SID {
+			http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
+		delete(f.subscriptions, svc.Type)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("SID", sub.SID)
+	w.Header().Set("TIMEOUT", "Second-1800")
+}
+
+// Notify sends the current state of a service to its subscriber as a
+// LastChange event, like a speaker does after every change
+func (f *fakeSonos) Notify(service string) error {
+	f.mu.Lock()
+	sub, ok := f.subscriptions[service]
+	var lastChange string
+	switch service {
+	case "AVTransport":
+		var b strings.Builder
+		fmt.Fprintf(&b, `<Event xmlns="urn:schemas-upnp-org:metadata-1-0/AVT/"><InstanceID val="0"><TransportState val="%s"/><CurrentTrack val="%d"/>`, f.transportState, f.currentTrack)
+		if f.currentTrack > 0 {
+			track := f.queue[f.currentTrack-1]
+			fmt.Fprintf(&b, `<CurrentTrackURI val="%s"/><CurrentTrackDuration val="%s"/><CurrentTrackMetaData val="%s"/>`,
+				xmlEscape(track.URI), fakeTrackDuration, xmlEscape(track.Metadata))
+		}
+		b.WriteString(`</InstanceID></Event>`)
+		lastChange = b.String()
+	case "RenderingControl":
+		mute := 0
+		if f.mute {
+			mute = 1
+		}
+		lastChange = fmt.Sprintf(`<Event xmlns="urn:schemas-upnp-org:metadata-1-0/RCS/"><InstanceID val="0"><Volume channel="Master" val="%d"/><Volume channel="LF" val="100"/><Mute channel="Master" val="%d"/></InstanceID></Event>`, f.volume, mute)
+	}
+	sub.Seq++
+	f.subscriptions[service] = sub
+	f.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no subscription to %s", service)
+	}
+
+	body := `<?xml version="1.0"?><e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0"><e:property><LastChange>` +
+		xmlEscape(lastChange) + `</LastChange></e:property></e:propertyset>`
+	req, err := http.NewRequest("NOTIFY", sub.Callback, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("NT", "upnp:event")
+	req.Header.Set("NTS", "upnp:propchange")
+	req.Header.Set("SID", sub.SID)
+	req.Header.Set("SEQ", strconv.Itoa(sub.Seq-1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("NOTIFY returned %s", resp.Status)
+	}
+	return nil
+}
+
+// PlayMode returns the play mode last set with SetPlayMode
+func (f *fakeSonos) PlayMode() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.playMode
+}
+
+// SleepTimer returns the duration of the native sleep timer, "" when it is
+// off. The fake does not count it down.
+func (f *fakeSonos) SleepTimer() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sleepTimer
+}
+
+// SetState overrides the transport state, current track, volume and mute
+func (f *fakeSonos) SetState(transportState string, track int, volume uint16, mute bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.transportState = transportState
+	f.currentTrack = track
+	f.volume = volume
+	f.mute = mute
+}
+
+func (f *fakeSonos) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/xml/device_description.xml" {
+		f.mu.Lock()
+		f.describes++
+		f.mu.Unlock()
+		f.serveDeviceDescription(w)
+		return
+	}
+	for _, svc := range fakeServices {
+		switch r.URL.Path {
+		case svc.SCPDURL:
+			f.serveSCPD(w, svc)
+			return
+		case svc.ControlURL:
+			f.serveControl(w, r, svc)
+			return
+		case svc.EventURL:
+			f.serveEvent(w, r, svc)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (f *fakeSonos) serveDeviceDescription(w http.ResponseWriter) {
+	serviceList := func(types ...string) string {
+		var b strings.Builder
+		for _, svc := range fakeServices {
+			for _, typ := range types {
+				if svc.Type != typ {
+					continue
+				}
+				fmt.Fprintf(&b, "<service><serviceType>urn:schemas-upnp-org:service:%s:1</serviceType>"+
+					"<serviceId>urn:upnp-org:serviceId:%s</serviceId><controlURL>%s</controlURL>"+
+					"<eventSubURL>%s</eventSubURL><SCPDURL>%s</SCPDURL></service>",
+					svc.Type, svc.Type, svc.ControlURL, svc.EventURL, svc.SCPDURL)
+			}
+		}
+		return b.String()
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:ZonePlayer:1</deviceType>
+<friendlyName>127.0.0.1 - Sonos Play:1</friendlyName>
+<manufacturer>Sonos, Inc.</manufacturer>
+<modelName>Sonos Play:1</modelName>
+<UDN>uuid:%[1]s</UDN>
+<roomName>%[2]s</roomName>
+<serviceList>%[3]s</serviceList>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+<UDN>uuid:%[1]s_MS</UDN>
+<serviceList>%[4]s</serviceList>
+</device>
+<device>
+<deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+<UDN>uuid:%[1]s_MR</UDN>
+<serviceList>%[5]s</serviceList>
+</device>
+</deviceList>
+</device>
+</root>`, f.udn, xmlEscape(f.roomName), serviceList("DeviceProperties"),
+		serviceList("ContentDirectory"), serviceList("AVTransport", "RenderingControl"))
+}
+
+func (f *fakeSonos) serveSCPD(w http.ResponseWriter, svc fakeService) {
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?>`)
+	fmt.Fprint(w, `<scpd xmlns="urn:schemas-upnp-org:service-1-0"><specVersion><major>1</major><minor>0</minor></specVersion><actionList>`)
+	for _, action := range svc.Actions {
+		fmt.Fprintf(w, "<action><name>%s</name></action>", action)
+	}
+	fmt.Fprint(w, `</actionList></scpd>`)
+}
+
+// soapRequest decodes the action element and its arguments from a request
+// envelope.
+type soapRequest struct {
+	Body struct {
+		Action struct {
+			XMLName xml.Name
+			Args    []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+// soapArg is an ordered output argument of a SOAP response
+type soapArg struct {
+	Name  string
+	Value string
+}
+
+// upnpError is returned by action implementations to produce a SOAP fault
+type upnpError int
+
+func (e upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d", int(e))
+}
+
+func (f *fakeSonos) serveControl(w http.ResponseWriter, r *http.Request, svc fakeService) {
+	var req soapRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := req.Body.Action.XMLName.Local
+	args := make(map[string]string)
+	for _, arg := range req.Body.Action.Args {
+		args[arg.XMLName.Local] = arg.Value
+	}
+
+	out, err := f.call(action, args)
+
+	ns := fmt.Sprintf("urn:schemas-upnp-org:service:%s:1", svc.Type)
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	if err != nil {
+		code := 501
+		if e, ok := err.(upnpError); ok {
+			code = int(e)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code)
+		return
+	}
+
+	var b strings.Builder
+	for _, arg := range out {
+		fmt.Fprintf(&b, "<%s>%s</%s>", arg.Name, xmlEscape(arg.Value), arg.Name)
+	}
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`,
+		action, ns, b.String(), action)
+}
+
+// call applies a SOAP action to the fake device state
+func (f *fakeSonos) call(action string, args map[string]string) ([]soapArg, error) {
+	f.mu.Lock()
+	var release chan struct{}
+	if hold := f.holds[action]; hold != nil {
+		if hold.skip > 0 {
+			hold.skip--
+		} else {
+			release = hold.release
+		}
+	}
+	f.mu.Unlock()
+	if release != nil {
+		<-release
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.actions = append(f.actions, action)
+	if n := f.failures[action]; n > 0 {
+		f.failures[action] = n - 1
+		return nil, upnpError(701)
+	}
+
+	switch action {
+	case "GetZoneAttributes":
+		return []soapArg{{"CurrentZoneName", f.roomName}, {"CurrentIcon", "x-rincon-roomicon:living"}}, nil
+
+	case "Play":
+		if f.transportURI == "" {
+			return nil, upnpError(701)
+		}
+		if f.currentTrack == 0 && len(f.queue) > 0 {
+			f.currentTrack = 1
+		}
+		f.transportState = "PLAYING"
+	case "Pause":
+		f.transportState = "PAUSED_PLAYBACK"
+	case "Stop":
+		f.transportState = "STOPPED"
+	case "Next":
+		if f.currentTrack >= len(f.queue) {
+			return nil, upnpError(711)
+		}
+		f.currentTrack++
+		f.position = "0:00:00"
+	case "Previous":
+		if f.currentTrack <= 1 {
+			return nil, upnpError(711)
+		}
+		f.currentTrack--
+		f.position = "0:00:00"
+	case "Seek":
+		switch args["Unit"] {
+		case "TRACK_NR":
+			n, err := strconv.Atoi(args["Target"])
+			if err != nil || n < 1 || n > len(f.queue) {
+				return nil, upnpError(711)
+			}
+			f.currentTrack = n
+			f.position = "0:00:00"
+		case "REL_TIME":
+			if f.currentTrack == 0 || parseTrackTime(args["Target"]) == 0 && args["Target"] != "0:00:00" {
+				return nil, upnpError(711)
+			}
+			f.position = args["Target"]
+		default:
+			return nil, upnpError(710)
+		}
+	case "GetTransportInfo":
+		return []soapArg{
+			{"CurrentTransportState", f.transportState},
+			{"CurrentTransportStatus", "OK"},
+			{"CurrentSpeed", "1"},
+		}, nil
+	case "GetPositionInfo":
+		if f.currentTrack == 0 {
+			return []soapArg{
+				{"Track", "0"}, {"TrackDuration", "0:00:00"}, {"TrackMetaData", ""},
+				{"TrackURI", ""}, {"RelTime", "NOT_IMPLEMENTED"}, {"AbsTime", "NOT_IMPLEMENTED"},
+				{"RelCount", "2147483647"}, {"AbsCount", "2147483647"},
+			}, nil
+		}
+		track := f.queue[f.currentTrack-1]
+		return []soapArg{
+			{"Track", strconv.Itoa(f.currentTrack)},
+			{"TrackDuration", fakeTrackDuration},
+			{"TrackMetaData", track.Metadata},
+			{"TrackURI", track.URI},
+			{"RelTime", f.position},
+			{"AbsTime", "NOT_IMPLEMENTED"},
+			{"RelCount", "2147483647"},
+			{"AbsCount", "2147483647"},
+		}, nil
+	case "GetMediaInfo":
+		return []soapArg{
+			{"NrTracks", strconv.Itoa(len(f.queue))},
+			{"MediaDuration", "NOT_IMPLEMENTED"},
+			{"CurrentURI", f.transportURI},
+			{"CurrentURIMetaData", f.transportMeta},
+			{"NextURI", ""},
+			{"NextURIMetaData", ""},
+			{"PlayMedium", "NETWORK"},
+			{"RecordMedium", "NOT_IMPLEMENTED"},
+			{"WriteStatus", "NOT_IMPLEMENTED"},
+		}, nil
+	case "GetTransportSettings":
+		return []soapArg{{"PlayMode", f.playMode}, {"RecQualityMode", "NOT_IMPLEMENTED"}}, nil
+	case "SetPlayMode":
+		// Sonos only accepts a play mode while playing from the queue
+		if !strings.HasPrefix(f.transportURI, "x-rincon-queue:") {
+			return nil, upnpError(712)
+		}
+		switch mode := args["NewPlayMode"]; mode {
+		case "NORMAL", "REPEAT_ALL", "REPEAT_ONE", "SHUFFLE_NOREPEAT", "SHUFFLE", "SHUFFLE_REPEAT_ONE":
+			f.playMode = mode
+		default:
+			return nil, upnpError(712)
+		}
+	case "SetAVTransportURI":
+		f.transportURI = args["CurrentURI"]
+		f.transportMeta = args["CurrentURIMetaData"]
+		f.transportState = "STOPPED"
+	case "AddURIToQueue":
+		f.queue = append(f.queue, fakeTrack{URI: args["EnqueuedURI"], Metadata: args["EnqueuedURIMetaData"]})
+		return []soapArg{
+			{"FirstTrackNumberEnqueued", strconv.Itoa(len(f.queue))},
+			{"NumTracksAdded", "1"},
+			{"NewQueueLength", strconv.Itoa(len(f.queue))},
+		}, nil
+	case "RemoveAllTracksFromQueue":
+		f.queue = nil
+		f.currentTrack = 0
+	case "ConfigureSleepTimer":
+		duration := args["NewSleepTimerDuration"]
+		if duration != "" && parseTrackTime(duration) == 0 {
+			return nil, upnpError(402)
+		}
+		f.sleepTimer = duration
+	case "GetRemainingSleepTimerDuration":
+		return []soapArg{{"RemainingSleepTimerDuration", f.sleepTimer}, {"CurrentSleepTimerGeneration", "1"}}, nil
+
+	case "GetVolume":
+		return []soapArg{{"CurrentVolume", strconv.Itoa(int(f.volume))}}, nil
+	case "SetVolume":
+		v, err := strconv.Atoi(args["DesiredVolume"])
+		if err != nil || v < 0 || v > 100 {
+			return nil, upnpError(402)
+		}
+		f.volume = uint16(v)
+	case "GetMute":
+		mute := "0"
+		if f.mute {
+			mute = "1"
+		}
+		return []soapArg{{"CurrentMute", mute}}, nil
+	case "SetMute":
+		mute, err := strconv.ParseBool(args["DesiredMute"])
+		if err != nil {
+			return nil, upnpError(402)
+		}
+		f.mute = mute
+
+	case "Browse":
+		return f.browse(args)
+
+	default:
+		return nil, upnpError(401)
+	}
+	return nil, nil
+}
+
+// browse answers ContentDirectory Browse requests for the queue
+func (f *fakeSonos) browse(args map[string]string) ([]soapArg, error) {
+	if args["ObjectID"] != "Q:0" {
+		return nil, upnpError(701)
+	}
+
+	var b strings.Builder
+	b.WriteString(`<DIDL-Lite xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/" xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/">`)
+	count := 1
+	if args["BrowseFlag"] == "BrowseMetadata" {
+		fmt.Fprintf(&b, `<container id="Q:0" parentID="Q:" restricted="true"><res>x-rincon-queue:%s#0</res><dc:title>Queue Instance 0</dc:title><upnp:class>object.container.playlistContainer</upnp:class></container>`, f.udn)
+	} else {
+		count = len(f.queue)
+		for i, track := range f.queue {
+			fmt.Fprintf(&b, `<item id="Q:0/%d" parentID="Q:0" restricted="true"><res protocolInfo="%s">%s</res><dc:title>%s</dc:title><upnp:class>object.item.audioItem.musicTrack</upnp:class></item>`,
+				i+1, xmlEscape(fakeTrackProtocolInfo(track.Metadata)), xmlEscape(track.URI), xmlEscape(fakeTrackTitle(track.Metadata)))
+		}
+	}
+	b.WriteString(`</DIDL-Lite>`)
+
+	return []soapArg{
+		{"Result", b.String()},
+		{"NumberReturned", strconv.Itoa(count)},
+		{"TotalMatches", strconv.Itoa(count)},
+		{"UpdateID", "1"},
+	}, nil
+}
+
+// fakeTrackTitle extracts the dc:title from enqueued DIDL-Lite metadata
+func fakeTrackTitle(metadata string) string {
+	var doc struct {
+		Title string `xml:"item>title"`
+	}
+	if err := xml.Unmarshal([]byte(metadata), &doc); err != nil {
+		return ""
+	}
+	return doc.Title
+}
+
+// fakeTrackProtocolInfo extracts the protocolInfo of the resource in
+// enqueued DIDL-Lite metadata, defaulting to MP3 over HTTP
+func fakeTrackProtocolInfo(metadata string) string {
+	var doc struct {
+		Res struct {
+			ProtocolInfo string `xml:"protocolInfo,attr"`
+		} `xml:"item>res"`
+	}
+	if err := xml.Unmarshal([]byte(metadata), &doc); err != nil || doc.Res.ProtocolInfo == "" {
+		return "http-get:*:audio/mpeg:*"
+	}
+	return doc.Res.ProtocolInfo
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
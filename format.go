@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"strings"
+	"sync"
+)
+
+// audioFormat is a kind of audio file the speakers can play over HTTP
+type audioFormat struct {
+	name       string
+	mimeType   string
+	extensions []string
+}
+
+// protocolInfo returns the DIDL-Lite protocolInfo of files in the format
+func (f audioFormat) protocolInfo() string {
+	return "http-get:*:" + f.mimeType + ":*"
+}
+
+var (
+	formatMP3  = audioFormat{name: "MP3", mimeType: "audio/mpeg", extensions: []string{".mp3"}}
+	formatAAC  = audioFormat{name: "AAC", mimeType: "audio/mp4", extensions: []string{".m4a"}}
+	formatFLAC = audioFormat{name: "FLAC", mimeType: "audio/flac", extensions: []string{".flac"}}
+	formatOGG  = audioFormat{name: "OGG", mimeType: "audio/ogg", extensions: []string{".ogg", ".oga"}}
+)
+
+// audioFormats are the formats served and queued from the music library
+var audioFormats = []audioFormat{formatMP3, formatAAC, formatFLAC, formatOGG}
+
+// companionExtensions are files kept next to music that are not meant to be
+// played, so skipping them is not worth a warning
+var companionExtensions = map[string]bool{
+	".json": true, ".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+	".txt": true, ".md": true, ".m3u": true, ".m3u8": true, ".cue": true,
+}
+
+// sniffLength is how much of a file sniffFormat needs
+const sniffLength = 12
+
+// warnedUnsupported holds the paths already logged as unsupported, so each
+// is only warned about once rather than on every request
+var warnedUnsupported sync.Map
+
+// formatByExtension returns the format of the file at name from its
+// extension alone
+func formatByExtension(name string) (audioFormat, bool) {
+	ext := strings.ToLower(path.Ext(name))
+	for _, format := range audioFormats {
+		for _, e := range format.extensions {
+			if e == ext {
+				return format, true
+			}
+		}
+	}
+	return audioFormat{}, false
+}
+
+// sniffFormat returns the format of a file from its first bytes, or false if
+// they are not recognized
+func sniffFormat(header []byte) (audioFormat, bool) {
+	switch {
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return formatFLAC, true
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return formatOGG, true
+	case len(header) >= 8 && string(header[4:8]) == "ftyp":
+		return formatAAC, true
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return formatMP3, true
+	}
+	if _, ok := parseMPEGHeader(header); ok {
+		return formatMP3, true
+	}
+	return audioFormat{}, false
+}
+
+// detectFormat returns the format of the file at name in fsys. A file's
+// first bytes decide its format, so a FLAC file named .mp3 is still served
+// as FLAC and a file with an unknown or missing extension is played if its
+// content is recognized. Files with the extension of a supported format keep
+// that format when their content is not recognized. Hidden files and
+// companions such as cover images are never audio.
+func detectFormat(fsys fs.FS, name string) (audioFormat, bool) {
+	format, known := formatByExtension(name)
+	base := path.Base(name)
+	if !known && (strings.HasPrefix(base, ".") || companionExtensions[strings.ToLower(path.Ext(base))]) {
+		return audioFormat{}, false
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return format, known
+	}
+	defer f.Close()
+	header := make([]byte, sniffLength)
+	n, _ := io.ReadFull(f, header)
+	if sniffed, ok := sniffFormat(header[:n]); ok {
+		return sniffed, true
+	}
+	return format, known
+}
+
+// audioFile reports whether the file at name in fsys is music to play,
+// logging a warning the first time an unsupported file is skipped. Hidden
+// files and companions such as cover images and manifests are skipped
+// silently.
+func audioFile(fsys fs.FS, name string) (audioFormat, bool) {
+	format, ok := detectFormat(fsys, name)
+	if ok {
+		return format, true
+	}
+	base := path.Base(name)
+	if strings.HasPrefix(base, ".") || companionExtensions[strings.ToLower(path.Ext(base))] {
+		return audioFormat{}, false
+	}
+	if _, warned := warnedUnsupported.LoadOrStore(name, true); !warned {
+		log.Printf("Warning: skipping %s, an unsupported audio format", name)
+	}
+	return audioFormat{}, false
+}
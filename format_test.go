@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// Minimal headers of each format, enough for sniffing
+var (
+	flacHeader = "fLaC\x00\x00\x00\x22"
+	oggHeader  = "OggS\x00\x02\x00\x00"
+	m4aHeader  = "\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00"
+)
+
+func TestDetectFormat(t *testing.T) {
+	fsys := fstest.MapFS{
+		"song.mp3":       {Data: mpegFrames(2)},
+		"tagged.MP3":     {Data: id3v2Tag(3)},
+		"unknown.mp3":    {Data: []byte("not audio")},
+		"song.m4a":       {Data: []byte(m4aHeader)},
+		"song.flac":      {Data: []byte(flacHeader)},
+		"song.ogg":       {Data: []byte(oggHeader)},
+		"song.oga":       {Data: []byte(oggHeader)},
+		"flac-named.mp3": {Data: []byte(flacHeader)},
+		"short.flac":     {Data: []byte("fL")},
+		"song.wma":       {Data: []byte("\x30\x26\xB2\x75")},
+		"folder.jpg":     {Data: []byte("\xFF\xD8\xFF")},
+		"no-extension":   {Data: []byte(flacHeader)},
+		"song.audio":     {Data: mpegFrames(2)},
+		"notes.bin":      {Data: []byte("not audio")},
+		".hidden":        {Data: []byte(oggHeader)},
+		"cover.png":      {Data: []byte(flacHeader)},
+	}
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"song.mp3", "audio/mpeg", true},
+		{"tagged.MP3", "audio/mpeg", true},
+		// Unrecognized content keeps the format of the extension
+		{"unknown.mp3", "audio/mpeg", true},
+		{"song.m4a", "audio/mp4", true},
+		{"song.flac", "audio/flac", true},
+		{"song.ogg", "audio/ogg", true},
+		{"song.oga", "audio/ogg", true},
+		// Content wins over a wrong extension
+		{"flac-named.mp3", "audio/flac", true},
+		{"short.flac", "audio/flac", true},
+		{"absent.ogg", "audio/ogg", true},
+		{"song.wma", "", false},
+		{"folder.jpg", "", false},
+		// Content alone is enough without a supported extension
+		{"no-extension", "audio/flac", true},
+		{"song.audio", "audio/mpeg", true},
+		{"notes.bin", "", false},
+		{"absent", "", false},
+		{".hidden", "", false},
+		{"cover.png", "", false},
+	}
+	for _, tt := range tests {
+		format, ok := detectFormat(fsys, tt.name)
+		if ok != tt.ok || format.mimeType != tt.want {
+			t.Errorf("%s: expected %q %v, got %q %v", tt.name, tt.want, tt.ok, format.mimeType, ok)
+		}
+	}
+}
+
+func TestMixedFormatPreset(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writeMusicFile(t, dir, "presets/7/01 Song.mp3", string(mpegFrames(38)))
+	writeMusicFile(t, dir, "presets/7/02 Song.m4a", m4aHeader)
+	writeMusicFile(t, dir, "presets/7/03 Song.flac", flacHeader)
+	writeMusicFile(t, dir, "presets/7/04 Song.ogg", oggHeader)
+	writeMusicFile(t, dir, "presets/7/05 Song.wma", "\x30\x26\xB2\x75")
+	writeMusicFile(t, dir, "presets/7/folder.jpg", "\xFF\xD8\xFF")
+	writeMusicFile(t, dir, "presets/7/.DS_Store", "junk")
+	useMusicDir(t, dir)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	rr := serve(t, "POST", "/sonos/preset/7", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	queue := fake.Queue()
+	want := []string{"audio/mpeg", "audio/mp4", "audio/flac", "audio/ogg"}
+	if len(queue) != len(want) {
+		t.Fatalf("expected %d queued tracks, got %+v", len(want), queue)
+	}
+	for i, mimeType := range want {
+		protocolInfo := `protocolInfo="http-get:*:` + mimeType + `:*"`
+		if !strings.Contains(queue[i].Metadata, protocolInfo) {
+			t.Errorf("track %d: expected %s in %s", i, protocolInfo, queue[i].Metadata)
+		}
+	}
+
+	output := logs.String()
+	if !strings.Contains(output, "Warning: skipping presets/7/05 Song.wma") {
+		t.Errorf("expected a warning for the unsupported file, got:\n%s", output)
+	}
+	for _, quiet := range []string{"folder.jpg", ".DS_Store"} {
+		if strings.Contains(output, "skipping presets/7/"+quiet) {
+			t.Errorf("expected no warning for %s, got:\n%s", quiet, output)
+		}
+	}
+
+	// Each file is served with the Content-Type of its format
+	for i, name := range []string{"01%20Song.mp3", "02%20Song.m4a", "03%20Song.flac", "04%20Song.ogg"} {
+		rr := serve(t, "GET", "/music/presets/7/"+name, "")
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", name, rr.Code)
+			continue
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != want[i] {
+			t.Errorf("%s: expected Content-Type %s, got %s", name, want[i], ct)
+		}
+	}
+}
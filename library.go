@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// musicLibrary is the music served at /music/ and enumerated for presets:
+// the embedded music directory, or a directory on disk given with -music-dir
+var musicLibrary = NewLibrary(embeddedMusic())
+
+// embeddedMusic returns the embedded music directory as its own filesystem,
+// with paths such as presets/5/01 Song.mp3
+func embeddedMusic() fs.FS {
+	sub, err := fs.Sub(musicFS, "music")
+	if err != nil {
+		panic(fmt.Sprintf("embedded music: %v", err))
+	}
+	return sub
+}
+
+// Library is the music filesystem with change notification. Files are read
+// from it on every request, so changes on disk are served immediately; Watch
+// tells caches built from the files when to start over.
+type Library struct {
+	mu       sync.RWMutex
+	fsys     fs.FS
+	dir      string
+	files    map[string]fileStamp
+	watchers []func()
+
+	tagsMu sync.Mutex
+	tags   map[string]cachedTags
+}
+
+// cachedTags are the tags read from a version of a file
+type cachedTags struct {
+	stamp fileStamp
+	tags  Tags
+}
+
+// fileStamp identifies a version of a file in the music directory
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// equal reports whether two stamps are of the same version of a file
+func (s fileStamp) equal(other fileStamp) bool {
+	return s.size == other.size && s.modTime.Equal(other.modTime)
+}
+
+// NewLibrary returns a library serving fsys
+func NewLibrary(fsys fs.FS) *Library {
+	return &Library{fsys: fsys, tags: make(map[string]cachedTags)}
+}
+
+// UseDir serves music from dir in front of the embedded music. A directory on
+// disk replaces the files of the embedded directory at the same path, while
+// embedded subdirectories missing on disk, such as presets the directory does
+// not have, are still served.
+func (l *Library) UseDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	files, err := scanMusicDir(dir)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	l.fsys = layeredFS{primary: os.DirFS(dir), fallback: embeddedMusic()}
+	l.dir = dir
+	l.files = files
+	l.mu.Unlock()
+	l.clearTags()
+	log.Printf("Serving music from %s (%d files), falling back to embedded music", dir, len(files))
+	return nil
+}
+
+// FS returns the music filesystem. Paths are relative to the music
+// directory, e.g. presets/5.
+func (l *Library) FS() fs.FS {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.fsys
+}
+
+// Dir returns the music directory on disk, or "" when only embedded music is
+// served
+func (l *Library) Dir() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.dir
+}
+
+// OnChange registers fn to be called after Watch finds files in the music
+// directory added, removed or modified
+func (l *Library) OnChange(fn func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.watchers = append(l.watchers, fn)
+}
+
+// Watch rescans the music directory every interval until ctx is cancelled.
+// Embedded music never changes, so Watch returns immediately without a
+// directory or with a zero interval.
+func (l *Library) Watch(ctx context.Context, interval time.Duration) {
+	if l.Dir() == "" || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.Rescan()
+		}
+	}
+}
+
+// Rescan compares the music directory with the last scan and notifies the
+// OnChange watchers if anything changed. It reports whether there were
+// changes.
+func (l *Library) Rescan() bool {
+	dir := l.Dir()
+	if dir == "" {
+		return false
+	}
+
+	files, err := scanMusicDir(dir)
+	if err != nil {
+		log.Printf("Failed to scan music directory %s: %v", dir, err)
+		return false
+	}
+
+	l.mu.Lock()
+	added, removed, modified := diffFiles(l.files, files)
+	changed := added+removed+modified > 0
+	if changed {
+		l.files = files
+	}
+	watchers := append([]func(){}, l.watchers...)
+	l.mu.Unlock()
+
+	if !changed {
+		return false
+	}
+	l.clearTags()
+	log.Printf("Music directory %s changed: %d added, %d removed, %d modified", dir, added, removed, modified)
+	for _, fn := range watchers {
+		fn()
+	}
+	return true
+}
+
+// Tags returns the tags of the MP3 file at name, read once per version of
+// the file. Other formats have no tags read, so their Tags are empty.
+func (l *Library) Tags(name string) (Tags, error) {
+	if format, ok := detectFormat(l.FS(), name); ok && format.name != formatMP3.name {
+		return Tags{}, nil
+	}
+	f, err := l.FS().Open(name)
+	if err != nil {
+		return Tags{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Tags{}, err
+	}
+	stamp := fileStamp{size: info.Size(), modTime: info.ModTime()}
+
+	l.tagsMu.Lock()
+	cached, ok := l.tags[name]
+	l.tagsMu.Unlock()
+	if ok && cached.stamp.equal(stamp) {
+		return cached.tags, nil
+	}
+
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		return Tags{}, fmt.Errorf("%s does not support seeking", name)
+	}
+	tags, err := readTags(rs, info.Size(), false)
+	if err != nil {
+		return Tags{}, err
+	}
+
+	l.tagsMu.Lock()
+	l.tags[name] = cachedTags{stamp: stamp, tags: tags}
+	l.tagsMu.Unlock()
+	return tags, nil
+}
+
+// clearTags forgets the tags read so far
+func (l *Library) clearTags() {
+	l.tagsMu.Lock()
+	defer l.tagsMu.Unlock()
+	l.tags = make(map[string]cachedTags)
+}
+
+// trackItem returns the playlist item for the audio file at name, with URLs
+// under baseURL and the metadata from its tags. title, if not empty, takes
+// the place of the title tag; without either the title is the file name.
+func (l *Library) trackItem(index int, name, baseURL, title string) ListItem {
+	filename := path.Base(name)
+	item := ListItem{
+		Index:       index,
+		Title:       title,
+		Filename:    filename,
+		URL:         baseURL + "/music/" + escapePath(name),
+		AlbumArtURI: l.artURL(baseURL, name),
+	}
+	if format, ok := detectFormat(l.FS(), name); ok {
+		item.MIMEType = format.mimeType
+	}
+
+	tags, err := l.Tags(name)
+	if err != nil {
+		log.Printf("Warning: failed to read tags of %s: %v", name, err)
+	}
+	if item.Title == "" {
+		item.Title = tags.Title
+	}
+	if item.Title == "" {
+		item.Title = strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
+	item.Artist = tags.Artist
+	item.Album = tags.Album
+	item.TrackNumber = tags.Track
+	item.DurationSeconds = int(tags.Duration.Round(time.Second) / time.Second)
+	return item
+}
+
+// escapePath escapes each element of a slash-separated path for use in a URL
+func escapePath(name string) string {
+	elems := strings.Split(name, "/")
+	for i, elem := range elems {
+		elems[i] = url.PathEscape(elem)
+	}
+	return strings.Join(elems, "/")
+}
+
+// scanMusicDir returns the stamp of every regular file under dir, keyed by
+// slash-separated path
+func scanMusicDir(dir string) (map[string]fileStamp, error) {
+	files := make(map[string]fileStamp)
+	err := fs.WalkDir(os.DirFS(dir), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// Removed since the directory was read
+			return nil
+		}
+		files[name] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	return files, err
+}
+
+// diffFiles counts the files added, removed and modified between two scans
+func diffFiles(before, after map[string]fileStamp) (added, removed, modified int) {
+	for name, stamp := range after {
+		old, ok := before[name]
+		switch {
+		case !ok:
+			added++
+		case !old.equal(stamp):
+			modified++
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			removed++
+		}
+	}
+	return added, removed, modified
+}
+
+// layeredFS serves primary in front of fallback. A directory present in
+// primary hides the files fallback has in the same directory, but listings
+// include fallback's subdirectories that primary lacks.
+type layeredFS struct {
+	primary  fs.FS
+	fallback fs.FS
+}
+
+// Open opens name from primary, or from fallback if name is a directory
+// missing from primary or a file whose directory is missing from primary
+func (l layeredFS) Open(name string) (fs.File, error) {
+	f, err := l.primary.Open(name)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return f, err
+	}
+
+	f, err = l.fallback.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err == nil && !info.IsDir() && l.primaryHasDir(path.Dir(name)) {
+		f.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f, nil
+}
+
+// ReadDir lists name from primary merged with the subdirectories only
+// fallback has, or lists fallback if primary does not have name
+func (l layeredFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(l.primary, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fs.ReadDir(l.fallback, name)
+		}
+		return nil, err
+	}
+
+	fallbackEntries, err := fs.ReadDir(l.fallback, name)
+	if err != nil {
+		return entries, nil
+	}
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+	for _, entry := range fallbackEntries {
+		if entry.IsDir() && !names[entry.Name()] {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// primaryHasDir reports whether name is a directory in primary
+func (l layeredFS) primaryHasDir(name string) bool {
+	info, err := fs.Stat(l.primary, name)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestLayeredFS(t *testing.T) {
+	fsys := layeredFS{
+		primary: fstest.MapFS{
+			"presets/5/03 Disk.mp3": {Data: []byte("disk")},
+			"presets/7/01 New.mp3":  {Data: []byte("new")},
+		},
+		fallback: fstest.MapFS{
+			"sample.mp3":             {Data: []byte("sample")},
+			"presets/1/01 One.mp3":   {Data: []byte("one")},
+			"presets/5/01 Embed.mp3": {Data: []byte("embed")},
+		},
+	}
+
+	entries, err := fs.ReadDir(fsys, "presets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if want := []string{"1", "5", "7"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expected presets %v, got %v", want, names)
+	}
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"presets/5/03 Disk.mp3", "disk"},
+		{"presets/7/01 New.mp3", "new"},
+		// Presets missing on disk come from the fallback
+		{"presets/1/01 One.mp3", "one"},
+		// A directory on disk hides the fallback's files in it
+		{"presets/5/01 Embed.mp3", ""},
+		{"sample.mp3", ""},
+	}
+	for _, tt := range tests {
+		data, err := fs.ReadFile(fsys, tt.name)
+		if tt.data == "" {
+			if err == nil {
+				t.Errorf("%s: expected not found, got %q", tt.name, data)
+			}
+			continue
+		}
+		if err != nil || string(data) != tt.data {
+			t.Errorf("%s: expected %q, got %q (%v)", tt.name, tt.data, data, err)
+		}
+	}
+
+	files, err := getPresetFiles(fsys, "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"03 Disk.mp3"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("expected preset 5 files %v, got %v", want, files)
+	}
+}
+
+func TestLibraryRescan(t *testing.T) {
+	dir := t.TempDir()
+	writeMusicFile(t, dir, "presets/6/01 First.mp3", "first")
+
+	library := NewLibrary(embeddedMusic())
+	if err := library.UseDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	changes := 0
+	library.OnChange(func() { changes++ })
+
+	if library.Rescan() {
+		t.Error("expected no changes before files are touched")
+	}
+
+	writeMusicFile(t, dir, "presets/6/02 Second.mp3", "second")
+	if !library.Rescan() || changes != 1 {
+		t.Errorf("expected added file to be noticed, got %d changes", changes)
+	}
+	files, err := getPresetFiles(library.FS(), "6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"01 First.mp3", "02 Second.mp3"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("expected %v, got %v", want, files)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(dir, "presets/6/01 First.mp3"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !library.Rescan() || changes != 2 {
+		t.Errorf("expected modified file to be noticed, got %d changes", changes)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "presets/6/02 Second.mp3")); err != nil {
+		t.Fatal(err)
+	}
+	if !library.Rescan() || changes != 3 {
+		t.Errorf("expected removed file to be noticed, got %d changes", changes)
+	}
+}
+
+func TestLibraryUseDirNotDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeMusicFile(t, dir, "song.mp3", "song")
+	library := NewLibrary(embeddedMusic())
+	if err := library.UseDir(filepath.Join(dir, "song.mp3")); err == nil {
+		t.Error("expected error for a file")
+	}
+	if err := library.UseDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected error for a missing directory")
+	}
+}
+
+func TestMusicDirServed(t *testing.T) {
+	dir := t.TempDir()
+	writeMusicFile(t, dir, "presets/7/01 Disk Song.mp3", "disk song")
+	useMusicDir(t, dir)
+
+	rr := serve(t, "GET", "/sonos/preset/7", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		PlaylistItems []ListItem `json:"playlist_items"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.PlaylistItems) != 1 || response.PlaylistItems[0].Title != "01 Disk Song" {
+		t.Errorf("expected the song on disk, got %+v", response.PlaylistItems)
+	}
+
+	rr = serve(t, "GET", "/music/presets/7/01%20Disk%20Song.mp3", "")
+	if rr.Code != http.StatusOK || rr.Body.String() != "disk song" {
+		t.Errorf("expected song served from disk, got %d %q", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "audio/mpeg" {
+		t.Errorf("expected audio/mpeg, got %s", ct)
+	}
+
+	// Presets only in the binary are still available
+	rr = serve(t, "GET", "/sonos/preset/5", "")
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected embedded preset 5, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// useMusicDir serves music from dir for the duration of the test
+func useMusicDir(t *testing.T, dir string) {
+	t.Helper()
+	library := NewLibrary(embeddedMusic())
+	if err := library.UseDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	saved := musicLibrary
+	musicLibrary = library
+	t.Cleanup(func() { musicLibrary = saved })
+}
+
+// writeMusicFile writes data to the slash-separated name under dir
+func writeMusicFile(t *testing.T, dir, name, data string) {
+	t.Helper()
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -45,9 +47,11 @@ type SpeakerInfo struct {
 }
 
 type Speaker struct {
-	Name    string `json:"name"`
-	Address string `json:"address"`
-	Room    string `json:"room"`
+	UUID     string    `json:"uuid"`
+	Name     string    `json:"name"`
+	Address  string    `json:"address"`
+	Room     string    `json:"room"`
+	LastSeen time.Time `json:"last_seen"`
 }
 
 type ListItem struct {
@@ -55,17 +59,25 @@ type ListItem struct {
 	Title    string `json:"title"`
 	Filename string `json:"filename"`
 	URL      string `json:"url"`
+
+	// Metadata read from the file's tags, empty when unknown
+	Artist          string `json:"artist,omitempty"`
+	Album           string `json:"album,omitempty"`
+	TrackNumber     int    `json:"track_number,omitempty"`
+	DurationSeconds int    `json:"duration_seconds,omitempty"`
+	AlbumArtURI     string `json:"album_art_uri,omitempty"`
+	MIMEType        string `json:"mime_type,omitempty"`
 }
 
-// Global cache of discovered speakers
-var speakerCache = make(map[string]Speaker)
+// Global registry of discovered speakers
+var speakerRegistry = NewSpeakerRegistry()
+
+// Global discoverer keeping speakerRegistry up to date
+var speakerDiscoverer = NewDiscoverer(speakerRegistry, discoverSonosDevices)
 
 // Global variables for server configuration
 var resourceHost string
 
-// Global flag to track if initial discovery is complete
-var initialDiscoveryComplete = false
-
 // getLocalIP returns the local network IP address (non-loopback)
 func getLocalIP() string {
 	interfaces, err := net.Interfaces()
@@ -134,12 +146,12 @@ func corsMiddleware(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		
+
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -147,19 +159,18 @@ func corsMiddleware(next http.Handler) http.Handler {
 func setupRoutes() *http.ServeMux {
 	mux := http.NewServeMux()
 
-	// Serve embedded music files
-	musicSubFS, err := fs.Sub(musicFS, "music")
-	if err != nil {
-		log.Fatalf("Failed to create music sub filesystem: %v", err)
-	}
-	// Use custom handler to set proper MIME type for MP3 files
+	// Serve music files from the music directory or the embedded music
+	// Use custom handler to set the MIME type of each audio format
 	mux.Handle("/music/", http.StripPrefix("/music/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasSuffix(strings.ToLower(r.URL.Path), ".mp3") {
-			w.Header().Set("Content-Type", "audio/mpeg")
+		if format, ok := detectFormat(musicLibrary.FS(), strings.TrimPrefix(r.URL.Path, "/")); ok {
+			w.Header().Set("Content-Type", format.mimeType)
 		}
-		http.FileServer(http.FS(musicSubFS)).ServeHTTP(w, r)
+		http.FileServer(http.FS(musicLibrary.FS())).ServeHTTP(w, r)
 	})))
 
+	// Serve cover art of music files and preset directories
+	mux.HandleFunc("/art/", artHandler)
+
 	// Serve embedded website
 	websiteSubFS, err := fs.Sub(websiteFS, "build")
 	if err != nil {
@@ -170,20 +181,103 @@ func setupRoutes() *http.ServeMux {
 	mux.HandleFunc("/", rootRedirectHandler)
 	mux.HandleFunc("/health", healthHandler)
 	mux.HandleFunc("/playlist", playlistHandler)
-	mux.HandleFunc("/sonos/play", playHandler)
-	mux.HandleFunc("/sonos/pause", pauseHandler)
-	mux.HandleFunc("/sonos/restart-playlist", restartPlaylistHandler)
-	mux.HandleFunc("/sonos/queue", queueHandler)
+	mux.HandleFunc("/sonos/play", commandHandler(speakerCommand{
+		name:     "Play",
+		action:   "play",
+		services: sonos.SVC_AV_TRANSPORT | sonos.SVC_CONTENT_DIRECTORY,
+		run:      playCommand,
+	}))
+	mux.HandleFunc("/sonos/pause", commandHandler(speakerCommand{
+		name:     "Pause",
+		action:   "pause",
+		services: sonos.SVC_AV_TRANSPORT,
+		run:      pauseCommand,
+	}))
+	mux.HandleFunc("/sonos/resume", commandHandler(speakerCommand{
+		name:     "Resume",
+		action:   "resume",
+		services: sonos.SVC_AV_TRANSPORT,
+		run:      resumeCommand,
+	}))
+	mux.HandleFunc("/sonos/restart-playlist", commandHandler(speakerCommand{
+		name:     "Restart playlist",
+		action:   "restart-playlist",
+		services: sonos.SVC_AV_TRANSPORT,
+		run:      restartPlaylistCommand,
+	}))
+	mux.HandleFunc("/sonos/queue", commandHandler(speakerCommand{
+		name:     "Queue",
+		action:   "queue",
+		services: sonos.SVC_CONTENT_DIRECTORY,
+		run:      queueCommand,
+	}))
+	mux.HandleFunc("/api/presets", presetsHandler)
+	mux.HandleFunc("/api/schedules", schedulesHandler)
+	mux.HandleFunc("/api/schedules/", schedulesHandler)
 	mux.HandleFunc("/api/sonos/discover", discoverHandler)
 	mux.HandleFunc("/api/sonos/speakers", speakersHandler)
+	mux.HandleFunc("/api/sonos/connections", connectionsHandler)
+	mux.HandleFunc("/api/sonos/events", speakerEvents.ServeEvents)
+	mux.HandleFunc(eventCallbackPath, speakerEvents.ServeNotify)
 	mux.HandleFunc("/echo", echoHandler)
 	mux.HandleFunc("/sonos/preset/", presetHandler)
-	mux.HandleFunc("/sonos/play-pause", playPauseHandler)
-	mux.HandleFunc("/sonos/next", nextTrackHandler)
-	mux.HandleFunc("/sonos/previous", previousTrackHandler)
-	mux.HandleFunc("/sonos/volume-up", volumeUpHandler)
-	mux.HandleFunc("/sonos/volume-down", volumeDownHandler)
-	mux.HandleFunc("/sonos/mute", muteHandler)
+	mux.HandleFunc("/sonos/play-pause", commandHandler(speakerCommand{
+		name:     "Play/Pause toggle",
+		action:   "play-pause",
+		services: sonos.SVC_AV_TRANSPORT,
+		run:      playPauseCommand,
+	}))
+	mux.HandleFunc("/sonos/next", commandHandler(speakerCommand{
+		name:     "Next track",
+		action:   "next",
+		services: sonos.SVC_AV_TRANSPORT,
+		run:      nextTrackCommand,
+	}))
+	mux.HandleFunc("/sonos/previous", commandHandler(speakerCommand{
+		name:     "Previous track",
+		action:   "previous",
+		services: sonos.SVC_AV_TRANSPORT,
+		run:      previousTrackCommand,
+	}))
+	mux.HandleFunc("/sonos/volume-up", commandHandler(speakerCommand{
+		name:     "Volume up",
+		action:   "volume-up",
+		services: sonos.SVC_RENDERING_CONTROL,
+		run:      volumeUpCommand,
+	}))
+	mux.HandleFunc("/sonos/volume-down", commandHandler(speakerCommand{
+		name:     "Volume down",
+		action:   "volume-down",
+		services: sonos.SVC_RENDERING_CONTROL,
+		run:      volumeDownCommand,
+	}))
+	mux.HandleFunc("/sonos/mute", commandHandler(speakerCommand{
+		name:     "Mute toggle",
+		action:   "mute",
+		services: sonos.SVC_RENDERING_CONTROL,
+		run:      muteCommand,
+	}))
+	mux.HandleFunc("/sonos/play-mode", playModeHandler)
+	mux.HandleFunc("/sonos/sleep-timer", sleepTimerHandler)
+	mux.HandleFunc("/sonos/seek-forward", commandHandler(speakerCommand{
+		name:     "Seek forward",
+		action:   "seek-forward",
+		services: sonos.SVC_AV_TRANSPORT,
+		run:      seekCommand(1),
+	}))
+	mux.HandleFunc("/sonos/seek-back", commandHandler(speakerCommand{
+		name:     "Seek back",
+		action:   "seek-back",
+		services: sonos.SVC_AV_TRANSPORT,
+		run:      seekCommand(-1),
+	}))
+	mux.HandleFunc("/sonos/status", commandHandler(speakerCommand{
+		method:   http.MethodGet,
+		name:     "Status",
+		action:   "status",
+		services: sonos.SVC_AV_TRANSPORT | sonos.SVC_RENDERING_CONTROL,
+		run:      statusCommand,
+	}))
 
 	return mux
 }
@@ -198,7 +292,7 @@ func rootRedirectHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
-	if !initialDiscoveryComplete {
+	if !speakerRegistry.Ready() {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte("Initial discovery in progress\n"))
 		return
@@ -212,179 +306,120 @@ func echoHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	
+
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
-	
+
 	w.WriteHeader(http.StatusOK)
 	w.Write(body)
 }
 
-// getEmbeddedFiles returns the list of MP3 files in the embedded filesystem for a given preset
-func getEmbeddedFiles(presetNum string) ([]string, error) {
+// getPresetFiles returns the list of audio files in fsys for a given preset,
+// skipping files in formats the speakers cannot play
+func getPresetFiles(fsys fs.FS, presetNum string) ([]string, error) {
 	// Check if preset directory exists
-	presetDir := fmt.Sprintf("music/presets/%s", presetNum)
-	entries, err := musicFS.ReadDir(presetDir)
+	presetDir := fmt.Sprintf("presets/%s", presetNum)
+	entries, err := fs.ReadDir(fsys, presetDir)
 	if err != nil {
 		return nil, fmt.Errorf("preset %s not found", presetNum)
 	}
-	
-	// Collect all MP3 files from the preset directory
-	var mp3Files []string
+
+	// Collect all audio files from the preset directory
+	var audioFiles []string
 	for _, entry := range entries {
-		if !entry.IsDir() && strings.HasSuffix(strings.ToLower(entry.Name()), ".mp3") {
+		if entry.IsDir() {
+			continue
+		}
+		if _, ok := audioFile(fsys, presetDir+"/"+entry.Name()); ok {
 			// Decode URL-encoded filename if needed
 			decodedName, err := url.QueryUnescape(entry.Name())
 			if err == nil {
-				mp3Files = append(mp3Files, decodedName)
+				audioFiles = append(audioFiles, decodedName)
 			} else {
-				mp3Files = append(mp3Files, entry.Name())
+				audioFiles = append(audioFiles, entry.Name())
 			}
 		}
 	}
-	
+
 	// Sort files alphanumerically (even if empty)
-	sort.Strings(mp3Files)
-	
-	return mp3Files, nil
+	sort.Strings(audioFiles)
+
+	return audioFiles, nil
 }
 
-// getPresetPlaylistItems returns a sorted list of playlist items for a given preset
-func getPresetPlaylistItems(presetNum string, scheme string) ([]ListItem, error) {
-	// Get embedded files for this preset
-	mp3Files, err := getEmbeddedFiles(presetNum)
-	if err != nil {
-		return nil, err
-	}
-	
-	// Build playlist items
-	baseURL := fmt.Sprintf("%s://%s", scheme, resourceHost)
-	playlistItems := make([]ListItem, 0, len(mp3Files))
-	
-	for i, mp3File := range mp3Files {
-		songURL := fmt.Sprintf("%s/music/presets/%s/%s", baseURL, presetNum, url.PathEscape(mp3File))
-		songTitle := strings.TrimSuffix(mp3File, filepath.Ext(mp3File))
-		
-		item := ListItem{
-			Index:    i,
-			Title:    songTitle,
-			Filename: mp3File,
-			URL:      songURL,
+// playPresetCommand returns a command that replaces the queue with the
+// preset's playlist items and starts playback, at the volume and in the play
+// mode given by the preset's manifest
+func playPresetCommand(preset *Preset) func(c *commandContext) error {
+	return func(c *commandContext) error {
+		var req struct {
+			PlayMode string  `json:"play_mode"`
+			Resume   *bool   `json:"resume"`
+			Volume   *uint16 `json:"volume"`
+		}
+		if err := c.decode(&req); err != nil {
+			return commandRejected(http.StatusBadRequest, codeInvalidRequest, "Invalid JSON request")
+		}
+		// A volume in the request overrides the preset's
+		volume := preset.Manifest.volume()
+		if req.Volume != nil {
+			if *req.Volume > 100 {
+				return commandRejected(http.StatusBadRequest, codeInvalidRequest, "volume must be between 0 and 100")
+			}
+			volume = req.Volume
+		}
+		// A play mode in the request overrides the preset's
+		playMode := preset.Manifest.playMode()
+		if req.PlayMode != "" {
+			mode, err := parsePlayMode(req.PlayMode)
+			if err != nil {
+				return commandRejected(http.StatusBadRequest, codeInvalidRequest, err.Error())
+			}
+			playMode = mode
+		}
+		if preset.Manifest.isStory() {
+			if err := rejectStoryPlayMode(preset.Number, playMode); err != nil {
+				return err
+			}
 		}
-		playlistItems = append(playlistItems, item)
-	}
-	
-	return playlistItems, nil
-}
 
-// playPreset handles the POST request to play a preset on a speaker
-func playPreset(w http.ResponseWriter, r *http.Request, presetNum string, speakerName string) {
-	log.Printf("Preset %s requested for speaker: %s", presetNum, speakerName)
-	
-	// Get playlist items
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
-	}
-	
-	playlistItems, err := getPresetPlaylistItems(presetNum, scheme)
-	if err != nil {
-		log.Printf("Failed to get preset playlist: %v", err)
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
-	}
-	
-	// Find the speaker in our cache
-	speaker, exists := speakerCache[speakerName]
-	if !exists {
-		http.Error(w, fmt.Sprintf("Speaker '%s' not found", speakerName), http.StatusNotFound)
-		return
-	}
-	
-	// Connect to Sonos device
-	locationURL := fmt.Sprintf("http://%s:1400/xml/device_description.xml", speaker.Address)
-	
-	svcMap, err := upnp.Describe(ssdp.Location(locationURL))
-	if err != nil {
-		log.Printf("Failed to describe Sonos device: %v", err)
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Create Sonos connection with AV Transport and Content Directory services
-	s := sonos.MakeSonos(svcMap, nil, sonos.SVC_AV_TRANSPORT|sonos.SVC_CONTENT_DIRECTORY)
-	if s == nil {
-		log.Printf("Failed to create Sonos connection")
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Clear the current queue first
-	log.Printf("Clearing current queue on %s", speaker.Name)
-	err = s.RemoveAllTracksFromQueue(0)
-	if err != nil {
-		log.Printf("Warning: Failed to clear queue: %v", err)
-	}
-	
-	// Add all MP3 files from the preset to the queue
-	var addedTracks int
-	for _, item := range playlistItems {
-		songURL := item.URL
-		songTitle := item.Title
-		
-		log.Printf("Adding track to queue: %s", songURL)
-		
-		// Add URI to queue with filename as metadata
-		req := &upnp.AddURIToQueueIn{
-			EnqueuedURI:         songURL,
-			EnqueuedURIMetaData: fmt.Sprintf("<DIDL-Lite><item><dc:title>%s</dc:title></item></DIDL-Lite>", songTitle),
-			DesiredFirstTrackNumberEnqueued: 0,
-			EnqueueAsNext: false,
+		// Remember where the preset being replaced was left off, then pick up
+		// this one where it was if asked to
+		presetProgress.Capture(c.speaker, c.s)
+		resume := preset.Manifest.resume()
+		if req.Resume != nil {
+			resume = *req.Resume
 		}
-		
-		if out, err := s.AddURIToQueue(0, req); err != nil {
-			log.Printf("Failed to add track %s to queue: %v", songURL, err)
-			http.Error(w, "Failed to add tracks to queue", http.StatusInternalServerError)
-			return
-		} else {
-			log.Printf("Added track %s at position %d", songURL, out.FirstTrackNumberEnqueued)
-			addedTracks++
+		var from *resumePoint
+		if resume {
+			if position, ok := presetProgress.Position(preset.Number, c.speaker); ok {
+				from = resumePointIn(preset.Items, position)
+			}
 		}
-	}
-	
-	log.Printf("Added %d tracks from preset %s to queue, setting up playback from queue", addedTracks, presetNum)
-	
-	// Get queue metadata to obtain the correct playable URI
-	if data, err := s.GetMetadata(sonos.ObjectID_Queue_AVT_Instance_0); err != nil {
-		log.Printf("Failed to get queue metadata: %v", err)
-		http.Error(w, "Failed to get queue metadata", http.StatusInternalServerError)
-		return
-	} else {
-		// Use the actual resource URI from metadata
-		if err := s.SetAVTransportURI(0, data[0].Res(), ""); err != nil {
-			log.Printf("Failed to set queue URI: %v", err)
-			http.Error(w, "Failed to set queue for playback", http.StatusInternalServerError)
-			return
+
+		if err := playQueue(c, preset.Items, playMode, volume, from); err != nil {
+			return err
 		}
+		presetProgress.Started(c.speaker, preset.Number)
+		if playMode != "" {
+			c.state.PlayMode = playModeName(playMode)
+		}
+
+		log.Printf("Successfully started playing preset %s on %s", preset.Number, c.speaker.Name)
+		c.state.TransportState = upnp.State_PLAYING
+		name := "preset " + preset.Number
+		if preset.Manifest != nil && preset.Manifest.Name != "" {
+			name = fmt.Sprintf("preset %s (%s)", preset.Number, preset.Name)
+		}
+		if track := c.state.Track; track != nil {
+			return c.reply("Resumed %s at track %d %s on %s", name, track.Index, track.Elapsed, c.speaker.Name)
+		}
+		return c.reply("Playing %s on %s", name, c.speaker.Name)
 	}
-	
-	log.Printf("Queue URI set successfully, starting playback...")
-	
-	// Start playback from the queue
-	err = s.Play(0, "1")
-	if err != nil {
-		log.Printf("Failed to start playback: %v", err)
-		http.Error(w, "Failed to start playback", http.StatusInternalServerError)
-		return
-	}
-	
-	log.Printf("Successfully started playing preset %s on %s", presetNum, speaker.Name)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("Playing preset %s on %s\n", presetNum, speaker.Name)))
 }
 
 func presetHandler(w http.ResponseWriter, r *http.Request) {
@@ -392,56 +427,91 @@ func presetHandler(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	presetNum := strings.TrimPrefix(path, "/sonos/preset/")
 	if presetNum == "" || presetNum == path {
-		http.Error(w, "Invalid preset path", http.StatusBadRequest)
+		writeError(w, r, "preset", "", commandRejected(http.StatusBadRequest, codeInvalidRequest, "Invalid preset path"))
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, r, "preset", "", commandRejected(http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	// Load the playlist before connecting to the speaker
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	preset, err := loadPreset(musicLibrary, presetNum, scheme)
+	if err != nil {
+		log.Printf("Failed to get preset playlist: %v", err)
+		writeError(w, r, "preset", "", err)
 		return
 	}
-	
+
 	switch r.Method {
 	case http.MethodGet:
-		// Return playlist items as JSON
-		scheme := "http"
-		if r.TLS != nil {
-			scheme = "https"
+		// Return playlist items and preset settings as JSON
+		manifest := preset.Manifest
+		if manifest == nil {
+			manifest = &PresetManifest{}
 		}
-		
-		playlistItems, err := getPresetPlaylistItems(presetNum, scheme)
-		if err != nil {
-			log.Printf("Failed to get preset playlist: %v", err)
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		
-		response := map[string]interface{}{
-			"preset":         presetNum,
-			"playlist_count": len(playlistItems),
-			"playlist_items": playlistItems,
-		}
-		
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
-		
+		writeJSON(w, http.StatusOK, struct {
+			commandResponse
+			Preset        string          `json:"preset"`
+			Name          string          `json:"name"`
+			AlbumArtURI   string          `json:"album_art_uri,omitempty"`
+			Volume        *uint16         `json:"volume,omitempty"`
+			PlayMode      string          `json:"play_mode"`
+			Shuffle       bool            `json:"shuffle"`
+			Repeat        bool            `json:"repeat"`
+			Type          string          `json:"type"`
+			Chapters      []PresetChapter `json:"chapters,omitempty"`
+			TargetSpeaker string          `json:"target_speaker,omitempty"`
+			PlaylistCount int             `json:"playlist_count"`
+			PlaylistItems []ListItem      `json:"playlist_items"`
+		}{
+			commandResponse: commandResponse{
+				OK:      true,
+				Action:  "preset",
+				Message: fmt.Sprintf("Preset %s has %d tracks", presetNum, len(preset.Items)),
+			},
+			Preset:        presetNum,
+			Name:          preset.Name,
+			AlbumArtURI:   preset.AlbumArtURI,
+			Volume:        manifest.Volume,
+			PlayMode:      playModeName(manifest.playMode()),
+			Shuffle:       manifest.Shuffle,
+			Repeat:        manifest.Repeat,
+			Type:          presetType(manifest),
+			Chapters:      manifest.Chapters,
+			TargetSpeaker: manifest.Speaker,
+			PlaylistCount: len(preset.Items),
+			PlaylistItems: preset.Items,
+		})
+
 	case http.MethodPost:
-		// Parse JSON request body to get optional speaker name
-		var req struct {
-			Speaker string `json:"speaker"`
+		// Leave the speaker alone when there is nothing to play. The
+		// envelope is sent whatever the Accept header, so clients such as the
+		// CardPuter can tell an empty preset by its error code.
+		if len(preset.Items) == 0 {
+			writeJSON(w, http.StatusConflict, commandResponse{
+				Action:  "preset",
+				Message: fmt.Sprintf("Preset %s has no playable tracks", presetNum),
+				Error:   codePresetEmpty,
+			})
+			return
 		}
-		
-		if r.Body != nil {
-			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-				// Body might be empty or invalid JSON, that's okay
-				log.Printf("Could not parse JSON body: %v", err)
-			}
+
+		cmd := speakerCommand{
+			name:     fmt.Sprintf("Preset %s", presetNum),
+			action:   "preset",
+			services: sonos.SVC_AV_TRANSPORT | sonos.SVC_CONTENT_DIRECTORY | sonos.SVC_RENDERING_CONTROL,
+			run:      playPresetCommand(preset),
 		}
-		
-		if req.Speaker == "" {
-			req.Speaker = defaultSpeaker
+		if preset.Manifest != nil {
+			cmd.speaker = preset.Manifest.Speaker
 		}
-		
-		playPreset(w, r, presetNum, req.Speaker)
-		
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		runCommand(w, r, cmd)
 	}
 }
 
@@ -450,54 +520,56 @@ func playlistHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	
+
 	log.Println("Generating dynamic playlist...")
-	
+
 	// Use the configured resource host for external devices to reach us
 	scheme := "http"
 	if r.TLS != nil {
 		scheme = "https"
 	}
 	baseURL := fmt.Sprintf("%s://%s", scheme, resourceHost)
-	
-	// Walk the embedded music filesystem to find all MP3 files
+
+	// Walk the music filesystem to find all audio files
+	fsys := musicLibrary.FS()
 	var songs []string
-	err := fs.WalkDir(musicFS, "music", func(path string, d fs.DirEntry, err error) error {
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		
-		if !d.IsDir() && strings.HasSuffix(strings.ToLower(path), ".mp3") {
-			// Convert embedded path to HTTP URL
-			// Remove "music/" prefix since our HTTP handler strips it
-			httpPath := strings.TrimPrefix(path, "music/")
-			songURL := fmt.Sprintf("%s/music/%s", baseURL, url.PathEscape(httpPath))
+
+		if d.IsDir() {
+			return nil
+		}
+		if _, ok := audioFile(fsys, path); ok {
+			// Convert music path to HTTP URL
+			songURL := fmt.Sprintf("%s/music/%s", baseURL, url.PathEscape(path))
 			songs = append(songs, songURL)
 			log.Printf("Added to playlist: %s", songURL)
 		}
-		
+
 		return nil
 	})
-	
+
 	if err != nil {
 		log.Printf("Error walking music filesystem: %v", err)
 		http.Error(w, "Failed to generate playlist", http.StatusInternalServerError)
 		return
 	}
-	
+
 	if len(songs) == 0 {
-		log.Println("No MP3 files found in embedded filesystem")
+		log.Println("No audio files found in music filesystem")
 		http.Error(w, "No songs available", http.StatusNotFound)
 		return
 	}
-	
+
 	// Generate M3U playlist format
 	w.Header().Set("Content-Type", "audio/x-mpegurl")
 	w.Header().Set("Content-Disposition", "attachment; filename=\"playlist.m3u\"")
-	
+
 	// Write M3U header
 	w.Write([]byte("#EXTM3U\n"))
-	
+
 	// Write each song entry
 	for _, song := range songs {
 		// Extract filename for display
@@ -505,374 +577,295 @@ func playlistHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(fmt.Sprintf("#EXTINF:-1,%s\n", filename)))
 		w.Write([]byte(fmt.Sprintf("%s\n", song)))
 	}
-	
+
 	log.Printf("Generated playlist with %d songs", len(songs))
 }
 
-func playHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	
-	// Parse JSON request body to get speaker name
-	var req struct {
-		Speaker string `json:"speaker"`
-	}
-	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
-		return
-	}
-	
-	if req.Speaker == "" {
-		req.Speaker = defaultSpeaker
-	}
-	
-	log.Printf("Play requested for speaker: %s", req.Speaker)
-	
-	// Find the speaker in our cache
-	speaker, exists := speakerCache[req.Speaker]
-	if !exists {
-		http.Error(w, fmt.Sprintf("Speaker '%s' not found", req.Speaker), http.StatusNotFound)
-		return
-	}
-	
-	// Connect to Sonos device
-	locationURL := fmt.Sprintf("http://%s:1400/xml/device_description.xml", speaker.Address)
-	
-	svcMap, err := upnp.Describe(ssdp.Location(locationURL))
-	if err != nil {
-		log.Printf("Failed to describe Sonos device: %v", err)
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Create Sonos connection with AV Transport and Content Directory services
-	s := sonos.MakeSonos(svcMap, nil, sonos.SVC_AV_TRANSPORT|sonos.SVC_CONTENT_DIRECTORY)
-	if s == nil {
-		log.Printf("Failed to create Sonos connection")
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Clear the current queue first
-	log.Printf("Clearing current queue on %s", speaker.Name)
-	err = s.RemoveAllTracksFromQueue(0)
-	if err != nil {
-		log.Printf("Warning: Failed to clear queue: %v", err)
-	}
-	
-	// Get all MP3 files from embedded filesystem and add them to the queue
+// playCommand replaces the queue with every audio file in the music library
+// and starts playback
+func playCommand(c *commandContext) error {
+	// Get all audio files from the music filesystem
 	scheme := "http"
-	if r.TLS != nil {
+	if c.r.TLS != nil {
 		scheme = "https"
 	}
 	baseURL := fmt.Sprintf("%s://%s", scheme, resourceHost)
-	
-	var addedTracks int
-	err = fs.WalkDir(musicFS, "music", func(path string, d fs.DirEntry, err error) error {
+
+	fsys := musicLibrary.FS()
+	var items []ListItem
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		
-		if !d.IsDir() && strings.HasSuffix(strings.ToLower(path), ".mp3") {
-			// Convert embedded path to HTTP URL
-			// Remove "music/" prefix since our HTTP handler strips it
-			httpPath := strings.TrimPrefix(path, "music/")
-			songURL := fmt.Sprintf("%s/music/%s", baseURL, url.PathEscape(httpPath))
-			
-			log.Printf("Adding track to queue: %s", songURL)
-			
-			// Extract filename from URL for metadata
-			filename := filepath.Base(songURL)
-			// Remove file extension for cleaner display
-			songTitle := strings.TrimSuffix(filename, filepath.Ext(filename))
-			
-			// Add URI to queue with filename as metadata
-			req := &upnp.AddURIToQueueIn{
-				EnqueuedURI:         songURL,
-				EnqueuedURIMetaData: fmt.Sprintf("<DIDL-Lite><item><dc:title>%s</dc:title></item></DIDL-Lite>", songTitle),
-				DesiredFirstTrackNumberEnqueued: 0,
-				EnqueueAsNext: false,
-			}
-			
-			if out, err := s.AddURIToQueue(0, req); err != nil {
-				log.Printf("Failed to add track %s to queue: %v", songURL, err)
-				return err
-			} else {
-				log.Printf("Added track %s at position %d", songURL, out.FirstTrackNumberEnqueued)
-				addedTracks++
-			}
+
+		if d.IsDir() {
+			return nil
 		}
-		
+		if _, ok := audioFile(fsys, path); ok {
+			items = append(items, musicLibrary.trackItem(len(items), path, baseURL, ""))
+		}
+
 		return nil
 	})
-	
 	if err != nil {
-		log.Printf("Failed to add tracks to queue: %v", err)
-		http.Error(w, "Failed to add tracks to queue", http.StatusInternalServerError)
-		return
+		return commandFailed("Failed to read music library", err)
 	}
-	
-	if addedTracks == 0 {
-		log.Println("No MP3 files found to add to queue")
-		http.Error(w, "No songs available", http.StatusNotFound)
-		return
+
+	if len(items) == 0 {
+		log.Println("No audio files found to add to queue")
+		return commandRejected(http.StatusNotFound, codeNotFound, "No songs available")
 	}
-	
-	log.Printf("Added %d tracks to queue, setting up playback from queue", addedTracks)
-	
-	// Get queue metadata to obtain the correct playable URI
-	if data, err := s.GetMetadata(sonos.ObjectID_Queue_AVT_Instance_0); err != nil {
-		log.Printf("Failed to get queue metadata: %v", err)
-		http.Error(w, "Failed to get queue metadata", http.StatusInternalServerError)
-		return
-	} else {
-		// Use the actual resource URI from metadata
-		if err := s.SetAVTransportURI(0, data[0].Res(), ""); err != nil {
-			log.Printf("Failed to set queue URI: %v", err)
-			http.Error(w, "Failed to set queue for playback", http.StatusInternalServerError)
-			return
-		}
+
+	if err := playQueue(c, items, "", nil, nil); err != nil {
+		return err
 	}
-	
-	log.Printf("Queue URI set successfully, starting playback...")
-	
-	// Start playback from the queue
-	// Play requires (instanceID, speed)
-	err = s.Play(0, "1")
+
+	log.Printf("Successfully started playback on %s", c.speaker.Name)
+	c.state.TransportState = upnp.State_PLAYING
+	return c.reply("Playing playlist on %s", c.speaker.Name)
+}
+
+// playQueue replaces the speaker's queue with items and plays it from the
+// first track, or from the item and time of from when it is not nil. A volume
+// other than nil is set before the queue is replaced and a playMode other
+// than "" once the queue is the speaker's source, both before playback
+// starts. Only the tracks up to the one playback starts with are
+// queued before playback starts; the rest are added in the background so
+// audio starts without waiting for a long playlist. If playback cannot be started
+// the previous queue, source and volume are put back, so a failed preset
+// does not leave the speaker silent.
+func playQueue(c *commandContext, items []ListItem, playMode string, volume *uint16, from *resumePoint) error {
+	s := c.s
+	if len(items) == 0 {
+		return commandRejected(http.StatusNotFound, codeNotFound, "No tracks to play")
+	}
+
+	// Stop adding the tracks of an earlier playlist to this speaker
+	queueFillers.Stop(c.speaker)
+
+	snapshot, err := takeQueueSnapshot(s)
 	if err != nil {
-		log.Printf("Failed to start playback: %v", err)
-		http.Error(w, "Failed to start playback", http.StatusInternalServerError)
-		return
+		log.Printf("Warning: failed to save the queue of %s, it cannot be restored on failure: %v", c.speaker.Name, err)
 	}
-	
-	log.Printf("Successfully started playback on %s", speaker.Name)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("Playing playlist on %s\n", speaker.Name)))
-}
 
-func queueHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	if volume != nil {
+		if snapshot != nil {
+			snapshot.recordVolume(s)
+		}
+		if err := s.SetVolume(*volume); err != nil {
+			return commandFailed("Failed to set volume", err)
+		}
+		c.state.Volume = volume
 	}
 
-	var req struct {
-		Speaker string `json:"speaker"`
+	// Clear the current queue first
+	log.Printf("Clearing current queue on %s", c.speaker.Name)
+	if err := s.RemoveAllTracksFromQueue(); err != nil {
+		log.Printf("Warning: Failed to clear queue: %v", err)
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("Error decoding JSON request: %v", err)
-		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
-		return
+	// Queue the first track that can be added, skipping any that fail
+	next := 0
+	for ; next < len(items); next++ {
+		err := enqueueTrack(s, items[next])
+		if err == nil {
+			break
+		}
+		log.Printf("Warning: failed to add track %s: %v", items[next].URL, err)
+		c.failedTracks = append(c.failedTracks, items[next].Filename)
+	}
+	if next == len(items) {
+		return rollbackQueue(c, snapshot, commandFailed("Failed to add tracks to queue", fmt.Errorf("all %d tracks failed", len(items))))
+	}
+
+	// When resuming, queue every track up to the one to resume so playback
+	// can seek to it; the rest are added in the background as usual
+	resumeIndex := -1
+	if from != nil {
+		resumeIndex = from.index
+	}
+	queued, resumeTrack := 1, 0
+	if next == resumeIndex {
+		resumeTrack = 1
+	}
+	for next++; next <= resumeIndex && next < len(items); next++ {
+		if err := enqueueTrack(s, items[next]); err != nil {
+			log.Printf("Warning: failed to add track %s: %v", items[next].URL, err)
+			c.failedTracks = append(c.failedTracks, items[next].Filename)
+			continue
+		}
+		queued++
+		if next == resumeIndex {
+			resumeTrack = queued
+		}
 	}
 
-	if req.Speaker == "" {
-		req.Speaker = defaultSpeaker
+	log.Printf("Added first track to queue, setting up playback from queue")
+
+	// Get queue metadata to obtain the correct playable URI
+	data, err := s.GetMetadata(sonos.ObjectID_Queue_AVT_Instance_0)
+	if err != nil {
+		return rollbackQueue(c, snapshot, commandFailed("Failed to get queue metadata", err))
+	}
+	if len(data) == 0 || data[0].Res() == "" {
+		return rollbackQueue(c, snapshot, commandFailed("Failed to get queue metadata", errors.New("speaker returned no queue URI")))
 	}
 
-	log.Printf("Queue requested for speaker: %s", req.Speaker)
+	// Use the actual resource URI from metadata
+	if err := s.SetAVTransportURI(data[0].Res(), ""); err != nil {
+		return rollbackQueue(c, snapshot, commandFailed("Failed to set queue for playback", err))
+	}
 
-	speaker, exists := speakerCache[req.Speaker]
-	if !exists {
-		http.Error(w, "Speaker not found", http.StatusNotFound)
-		return
+	log.Printf("Queue URI set successfully, starting playback...")
+
+	if playMode != "" {
+		if err := s.SetPlayMode(playMode); err != nil {
+			return rollbackQueue(c, snapshot, commandFailed("Failed to set play mode", err))
+		}
 	}
 
-	// Connect to Sonos device
-	locationURL := fmt.Sprintf("http://%s:1400/xml/device_description.xml", speaker.Address)
-	
-	svcMap, err := upnp.Describe(ssdp.Location(locationURL))
-	if err != nil {
-		log.Printf("Failed to describe Sonos device: %v", err)
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
+	if resumeTrack > 0 {
+		seekResume(c, items[from.index], resumeTrack, from.relTime)
 	}
 
-	// Create Sonos connection with Content Directory service for queue browsing
-	s := sonos.MakeSonos(svcMap, nil, sonos.SVC_CONTENT_DIRECTORY)
-	
-	queueContents, err := s.GetQueueContents()
+	// Start playback from the queue
+	if err := s.Play(); err != nil {
+		return rollbackQueue(c, snapshot, commandFailed("Failed to start playback", err))
+	}
+
+	if next < len(items) {
+		log.Printf("Adding %d more tracks to the queue of %s in the background", len(items)-next, c.speaker.Name)
+		queueFillers.Start(c.speaker, s, items[next:])
+		// The rest of the queue is unverified until the fill is done; its
+		// failed tracks are reported by /sonos/status
+		c.state.QueueFill, _ = queueFillers.Status(c.speaker)
+	}
+	return nil
+}
+
+// queueCommand returns the speaker's queue as JSON
+func queueCommand(c *commandContext) error {
+	queueContents, err := c.s.GetQueueContents()
 	if err != nil {
-		log.Printf("Error getting queue contents: %v", err)
-		http.Error(w, "Failed to get queue contents", http.StatusInternalServerError)
-		return
+		return commandFailed("Failed to get queue contents", err)
 	}
 
 	// Extract detailed information from queue items for debugging
 	var queueItems []map[string]interface{}
 	for i, item := range queueContents {
 		queueItem := map[string]interface{}{
-			"index":          i,
-			"id":             item.ID(),
-			"title":          item.Title(),
-			"uri":            item.Res(),
-			"creator":        item.Creator(),
-			"album":          item.Album(),
-			"track_number":   item.OriginalTrackNumber(),
-			"class":          item.Class(),
-			"album_art_uri":  item.AlbumArtURI(),
-			"parent_id":      item.ParentID(),
-			"restricted":     item.Restricted(),
+			"index":         i,
+			"id":            item.ID(),
+			"title":         item.Title(),
+			"uri":           item.Res(),
+			"creator":       item.Creator(),
+			"album":         item.Album(),
+			"track_number":  item.OriginalTrackNumber(),
+			"class":         item.Class(),
+			"album_art_uri": item.AlbumArtURI(),
+			"parent_id":     item.ParentID(),
+			"restricted":    item.Restricted(),
 		}
 		queueItems = append(queueItems, queueItem)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"speaker":        req.Speaker,
-		"queue_length":   len(queueContents),
-		"queue_items":    queueItems,
+	// The queue is data rather than a message, so it is always JSON: the
+	// usual envelope plus the queue contents
+	return c.replyJSON(struct {
+		commandResponse
+		QueueLength int                      `json:"queue_length"`
+		QueueItems  []map[string]interface{} `json:"queue_items"`
+	}{
+		commandResponse: c.response(fmt.Sprintf("%d tracks in queue on %s", len(queueContents), c.speaker.Name)),
+		QueueLength:     len(queueContents),
+		QueueItems:      queueItems,
 	})
 }
 
-func pauseHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	
-	// Parse JSON request body to get optional speaker name
-	var req struct {
-		Speaker string `json:"speaker"`
-	}
-	
-	if r.Body != nil {
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			// Body might be empty or invalid JSON, that's okay
-			log.Printf("Could not parse JSON body: %v", err)
-		}
-	}
-	
-	if req.Speaker == "" {
-		req.Speaker = defaultSpeaker
-	}
-	
-	log.Printf("Pause requested for speaker: %s", req.Speaker)
-	
-	// Find the speaker in our cache
-	speaker, exists := speakerCache[req.Speaker]
-	if !exists {
-		http.Error(w, fmt.Sprintf("Speaker '%s' not found", req.Speaker), http.StatusNotFound)
-		return
+// pauseCommand pauses playback
+func pauseCommand(c *commandContext) error {
+	presetProgress.Capture(c.speaker, c.s)
+	if err := c.s.Pause(); err != nil {
+		return commandFailed("Failed to pause playback", err)
 	}
-	
-	// Connect to Sonos device
-	locationURL := fmt.Sprintf("http://%s:1400/xml/device_description.xml", speaker.Address)
-	
-	svcMap, err := upnp.Describe(ssdp.Location(locationURL))
-	if err != nil {
-		log.Printf("Failed to describe Sonos device: %v", err)
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Create Sonos connection with AV Transport service
-	s := sonos.MakeSonos(svcMap, nil, sonos.SVC_AV_TRANSPORT)
-	if s == nil {
-		log.Printf("Failed to create Sonos connection")
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Pause playback
-	err = s.Pause(0)
-	if err != nil {
-		log.Printf("Failed to pause playback: %v", err)
-		http.Error(w, "Failed to pause playback", http.StatusInternalServerError)
-		return
-	}
-	
-	log.Printf("Successfully paused playback on %s", speaker.Name)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("Paused %s\n", speaker.Name)))
+
+	log.Printf("Successfully paused playback on %s", c.speaker.Name)
+	c.state.TransportState = upnp.State_PAUSED_PLAYBACK
+	return c.reply("Paused %s", c.speaker.Name)
 }
 
-func restartPlaylistHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	
-	// Parse JSON request body to get optional speaker name
-	var req struct {
-		Speaker string `json:"speaker"`
+// resumeCommand plays whatever the speaker has loaded, leaving its queue
+// alone
+func resumeCommand(c *commandContext) error {
+	if err := c.s.Play(); err != nil {
+		return commandFailed("Failed to start playback", err)
 	}
-	
-	if r.Body != nil {
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			// Body might be empty or invalid JSON, that's okay
-			log.Printf("Could not parse JSON body: %v", err)
-		}
+
+	log.Printf("Successfully resumed playback on %s", c.speaker.Name)
+	c.state.TransportState = upnp.State_PLAYING
+	return c.reply("Playing on %s", c.speaker.Name)
+}
+
+// restartPlaylistCommand plays the queue from the first track
+func restartPlaylistCommand(c *commandContext) error {
+	// Seek to the first track in the queue
+	if err := c.s.Seek("TRACK_NR", "1"); err != nil {
+		return commandFailed("Failed to restart playlist", err)
 	}
-	
-	if req.Speaker == "" {
-		req.Speaker = defaultSpeaker
-	}
-	
-	log.Printf("Restart playlist requested for speaker: %s", req.Speaker)
-	
-	// Find the speaker in our cache
-	speaker, exists := speakerCache[req.Speaker]
-	if !exists {
-		http.Error(w, fmt.Sprintf("Speaker '%s' not found", req.Speaker), http.StatusNotFound)
-		return
+
+	// Start playing from the beginning
+	if err := c.s.Play(); err != nil {
+		return commandFailed("Failed to start playback", err)
 	}
-	
-	// Connect to Sonos device
-	locationURL := fmt.Sprintf("http://%s:1400/xml/device_description.xml", speaker.Address)
-	
-	svcMap, err := upnp.Describe(ssdp.Location(locationURL))
+
+	log.Printf("Successfully restarted playlist on %s", c.speaker.Name)
+	c.state.TransportState = upnp.State_PLAYING
+	return c.reply("Playlist restarted on %s", c.speaker.Name)
+}
+
+// discoverSonosDevices finds speakers with SSDP and by probing the static
+// speaker addresses, falling back to a subnet sweep when SSDP finds nothing,
+// then prunes registered speakers that no longer answer
+func discoverSonosDevices() ([]SpeakerInfo, error) {
+	speakers, err := discoverSSDP()
 	if err != nil {
-		log.Printf("Failed to describe Sonos device: %v", err)
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
+		log.Printf("SSDP discovery failed: %v", err)
 	}
-	
-	// Create Sonos connection with AV Transport service
-	s := sonos.MakeSonos(svcMap, nil, sonos.SVC_AV_TRANSPORT)
-	if s == nil {
-		log.Printf("Failed to create Sonos connection")
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
+
+	seen := make(map[string]bool)
+	for _, speaker := range speakers {
+		seen[speaker.IP] = true
 	}
-	
-	// Seek to the beginning of the current track (position 0)
-	err = s.Seek(0, "TRACK_NR", "1")
-	if err != nil {
-		log.Printf("Failed to restart playlist: %v", err)
-		http.Error(w, "Failed to restart playlist", http.StatusInternalServerError)
-		return
+	ssdpFound := len(speakers) > 0
+	speakers = append(speakers, probeSpeakerAddresses(staticSpeakerAddresses, seen)...)
+	if !ssdpFound && len(sweepSubnets) > 0 {
+		log.Println("SSDP found no speakers, falling back to subnet sweep")
+		speakers = append(speakers, sweepForSpeakers(sweepSubnets, seen)...)
 	}
-	
-	// Start playing from the beginning
-	err = s.Play(0, "1")
-	if err != nil {
-		log.Printf("Failed to start playback: %v", err)
-		http.Error(w, "Failed to start playback", http.StatusInternalServerError)
-		return
+
+	// Drop registered speakers that were not found and no longer answer
+	pruneSpeakers(speakers)
+
+	if len(speakers) == 0 && err != nil {
+		return nil, err
 	}
-	
-	log.Printf("Successfully restarted playlist on %s", speaker.Name)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("Playlist restarted on %s\n", speaker.Name)))
+	return speakers, nil
 }
 
-func discoverSonosDevices() ([]SpeakerInfo, error) {
+// discoverSSDP finds speakers with SSDP multicast on each suitable interface
+func discoverSSDP() ([]SpeakerInfo, error) {
 	var speakers []SpeakerInfo
-	
+
 	// Create SSDP manager
 	mgr := ssdp.MakeManager()
 	defer mgr.Close()
-	
+
 	// Get all available network interfaces using Go standard library
 	netInterfaces, err := net.Interfaces()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get network interfaces: %v", err)
 	}
-	
+
 	// Filter for suitable interfaces and extract names
 	var interfaceNames []string
 	for _, iface := range netInterfaces {
@@ -880,13 +873,13 @@ func discoverSonosDevices() ([]SpeakerInfo, error) {
 		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
 			continue
 		}
-		
+
 		// Check if interface has IPv4 addresses
 		addrs, err := iface.Addrs()
 		if err != nil {
 			continue
 		}
-		
+
 		hasIPv4 := false
 		for _, addr := range addrs {
 			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
@@ -894,18 +887,18 @@ func discoverSonosDevices() ([]SpeakerInfo, error) {
 				break
 			}
 		}
-		
+
 		if hasIPv4 {
 			interfaceNames = append(interfaceNames, iface.Name)
 		}
 	}
-	
+
 	if len(interfaceNames) == 0 {
 		return nil, fmt.Errorf("no suitable network interfaces found")
 	}
-	
+
 	log.Printf("Found %d suitable network interfaces: %v", len(interfaceNames), interfaceNames)
-	
+
 	for _, iface := range interfaceNames {
 		log.Printf("Trying discovery on interface: %s", iface)
 		err := mgr.Discover(iface, "1900", false)
@@ -913,95 +906,159 @@ func discoverSonosDevices() ([]SpeakerInfo, error) {
 			log.Printf("Discovery error on %s: %v", iface, err)
 			continue
 		}
-		
+
 		// Give discovery some time to complete
 		time.Sleep(2 * time.Second)
-		
+
 		// Get all discovered devices
 		devices := mgr.Devices()
 		log.Printf("Found %d devices on %s", len(devices), iface)
-		
+
 		// Track unique IPs to avoid duplicates (same device may have multiple services)
 		seenIPs := make(map[string]bool)
-		
+
 		for _, device := range devices {
 			// Check if this is a Sonos device
 			if strings.Contains(strings.ToLower(device.Product()), "sonos") {
 				ip := extractIPFromLocation(device.Location())
 				if ip != "" && !seenIPs[ip] {
 					seenIPs[ip] = true
-					
-					// Try to connect to get the actual room name and device name
-					roomName, deviceName := getSonosRoomName(ip)
-					if roomName == "" {
-						roomName = device.Name() // fallback to device name
-					}
-					if deviceName == "" {
-						deviceName = roomName
-					}
-					
-					// Store in cache
-					speaker := Speaker{
-						Name:    deviceName,
-						Address: ip,
-						Room:    roomName,
+
+					// Probe the device for its UUID and room name
+					speaker, err := probeSpeaker(ip)
+					if err != nil {
+						log.Printf("Failed to probe Sonos device at %s: %v", ip, err)
+						continue
 					}
-					speakerCache[deviceName] = speaker
-					
+
+					// Store in registry
+					speakerRegistry.Put(speaker)
+
 					speakers = append(speakers, SpeakerInfo{
-						Name: deviceName,
+						Name: speaker.Name,
 						IP:   ip,
 					})
-					log.Printf("Found Sonos device: %s (room: %s) at %s", deviceName, roomName, ip)
+					log.Printf("Found Sonos device: %s (room: %s) at %s", speaker.Name, speaker.Room, ip)
 				}
 			}
 		}
-		
+
 		// If we found some speakers, no need to try other interfaces
 		if len(speakers) > 0 {
 			break
 		}
 	}
-	
+
 	return speakers, nil
 }
 
+// pruneSpeakers probes every registered speaker missing from found and
+// removes the ones that do not answer
+func pruneSpeakers(found []SpeakerInfo) {
+	foundIPs := make(map[string]bool)
+	for _, speaker := range found {
+		foundIPs[speaker.IP] = true
+	}
+
+	for _, speaker := range speakerRegistry.List() {
+		if foundIPs[speaker.Address] {
+			continue
+		}
+		if probed, err := probeSpeaker(speaker.Address); err != nil || probed.UUID != speaker.UUID {
+			log.Printf("Removing speaker %s at %s: no longer answering", speaker.Name, speaker.Address)
+			speakerRegistry.Remove(speaker.UUID)
+		} else {
+			speakerRegistry.Put(probed)
+		}
+	}
+}
+
 func getSonosRoomName(ip string) (string, string) {
 	log.Printf("Getting room name for Sonos device at %s", ip)
-	
-	// Try to find the device by creating it manually using the known IP
-	locationURL := fmt.Sprintf("http://%s:1400/xml/device_description.xml", ip)
-	
-	// Try to describe the device at this location to get UPnP services
-	if svcMap, err := upnp.Describe(ssdp.Location(locationURL)); err != nil {
-		log.Printf("Failed to describe device at %s: %v", ip, err)
+
+	// Connect to the device using the known IP with only the device
+	// properties service enabled
+	s, err := connectSpeaker(ip, sonos.SVC_DEVICE_PROPERTIES)
+	if err != nil {
+		log.Printf("Failed to connect to device at %s: %v", ip, err)
+		return "Unknown Room", "Sonos Speaker"
+	}
+
+	// Get zone attributes - this returns (currentZoneName, currentIcon, error)
+	if currentZoneName, _, err := s.GetZoneAttributes(); err != nil {
+		log.Printf("Failed to get zone attributes from %s: %v", ip, err)
 		return "Unknown Room", "Sonos Speaker"
 	} else {
-		// Create Sonos connection WITHOUT reactor to avoid HTTP handler conflicts
-		// Pass nil reactor and only enable device properties service
-		s := sonos.MakeSonos(svcMap, nil, sonos.SVC_DEVICE_PROPERTIES)
-		if s == nil {
-			log.Printf("Failed to create Sonos connection for %s", ip)
-			return "Unknown Room", "Sonos Speaker"
-		}
-		
-		// Get zone attributes - this returns (currentZoneName, currentIcon, error)
-		if currentZoneName, _, err := s.GetZoneAttributes(); err != nil {
-			log.Printf("Failed to get zone attributes from %s: %v", ip, err)
-			return "Unknown Room", "Sonos Speaker"
-		} else {
-			roomName := currentZoneName
-			deviceName := currentZoneName // Use zone name as device name
-			
-			if roomName == "" {
-				roomName = "Unknown Room" 
-				deviceName = "Sonos Speaker"
-			}
-			
-			log.Printf("Found Sonos device: room='%s', device='%s'", roomName, deviceName)
-			return roomName, deviceName
+		roomName := currentZoneName
+		deviceName := currentZoneName // Use zone name as device name
+
+		if roomName == "" {
+			roomName = "Unknown Room"
+			deviceName = "Sonos Speaker"
 		}
+
+		log.Printf("Found Sonos device: room='%s', device='%s'", roomName, deviceName)
+		return roomName, deviceName
+	}
+}
+
+// deviceDescription is the subset of device_description.xml used to identify
+// a speaker
+type deviceDescription struct {
+	Device struct {
+		UDN string `xml:"UDN"`
+	} `xml:"device"`
+}
+
+// describeClient fetches device descriptions with the same timeout go-sonos
+// uses for upnp.Describe
+var describeClient = &http.Client{Timeout: 3 * time.Second}
+
+// probeSpeaker fetches the device description at address to confirm a Sonos
+// device is answering and to learn its UUID, then looks up its room name
+func probeSpeaker(address string) (Speaker, error) {
+	resp, err := describeClient.Get(string(speakerLocation(address)))
+	if err != nil {
+		return Speaker{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Speaker{}, fmt.Errorf("unexpected status %s from %s", resp.Status, address)
+	}
+
+	var desc deviceDescription
+	if err := xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return Speaker{}, fmt.Errorf("invalid device description from %s: %w", address, err)
 	}
+
+	uuid := strings.TrimPrefix(desc.Device.UDN, "uuid:")
+	if uuid == "" {
+		return Speaker{}, fmt.Errorf("device at %s has no UDN", address)
+	}
+
+	roomName, deviceName := getSonosRoomName(address)
+	return Speaker{
+		UUID:    uuid,
+		Name:    deviceName,
+		Address: address,
+		Room:    roomName,
+	}, nil
+}
+
+// openSpeaker connects to a registered speaker, reusing its cached
+// description. When the cached address does not answer, the speaker has
+// probably moved to a new DHCP address, so a background rediscovery is
+// requested.
+func openSpeaker(speaker Speaker, services int) (SpeakerController, error) {
+	rediscover := func(err error) {
+		speakerDiscoverer.Trigger(fmt.Sprintf("%s did not answer at %s", speaker.Name, speaker.Address))
+	}
+	s, err := speakerConnections.Connect(speaker, services, rediscover)
+	if err != nil {
+		rediscover(err)
+	}
+	return s, err
 }
 
 func extractIPFromLocation(location ssdp.Location) string {
@@ -1011,13 +1068,13 @@ func extractIPFromLocation(location ssdp.Location) string {
 	if locationStr == "" {
 		return ""
 	}
-	
+
 	parsed, err := url.Parse(locationStr)
 	if err != nil {
 		log.Printf("Error parsing location URL: %v", err)
 		return ""
 	}
-	
+
 	// Extract just the host part (without port)
 	host := parsed.Hostname()
 	return host
@@ -1028,18 +1085,18 @@ func discoverHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	
+
 	log.Println("Discovering Sonos devices...")
-	
-	speakers, err := discoverSonosDevices()
+
+	speakers, _, err := speakerDiscoverer.Sweep()
 	if err != nil {
 		log.Printf("Discovery error: %v", err)
 		http.Error(w, "Discovery failed", http.StatusInternalServerError)
 		return
 	}
-	
+
 	log.Printf("Discovery completed, found %d speakers", len(speakers))
-	
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(speakers)
 }
@@ -1049,452 +1106,173 @@ func speakersHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	
+
 	log.Println("Getting cached speakers...")
-	
-	// Convert speakerCache map to slice for JSON response
-	var speakers []Speaker
-	for _, speaker := range speakerCache {
-		speakers = append(speakers, speaker)
-	}
-	
+
+	speakers := speakerRegistry.List()
+
 	log.Printf("Returning %d cached speakers", len(speakers))
-	
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(speakers)
 }
 
-func playPauseHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	
-	// Parse JSON request body to get optional speaker name
-	var req struct {
-		Speaker string `json:"speaker"`
-	}
-	
-	if r.Body != nil {
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			// Body might be empty or invalid JSON, that's okay
-			log.Printf("Could not parse JSON body: %v", err)
-		}
-	}
-	
-	if req.Speaker == "" {
-		req.Speaker = defaultSpeaker
-	}
-	
-	log.Printf("Play/Pause toggle requested for speaker: %s", req.Speaker)
-	
-	// Find the speaker in our cache
-	speaker, exists := speakerCache[req.Speaker]
-	if !exists {
-		http.Error(w, fmt.Sprintf("Speaker '%s' not found", req.Speaker), http.StatusNotFound)
-		return
-	}
-	
-	// Connect to Sonos device
-	locationURL := fmt.Sprintf("http://%s:1400/xml/device_description.xml", speaker.Address)
-	
-	svcMap, err := upnp.Describe(ssdp.Location(locationURL))
-	if err != nil {
-		log.Printf("Failed to describe Sonos device: %v", err)
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Create Sonos connection with AV Transport service
-	s := sonos.MakeSonos(svcMap, nil, sonos.SVC_AV_TRANSPORT)
-	if s == nil {
-		log.Printf("Failed to create Sonos connection")
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
+// playPauseCommand pauses the speaker if it is playing and plays it otherwise
+func playPauseCommand(c *commandContext) error {
 	// Get current transport info to determine play state
-	transportInfo, err := s.GetTransportInfo(0)
+	transportInfo, err := c.s.GetTransportInfo()
 	if err != nil {
-		log.Printf("Failed to get transport info: %v", err)
-		http.Error(w, "Failed to get playback state", http.StatusInternalServerError)
-		return
+		return commandFailed("Failed to get playback state", err)
 	}
-	
+
 	// Toggle play/pause based on current state
-	if transportInfo.CurrentTransportState == "PLAYING" {
-		err = s.Pause(0)
-		if err != nil {
-			log.Printf("Failed to pause playback: %v", err)
-			http.Error(w, "Failed to pause playback", http.StatusInternalServerError)
-			return
+	if transportInfo.CurrentTransportState == upnp.State_PLAYING {
+		presetProgress.Capture(c.speaker, c.s)
+		if err := c.s.Pause(); err != nil {
+			return commandFailed("Failed to pause playback", err)
 		}
-		log.Printf("Successfully paused playback on %s", speaker.Name)
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(fmt.Sprintf("Paused %s\n", speaker.Name)))
-	} else {
-		err = s.Play(0, "1")
-		if err != nil {
-			log.Printf("Failed to start playback: %v", err)
-			http.Error(w, "Failed to start playback", http.StatusInternalServerError)
-			return
-		}
-		log.Printf("Successfully started playback on %s", speaker.Name)
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(fmt.Sprintf("Playing on %s\n", speaker.Name)))
+		log.Printf("Successfully paused playback on %s", c.speaker.Name)
+		c.state.TransportState = upnp.State_PAUSED_PLAYBACK
+		return c.reply("Paused %s", c.speaker.Name)
 	}
-}
 
-func nextTrackHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	if err := c.s.Play(); err != nil {
+		return commandFailed("Failed to start playback", err)
 	}
-	
-	// Parse JSON request body to get optional speaker name
-	var req struct {
-		Speaker string `json:"speaker"`
-	}
-	
-	if r.Body != nil {
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			// Body might be empty or invalid JSON, that's okay
-			log.Printf("Could not parse JSON body: %v", err)
-		}
-	}
-	
-	if req.Speaker == "" {
-		req.Speaker = defaultSpeaker
-	}
-	
-	log.Printf("Next track requested for speaker: %s", req.Speaker)
-	
-	// Find the speaker in our cache
-	speaker, exists := speakerCache[req.Speaker]
-	if !exists {
-		http.Error(w, fmt.Sprintf("Speaker '%s' not found", req.Speaker), http.StatusNotFound)
-		return
-	}
-	
-	// Connect to Sonos device
-	locationURL := fmt.Sprintf("http://%s:1400/xml/device_description.xml", speaker.Address)
-	
-	svcMap, err := upnp.Describe(ssdp.Location(locationURL))
-	if err != nil {
-		log.Printf("Failed to describe Sonos device: %v", err)
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Create Sonos connection with AV Transport service
-	s := sonos.MakeSonos(svcMap, nil, sonos.SVC_AV_TRANSPORT)
-	if s == nil {
-		log.Printf("Failed to create Sonos connection")
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Move to next track
-	err = s.Next(0)
-	if err != nil {
-		log.Printf("Failed to skip to next track: %v", err)
-		http.Error(w, "Failed to skip to next track", http.StatusInternalServerError)
-		return
-	}
-	
-	log.Printf("Successfully skipped to next track on %s", speaker.Name)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("Next track on %s\n", speaker.Name)))
+	log.Printf("Successfully started playback on %s", c.speaker.Name)
+	c.state.TransportState = upnp.State_PLAYING
+	return c.reply("Playing on %s", c.speaker.Name)
 }
 
-func previousTrackHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	
-	// Parse JSON request body to get optional speaker name
-	var req struct {
-		Speaker string `json:"speaker"`
-	}
-	
-	if r.Body != nil {
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			// Body might be empty or invalid JSON, that's okay
-			log.Printf("Could not parse JSON body: %v", err)
-		}
+// nextTrackCommand skips to the next track in the queue, or the next
+// chapter of a story
+func nextTrackCommand(c *commandContext) error {
+	if ok, err := nextChapter(c); ok {
+		return err
 	}
-	
-	if req.Speaker == "" {
-		req.Speaker = defaultSpeaker
-	}
-	
-	log.Printf("Previous track requested for speaker: %s", req.Speaker)
-	
-	// Find the speaker in our cache
-	speaker, exists := speakerCache[req.Speaker]
-	if !exists {
-		http.Error(w, fmt.Sprintf("Speaker '%s' not found", req.Speaker), http.StatusNotFound)
-		return
+	if err := c.s.Next(); err != nil {
+		return commandFailed("Failed to skip to next track", err)
 	}
-	
-	// Connect to Sonos device
-	locationURL := fmt.Sprintf("http://%s:1400/xml/device_description.xml", speaker.Address)
-	
-	svcMap, err := upnp.Describe(ssdp.Location(locationURL))
-	if err != nil {
-		log.Printf("Failed to describe Sonos device: %v", err)
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Create Sonos connection with AV Transport service
-	s := sonos.MakeSonos(svcMap, nil, sonos.SVC_AV_TRANSPORT)
-	if s == nil {
-		log.Printf("Failed to create Sonos connection")
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Move to previous track
-	err = s.Previous(0)
-	if err != nil {
-		log.Printf("Failed to skip to previous track: %v", err)
-		http.Error(w, "Failed to skip to previous track", http.StatusInternalServerError)
-		return
-	}
-	
-	log.Printf("Successfully skipped to previous track on %s", speaker.Name)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("Previous track on %s\n", speaker.Name)))
+
+	log.Printf("Successfully skipped to next track on %s", c.speaker.Name)
+	return c.reply("Next track on %s", c.speaker.Name)
 }
 
-func volumeUpHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// previousTrackCommand skips to the previous track in the queue, or the
+// previous chapter of a story
+func previousTrackCommand(c *commandContext) error {
+	if ok, err := previousChapter(c); ok {
+		return err
 	}
-	
-	// Parse JSON request body to get optional speaker name
-	var req struct {
-		Speaker string `json:"speaker"`
-	}
-	
-	if r.Body != nil {
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			// Body might be empty or invalid JSON, that's okay
-			log.Printf("Could not parse JSON body: %v", err)
-		}
-	}
-	
-	if req.Speaker == "" {
-		req.Speaker = defaultSpeaker
-	}
-	
-	log.Printf("Volume up requested for speaker: %s", req.Speaker)
-	
-	// Find the speaker in our cache
-	speaker, exists := speakerCache[req.Speaker]
-	if !exists {
-		http.Error(w, fmt.Sprintf("Speaker '%s' not found", req.Speaker), http.StatusNotFound)
-		return
+	if err := c.s.Previous(); err != nil {
+		return commandFailed("Failed to skip to previous track", err)
 	}
-	
-	// Connect to Sonos device
-	locationURL := fmt.Sprintf("http://%s:1400/xml/device_description.xml", speaker.Address)
-	
-	svcMap, err := upnp.Describe(ssdp.Location(locationURL))
-	if err != nil {
-		log.Printf("Failed to describe Sonos device: %v", err)
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Create Sonos connection with Rendering Control service
-	s := sonos.MakeSonos(svcMap, nil, sonos.SVC_RENDERING_CONTROL)
-	if s == nil {
-		log.Printf("Failed to create Sonos connection")
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Get current volume
-	currentVolume, err := s.GetVolume(0, "Master")
+
+	log.Printf("Successfully skipped to previous track on %s", c.speaker.Name)
+	return c.reply("Previous track on %s", c.speaker.Name)
+}
+
+// volumeUpCommand raises the volume by 5, up to 100
+func volumeUpCommand(c *commandContext) error {
+	currentVolume, err := c.s.GetVolume()
 	if err != nil {
-		log.Printf("Failed to get current volume: %v", err)
-		http.Error(w, "Failed to get volume", http.StatusInternalServerError)
-		return
+		return commandFailed("Failed to get volume", err)
 	}
-	
+
 	// Increase volume by 5%, max 100
 	newVolume := currentVolume + 5
 	if newVolume > 100 {
 		newVolume = 100
 	}
-	
-	// Set new volume
-	err = s.SetVolume(0, "Master", newVolume)
-	if err != nil {
-		log.Printf("Failed to set volume: %v", err)
-		http.Error(w, "Failed to set volume", http.StatusInternalServerError)
-		return
+
+	if err := c.s.SetVolume(newVolume); err != nil {
+		return commandFailed("Failed to set volume", err)
 	}
-	
-	log.Printf("Successfully increased volume on %s from %d to %d", speaker.Name, currentVolume, newVolume)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("Volume increased to %d on %s\n", newVolume, speaker.Name)))
+
+	log.Printf("Successfully increased volume on %s from %d to %d", c.speaker.Name, currentVolume, newVolume)
+	c.state.Volume = &newVolume
+	return c.reply("Volume increased to %d on %s", newVolume, c.speaker.Name)
 }
 
-func volumeDownHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	
-	// Parse JSON request body to get optional speaker name
-	var req struct {
-		Speaker string `json:"speaker"`
-	}
-	
-	if r.Body != nil {
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			// Body might be empty or invalid JSON, that's okay
-			log.Printf("Could not parse JSON body: %v", err)
-		}
-	}
-	
-	if req.Speaker == "" {
-		req.Speaker = defaultSpeaker
-	}
-	
-	log.Printf("Volume down requested for speaker: %s", req.Speaker)
-	
-	// Find the speaker in our cache
-	speaker, exists := speakerCache[req.Speaker]
-	if !exists {
-		http.Error(w, fmt.Sprintf("Speaker '%s' not found", req.Speaker), http.StatusNotFound)
-		return
-	}
-	
-	// Connect to Sonos device
-	locationURL := fmt.Sprintf("http://%s:1400/xml/device_description.xml", speaker.Address)
-	
-	svcMap, err := upnp.Describe(ssdp.Location(locationURL))
-	if err != nil {
-		log.Printf("Failed to describe Sonos device: %v", err)
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Create Sonos connection with Rendering Control service
-	s := sonos.MakeSonos(svcMap, nil, sonos.SVC_RENDERING_CONTROL)
-	if s == nil {
-		log.Printf("Failed to create Sonos connection")
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Get current volume
-	currentVolume, err := s.GetVolume(0, "Master")
+// volumeDownCommand lowers the volume by 5, down to 0
+func volumeDownCommand(c *commandContext) error {
+	currentVolume, err := c.s.GetVolume()
 	if err != nil {
-		log.Printf("Failed to get current volume: %v", err)
-		http.Error(w, "Failed to get volume", http.StatusInternalServerError)
-		return
+		return commandFailed("Failed to get volume", err)
 	}
-	
-	// Decrease volume by 5%, min 0
-	newVolume := currentVolume - 5
-	if newVolume < 0 {
-		newVolume = 0
+
+	// Decrease volume by 5%, min 0 (volume is unsigned, so check before
+	// subtracting to avoid wrapping around to 65535)
+	var newVolume uint16
+	if currentVolume > 5 {
+		newVolume = currentVolume - 5
 	}
-	
-	// Set new volume
-	err = s.SetVolume(0, "Master", newVolume)
-	if err != nil {
-		log.Printf("Failed to set volume: %v", err)
-		http.Error(w, "Failed to set volume", http.StatusInternalServerError)
-		return
+
+	if err := c.s.SetVolume(newVolume); err != nil {
+		return commandFailed("Failed to set volume", err)
 	}
-	
-	log.Printf("Successfully decreased volume on %s from %d to %d", speaker.Name, currentVolume, newVolume)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("Volume decreased to %d on %s\n", newVolume, speaker.Name)))
+
+	log.Printf("Successfully decreased volume on %s from %d to %d", c.speaker.Name, currentVolume, newVolume)
+	c.state.Volume = &newVolume
+	return c.reply("Volume decreased to %d on %s", newVolume, c.speaker.Name)
 }
 
-func muteHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-	
-	// Parse JSON request body to get optional speaker name
-	var req struct {
-		Speaker string `json:"speaker"`
-	}
-	
-	if r.Body != nil {
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			// Body might be empty or invalid JSON, that's okay
-			log.Printf("Could not parse JSON body: %v", err)
-		}
-	}
-	
-	if req.Speaker == "" {
-		req.Speaker = defaultSpeaker
-	}
-	
-	log.Printf("Mute toggle requested for speaker: %s", req.Speaker)
-	
-	// Find the speaker in our cache
-	speaker, exists := speakerCache[req.Speaker]
-	if !exists {
-		http.Error(w, fmt.Sprintf("Speaker '%s' not found", req.Speaker), http.StatusNotFound)
-		return
-	}
-	
-	// Connect to Sonos device
-	locationURL := fmt.Sprintf("http://%s:1400/xml/device_description.xml", speaker.Address)
-	
-	svcMap, err := upnp.Describe(ssdp.Location(locationURL))
+// muteCommand toggles mute
+func muteCommand(c *commandContext) error {
+	currentMute, err := c.s.GetMute()
 	if err != nil {
-		log.Printf("Failed to describe Sonos device: %v", err)
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
-	}
-	
-	// Create Sonos connection with Rendering Control service
-	s := sonos.MakeSonos(svcMap, nil, sonos.SVC_RENDERING_CONTROL)
-	if s == nil {
-		log.Printf("Failed to create Sonos connection")
-		http.Error(w, "Failed to connect to speaker", http.StatusInternalServerError)
-		return
+		return commandFailed("Failed to get mute state", err)
 	}
-	
-	// Get current mute state
-	currentMute, err := s.GetMute(0, "Master")
-	if err != nil {
-		log.Printf("Failed to get current mute state: %v", err)
-		http.Error(w, "Failed to get mute state", http.StatusInternalServerError)
-		return
-	}
-	
+
 	// Toggle mute state
 	newMute := !currentMute
-	err = s.SetMute(0, "Master", newMute)
-	if err != nil {
-		log.Printf("Failed to set mute state: %v", err)
-		http.Error(w, "Failed to set mute state", http.StatusInternalServerError)
-		return
+	if err := c.s.SetMute(newMute); err != nil {
+		return commandFailed("Failed to set mute state", err)
 	}
-	
+
 	muteStatus := "unmuted"
 	if newMute {
 		muteStatus = "muted"
 	}
-	
-	log.Printf("Successfully %s %s", muteStatus, speaker.Name)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("Speaker %s %s\n", speaker.Name, muteStatus)))
+
+	log.Printf("Successfully %s %s", muteStatus, c.speaker.Name)
+	c.state.Mute = &newMute
+	return c.reply("Speaker %s %s", c.speaker.Name, muteStatus)
+}
+
+// defaultSpeakerCachePath returns the speaker cache location under the
+// user's cache directory, or "" if there is none
+func defaultSpeakerCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sonoserve", "speakers.json")
+}
+
+// loadSpeakerCache populates the registry from the cache file at path and
+// saves the registry back to it whenever discovery changes it. When any
+// speakers are loaded the registry is marked ready immediately; discovery
+// reconciles their addresses in the background.
+func loadSpeakerCache(path string) {
+	log.Printf("Speaker cache: %s", path)
+
+	n, err := speakerRegistry.Load(path)
+	if err != nil {
+		log.Printf("Failed to load speaker cache: %v", err)
+	} else if n > 0 {
+		log.Printf("Loaded %d speakers from cache, health endpoint ready", n)
+		for _, speaker := range speakerRegistry.List() {
+			log.Printf("  - %s at %s (last seen %s)", speaker.Name, speaker.Address, speaker.LastSeen.Format(time.RFC3339))
+		}
+		speakerRegistry.SetReady()
+	}
+
+	speakerDiscoverer.OnChange(func(changes []SpeakerChange) {
+		if err := speakerRegistry.Save(path); err != nil {
+			log.Printf("Failed to save speaker cache: %v", err)
+		}
+	})
 }
 
 func printVersion() {
@@ -1507,16 +1285,29 @@ func printVersion() {
 func main() {
 	// Determine default resource host (IP address for external devices to reach us)
 	defaultResourceHost := getLocalIP() + ":8080"
-	
+
 	var (
-		showVersion    = flag.Bool("version", false, "show version information")
-		listFiles      = flag.String("list-files", "", "list embedded files for a preset (e.g., -list-files=5)")
-		addr           = flag.String("addr", ":8080", "server listen address (interface:port)")
-		resourceHostPtr = flag.String("resource-host", defaultResourceHost, "host:port for external devices to fetch resources from this server")
-		defaultSpeakerPtr = flag.String("default-speaker", "Kids Room", "default speaker name to use when not specified")
+		showVersion        = flag.Bool("version", false, "show version information")
+		listFiles          = flag.String("list-files", "", "list the files of a preset (e.g., -list-files=5)")
+		listPresets        = flag.Bool("list-presets", false, "list every preset with its name, track count, duration and validity")
+		addr               = flag.String("addr", ":8080", "server listen address (interface:port)")
+		resourceHostPtr    = flag.String("resource-host", defaultResourceHost, "host:port for external devices to fetch resources from this server")
+		defaultSpeakerPtr  = flag.String("default-speaker", "Kids Room", "default speaker name to use when not specified")
+		discoveryInterval  = flag.Duration("discovery-interval", 5*time.Minute, "interval between background Sonos discovery sweeps (0 to disable)")
+		speakerCache       = flag.String("speaker-cache", defaultSpeakerCachePath(), "JSON file persisting discovered speakers across restarts (empty to disable)")
+		staticSpeakers     = flag.String("speakers", "", "comma-separated speaker addresses to probe on every discovery sweep, for networks that block SSDP multicast")
+		speakersFile       = flag.String("speakers-file", "", "JSON config file listing speaker addresses and subnets to sweep")
+		events             = flag.Bool("events", true, "subscribe to speaker events to stream live state at /api/sonos/events (speakers must reach -resource-host)")
+		musicDir           = flag.String("music-dir", "", "directory to serve music and presets from, in front of the embedded music")
+		musicWatchInterval = flag.Duration("music-watch-interval", 10*time.Second, "interval between scans of -music-dir for changed files (0 to disable)")
+		progressFile       = flag.String("progress-file", defaultProgressPath(), "JSON file remembering where each preset was left off on each speaker (empty to keep it in memory)")
+		progressInterval   = flag.Duration("progress-interval", 30*time.Second, "interval between saves of the position of speakers playing a preset (0 to save only on pause and preset changes)")
+		schedulesFile      = flag.String("schedules-file", defaultSchedulesPath(), "JSON file of scheduled actions, also saving those added at /api/schedules (empty to keep them in memory)")
+		timezone           = flag.String("timezone", "", "IANA time zone schedules run in, e.g. America/Los_Angeles (default the schedules file's, or local time)")
+		sweepSubnetsPtr    = flag.String("sweep-subnets", "", "comma-separated CIDR subnets, or \"auto\" for the local subnets, to sweep for port 1400 when SSDP finds no speakers")
 	)
 	flag.Parse()
-	
+
 	// Set global variables
 	resourceHost = *resourceHostPtr
 	defaultSpeaker = *defaultSpeakerPtr
@@ -1526,8 +1317,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *musicDir != "" {
+		if err := musicLibrary.UseDir(*musicDir); err != nil {
+			log.Fatalf("Error opening music directory: %v", err)
+		}
+	}
+
 	if *listFiles != "" {
-		files, err := getEmbeddedFiles(*listFiles)
+		files, err := getPresetFiles(musicLibrary.FS(), *listFiles)
 		if err != nil {
 			log.Fatalf("Error listing files for preset %s: %v", *listFiles, err)
 		}
@@ -1539,6 +1336,19 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *listPresets {
+		presets, err := presetStatuses(musicLibrary)
+		if err != nil {
+			log.Fatalf("Error listing presets: %v", err)
+		}
+		jsonOutput, err := json.Marshal(presets)
+		if err != nil {
+			log.Fatalf("Error encoding presets to JSON: %v", err)
+		}
+		fmt.Println(string(jsonOutput))
+		os.Exit(0)
+	}
+
 	log.Printf("Starting sonoserve %s", version)
 	if gitCommit != "unknown" {
 		log.Printf("Git commit: %s", gitCommit)
@@ -1546,10 +1356,48 @@ func main() {
 	log.Printf("Listen address: %s", *addr)
 	log.Printf("Resource host: %s", resourceHost)
 
-	// Perform initial Sonos discovery on startup
+	// Speakers declared by address and subnets to sweep make discovery work
+	// on networks that drop SSDP multicast
+	staticSpeakerAddresses = splitList(*staticSpeakers)
+	subnetSpecs := splitList(*sweepSubnetsPtr)
+	if *speakersFile != "" {
+		addresses, subnets, err := loadSpeakerConfig(*speakersFile)
+		if err != nil {
+			log.Fatalf("Error loading speakers file: %v", err)
+		}
+		staticSpeakerAddresses = append(staticSpeakerAddresses, addresses...)
+		subnetSpecs = append(subnetSpecs, subnets...)
+	}
+	subnets, err := parseSubnets(subnetSpecs)
+	if err != nil {
+		log.Fatalf("Error parsing sweep subnets: %v", err)
+	}
+	sweepSubnets = subnets
+	if len(staticSpeakerAddresses) > 0 {
+		log.Printf("Static speakers: %v", staticSpeakerAddresses)
+	}
+	if len(sweepSubnets) > 0 {
+		log.Printf("Fallback sweep subnets: %v", sweepSubnets)
+	}
+
+	// Load last-known speakers so the server is usable before discovery
+	// finishes, and keep the cache file up to date as discovery finds changes
+	if *speakerCache != "" {
+		loadSpeakerCache(*speakerCache)
+	}
+
+	// Drop cached connections to speakers that discovery finds have moved or
+	// gone away
+	speakerDiscoverer.OnChange(speakerConnections.InvalidateChanges)
+
+	ctx, stopDiscovery := context.WithCancel(context.Background())
+	defer stopDiscovery()
+
+	// Perform initial Sonos discovery on startup, then keep the registry up
+	// to date in the background
 	log.Println("Performing initial Sonos discovery...")
 	go func() {
-		speakers, err := discoverSonosDevices()
+		speakers, _, err := speakerDiscoverer.Sweep()
 		if err != nil {
 			log.Printf("Startup discovery failed: %v", err)
 		} else {
@@ -1559,16 +1407,72 @@ func main() {
 			}
 		}
 		// Mark initial discovery as complete
-		initialDiscoveryComplete = true
+		speakerRegistry.SetReady()
 		log.Println("Initial discovery complete, health endpoint now ready")
+
+		speakerDiscoverer.Run(ctx, *discoveryInterval)
 	}()
 
+	// Remember where presets were left off across restarts, and keep
+	// recording it while they play
+	if *progressFile != "" {
+		log.Printf("Preset progress: %s", *progressFile)
+		if n, err := presetProgress.Load(*progressFile); err != nil {
+			log.Printf("Failed to load preset progress: %v", err)
+		} else if n > 0 {
+			log.Printf("Loaded %d saved preset positions", n)
+		}
+	}
+	go presetProgress.Run(ctx, *progressInterval)
+
+	// Run scheduled actions through the same routes as HTTP requests
+	if *schedulesFile != "" {
+		log.Printf("Schedules: %s", *schedulesFile)
+		n, err := schedules.Load(*schedulesFile)
+		if err != nil {
+			log.Fatalf("Error loading schedules: %v", err)
+		}
+		log.Printf("Loaded %d schedules", n)
+	}
+	if *timezone != "" {
+		if err := schedules.SetTimezone(*timezone); err != nil {
+			log.Fatalf("Error setting schedule time zone: %v", err)
+		}
+	}
+	schedules.SetHandler(setupRoutes())
+	go schedules.Run(ctx)
+
+	// Report presets with nothing to play, now and whenever the music
+	// directory changes
+	validatePresets(musicLibrary)
+	musicLibrary.OnChange(func() { validatePresets(musicLibrary) })
+
+	// Drop cached thumbnails when the music changes
+	musicLibrary.OnChange(albumArt.Clear)
+
+	// Pick up songs added to the music directory without a restart
+	go musicLibrary.Watch(ctx, *musicWatchInterval)
+
+	// Follow speaker state through UPnP event subscriptions, resubscribing
+	// as discovery finds speakers come, go and move
+	eventsDone := make(chan struct{})
+	if *events {
+		speakerDiscoverer.OnChange(speakerEvents.HandleChanges)
+		go func() {
+			defer close(eventsDone)
+			speakerEvents.Run(ctx, time.Minute)
+		}()
+	} else {
+		close(eventsDone)
+	}
+
 	mux := setupRoutes()
 
 	srv := &http.Server{
 		Addr:    *addr,
 		Handler: corsMiddleware(mux),
 	}
+	srv.RegisterOnShutdown(speakerEvents.Close)
 
 	go func() {
 		log.Printf("Server listening on %s", srv.Addr)
@@ -1581,13 +1485,20 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("Shutting down server...")
+	stopDiscovery()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
+	// Give event subscriptions a chance to be cancelled on the speakers
+	select {
+	case <-eventsDone:
+	case <-shutdownCtx.Done():
+	}
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
 	log.Println("Server exited")
-}
\ No newline at end of file
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -64,8 +67,8 @@ func TestPresetHandlerGET(t *testing.T) {
 	}
 
 	// expectedFiles represents the mp3 files in the embedded filesystem for preset 5,
-	// sorted alpha-numerically. This should match what getEmbeddedFiles returns.
-	expectedFiles, err := getEmbeddedFiles("5")
+	// sorted alpha-numerically. This should match what getPresetFiles returns.
+	expectedFiles, err := getPresetFiles(musicLibrary.FS(), "5")
 	if err != nil {
 		t.Fatalf("failed to get embedded files: %v", err)
 	}
@@ -123,8 +126,8 @@ func TestAllPresetDirectories(t *testing.T) {
 	// Test each discovered preset directory
 	for _, presetNum := range presetDirs {
 		t.Run(fmt.Sprintf("preset_%s", presetNum), func(t *testing.T) {
-			// Get files from the directory using getEmbeddedFiles
-			expectedFiles, err := getEmbeddedFiles(presetNum)
+			// Get files from the directory using getPresetFiles
+			expectedFiles, err := getPresetFiles(musicLibrary.FS(), presetNum)
 			if err != nil {
 				t.Fatalf("failed to get embedded files for preset %s: %v", presetNum, err)
 			}
@@ -205,3 +208,431 @@ func TestAllPresetDirectories(t *testing.T) {
 		})
 	}
 }
+
+// useFakeSpeaker starts a fake Sonos device and registers it in the speaker
+// registry as the default speaker for the duration of the test.
+func useFakeSpeaker(t *testing.T) *fakeSonos {
+	t.Helper()
+	fake := newFakeSonos(t, "Kids Room")
+	speakerRegistry.Put(fake.Speaker())
+
+	oldDefault, oldResourceHost := defaultSpeaker, resourceHost
+	defaultSpeaker = "Kids Room"
+	resourceHost = "192.168.4.88:8080"
+	t.Cleanup(func() {
+		queueFillers.Wait()
+		speakerRegistry.Remove(fake.UUID())
+		defaultSpeaker, resourceHost = oldDefault, oldResourceHost
+	})
+	return fake
+}
+
+// serve sends a request through the full route table
+func serve(t *testing.T, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	corsMiddleware(setupRoutes()).ServeHTTP(rr, req)
+	// Let tracks queued in the background land before the caller looks
+	queueFillers.Wait()
+	return rr
+}
+
+// serveJSON sends a request like serve, asking for a JSON response, and
+// decodes the command response
+func serveJSON(t *testing.T, method, path, body string) (*httptest.ResponseRecorder, commandResponse) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	corsMiddleware(setupRoutes()).ServeHTTP(rr, req)
+	queueFillers.Wait()
+	var response commandResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s %s: invalid JSON response %q: %v", method, path, rr.Body.String(), err)
+	}
+	return rr, response
+}
+
+// embeddedMP3Count returns the number of MP3 files anywhere in musicFS
+func embeddedMP3Count(t *testing.T) int {
+	t.Helper()
+	count := 0
+	err := fs.WalkDir(musicFS, "music", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(strings.ToLower(path), ".mp3") {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestPlayHandler(t *testing.T) {
+	fake := useFakeSpeaker(t)
+
+	rr := serve(t, "POST", "/sonos/play", `{}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	queue := fake.Queue()
+	if want := embeddedMP3Count(t); len(queue) != want {
+		t.Errorf("expected %d queued tracks, got %d", want, len(queue))
+	}
+	for i, track := range queue {
+		if !strings.HasPrefix(track.URI, "http://192.168.4.88:8080/music/") {
+			t.Errorf("track %d has unexpected URI %s", i, track.URI)
+		}
+	}
+	if uri := fake.TransportURI(); !strings.HasPrefix(uri, "x-rincon-queue:") {
+		t.Errorf("expected transport URI to be the queue, got %q", uri)
+	}
+	if state, track, _, _ := fake.State(); state != "PLAYING" || track != 1 {
+		t.Errorf("expected PLAYING track 1, got %s track %d", state, track)
+	}
+}
+
+func TestPresetHandlerPOST(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	expectedFiles, err := getPresetFiles(musicLibrary.FS(), "5")
+	if err != nil {
+		t.Fatalf("failed to get embedded files: %v", err)
+	}
+
+	rr := serve(t, "POST", "/sonos/preset/5", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	queue := fake.Queue()
+	if len(queue) != len(expectedFiles) {
+		t.Fatalf("expected %d queued tracks, got %d", len(expectedFiles), len(queue))
+	}
+	for i, file := range expectedFiles {
+		if !strings.HasSuffix(queue[i].URI, "/music/presets/5/"+url.PathEscape(file)) {
+			t.Errorf("track %d: expected %s, got %s", i, file, queue[i].URI)
+		}
+	}
+	if state, _, _, _ := fake.State(); state != "PLAYING" {
+		t.Errorf("expected PLAYING, got %s", state)
+	}
+}
+
+func TestQueueHandler(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	if rr := serve(t, "POST", "/sonos/preset/5", ""); rr.Code != http.StatusOK {
+		t.Fatalf("failed to play preset: %d", rr.Code)
+	}
+
+	rr := serve(t, "POST", "/sonos/queue", `{"speaker":"Kids Room"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var response struct {
+		Speaker     string `json:"speaker"`
+		QueueLength int    `json:"queue_length"`
+		QueueItems  []struct {
+			Title string `json:"title"`
+			URI   string `json:"uri"`
+		} `json:"queue_items"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+
+	queue := fake.Queue()
+	if response.QueueLength != len(queue) {
+		t.Errorf("expected queue_length %d, got %d", len(queue), response.QueueLength)
+	}
+	for i, item := range response.QueueItems {
+		if item.URI != queue[i].URI {
+			t.Errorf("item %d: expected URI %s, got %s", i, queue[i].URI, item.URI)
+		}
+		if item.Title == "" {
+			t.Errorf("item %d missing title", i)
+		}
+	}
+}
+
+func TestTransportHandlers(t *testing.T) {
+	tests := []struct {
+		path      string
+		state     string
+		track     int
+		wantState string
+		wantTrack int
+	}{
+		{"/sonos/pause", "PLAYING", 2, "PAUSED_PLAYBACK", 2},
+		{"/sonos/play-pause", "PLAYING", 2, "PAUSED_PLAYBACK", 2},
+		{"/sonos/play-pause", "PAUSED_PLAYBACK", 2, "PLAYING", 2},
+		{"/sonos/play-pause", "STOPPED", 2, "PLAYING", 2},
+		{"/sonos/resume", "PAUSED_PLAYBACK", 2, "PLAYING", 2},
+		{"/sonos/restart-playlist", "PAUSED_PLAYBACK", 2, "PLAYING", 1},
+		{"/sonos/next", "PLAYING", 1, "PLAYING", 2},
+		{"/sonos/previous", "PLAYING", 2, "PLAYING", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s_from_%s", strings.TrimPrefix(tt.path, "/sonos/"), tt.state), func(t *testing.T) {
+			fake := useFakeSpeaker(t)
+			if rr := serve(t, "POST", "/sonos/preset/5", ""); rr.Code != http.StatusOK {
+				t.Fatalf("failed to play preset: %d", rr.Code)
+			}
+			if len(fake.Queue()) < 2 {
+				t.Skip("preset 5 needs at least two tracks")
+			}
+			fake.SetState(tt.state, tt.track, 20, false)
+
+			rr := serve(t, "POST", tt.path, `{}`)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+			}
+			if state, track, _, _ := fake.State(); state != tt.wantState || track != tt.wantTrack {
+				t.Errorf("expected %s track %d, got %s track %d", tt.wantState, tt.wantTrack, state, track)
+			}
+		})
+	}
+}
+
+func TestVolumeHandlers(t *testing.T) {
+	tests := []struct {
+		path       string
+		volume     uint16
+		wantVolume uint16
+	}{
+		{"/sonos/volume-up", 20, 25},
+		{"/sonos/volume-up", 98, 100},
+		{"/sonos/volume-down", 20, 15},
+		{"/sonos/volume-down", 3, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s_from_%d", strings.TrimPrefix(tt.path, "/sonos/"), tt.volume), func(t *testing.T) {
+			fake := useFakeSpeaker(t)
+			fake.SetState("PLAYING", 1, tt.volume, false)
+
+			rr := serve(t, "POST", tt.path, "")
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+			}
+			if _, _, volume, _ := fake.State(); volume != tt.wantVolume {
+				t.Errorf("expected volume %d, got %d", tt.wantVolume, volume)
+			}
+		})
+	}
+}
+
+func TestMuteHandler(t *testing.T) {
+	fake := useFakeSpeaker(t)
+
+	for _, want := range []bool{true, false} {
+		rr := serve(t, "POST", "/sonos/mute", `{"speaker":"Kids Room"}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if _, _, _, mute := fake.State(); mute != want {
+			t.Errorf("expected mute %v, got %v", want, mute)
+		}
+	}
+}
+
+// controlEndpoints are the POST endpoints that act on a single speaker
+var controlEndpoints = []string{
+	"/sonos/play",
+	"/sonos/pause",
+	"/sonos/resume",
+	"/sonos/restart-playlist",
+	"/sonos/queue",
+	"/sonos/preset/5",
+	"/sonos/play-pause",
+	"/sonos/next",
+	"/sonos/previous",
+	"/sonos/volume-up",
+	"/sonos/volume-down",
+	"/sonos/mute",
+}
+
+func TestControlEndpointsUnknownSpeaker(t *testing.T) {
+	useFakeSpeaker(t)
+
+	for _, path := range controlEndpoints {
+		t.Run(strings.TrimPrefix(path, "/sonos/"), func(t *testing.T) {
+			rr := serve(t, "POST", path, `{"speaker":"Garage"}`)
+			if rr.Code != http.StatusNotFound {
+				t.Errorf("expected status 404, got %d: %s", rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestControlEndpointsUnreachableSpeaker(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	fake.server.Close()
+
+	for _, path := range controlEndpoints {
+		t.Run(strings.TrimPrefix(path, "/sonos/"), func(t *testing.T) {
+			rr := serve(t, "POST", path, `{}`)
+			if rr.Code != http.StatusInternalServerError {
+				t.Errorf("expected status 500, got %d: %s", rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestControlEndpointsSOAPFault(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	fake.Fail("Pause", 1)
+
+	rr := serve(t, "POST", "/sonos/pause", "")
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestControlEndpointsRequestBody(t *testing.T) {
+	useFakeSpeaker(t)
+
+	// Every endpoint treats an empty body as the default speaker and rejects
+	// malformed JSON
+	for _, path := range controlEndpoints {
+		t.Run(strings.TrimPrefix(path, "/sonos/"), func(t *testing.T) {
+			if rr := serve(t, "POST", path, ""); rr.Code != http.StatusOK {
+				t.Errorf("expected status 200 for empty body, got %d: %s", rr.Code, rr.Body.String())
+			}
+			if rr := serve(t, "POST", path, `{"speaker":`); rr.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400 for malformed JSON, got %d: %s", rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestControlEndpointsJSONEnvelope(t *testing.T) {
+	useFakeSpeaker(t)
+
+	for _, path := range controlEndpoints {
+		t.Run(strings.TrimPrefix(path, "/sonos/"), func(t *testing.T) {
+			req := httptest.NewRequest("POST", path, strings.NewReader(`{}`))
+			req.Header.Set("Accept", "application/json")
+			rr := httptest.NewRecorder()
+			corsMiddleware(setupRoutes()).ServeHTTP(rr, req)
+
+			var resp commandResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("expected JSON envelope, got %q: %v", rr.Body.String(), err)
+			}
+			if rr.Code != http.StatusOK || !resp.OK || resp.Speaker != "Kids Room" || resp.Action == "" || resp.Message == "" {
+				t.Errorf("unexpected response %d %+v", rr.Code, resp)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("POST", "/sonos/volume-up", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	corsMiddleware(setupRoutes()).ServeHTTP(rr, req)
+	var resp commandResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.State == nil || resp.State.Volume == nil {
+		t.Fatalf("expected volume in state, got %+v", resp)
+	}
+}
+
+func TestProbeSpeaker(t *testing.T) {
+	fake := newFakeSonos(t, "Kids Room")
+
+	speaker, err := probeSpeaker(fake.Address())
+	if err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	if speaker.UUID != fake.UUID() || speaker.Name != "Kids Room" || speaker.Address != fake.Address() {
+		t.Errorf("unexpected speaker: %+v", speaker)
+	}
+
+	fake.server.Close()
+	if _, err := probeSpeaker(fake.Address()); err == nil {
+		t.Error("expected probe of stopped speaker to fail")
+	}
+}
+
+func TestPruneSpeakers(t *testing.T) {
+	alive := newFakeSonos(t, "Kitchen")
+	gone := newFakeSonos(t, "Garage")
+	speakerRegistry.Put(alive.Speaker())
+	speakerRegistry.Put(gone.Speaker())
+	t.Cleanup(func() {
+		speakerRegistry.Remove(alive.UUID())
+		speakerRegistry.Remove(gone.UUID())
+	})
+	gone.server.Close()
+
+	pruneSpeakers(nil)
+
+	if _, ok := speakerRegistry.Get(alive.UUID()); !ok {
+		t.Error("expected answering speaker to be kept")
+	}
+	if _, ok := speakerRegistry.Get(gone.UUID()); ok {
+		t.Error("expected silent speaker to be removed")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	oldRegistry := speakerRegistry
+	speakerRegistry = NewSpeakerRegistry()
+	t.Cleanup(func() { speakerRegistry = oldRegistry })
+
+	if rr := serve(t, "GET", "/health", ""); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 before discovery, got %d", rr.Code)
+	}
+	speakerRegistry.SetReady()
+	if rr := serve(t, "GET", "/health", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected status 200 after discovery, got %d", rr.Code)
+	}
+}
+
+func TestLoadSpeakerCache(t *testing.T) {
+	fake := newFakeSonos(t, "Kids Room")
+	path := filepath.Join(t.TempDir(), "speakers.json")
+
+	cached := NewSpeakerRegistry()
+	cached.Put(fake.Speaker())
+	if err := cached.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	oldRegistry, oldDiscoverer := speakerRegistry, speakerDiscoverer
+	speakerRegistry = NewSpeakerRegistry()
+	kitchen := Speaker{UUID: "RINCON_KITCHEN", Name: "Kitchen", Address: "192.168.4.130"}
+	speakerDiscoverer = NewDiscoverer(speakerRegistry, func() ([]SpeakerInfo, error) {
+		speakerRegistry.Put(kitchen)
+		return []SpeakerInfo{{Name: kitchen.Name, IP: kitchen.Address}}, nil
+	})
+	t.Cleanup(func() { speakerRegistry, speakerDiscoverer = oldRegistry, oldDiscoverer })
+
+	loadSpeakerCache(path)
+
+	// The cached speaker is usable before any discovery has run
+	if !speakerRegistry.Ready() {
+		t.Error("expected registry to be ready after loading cached speakers")
+	}
+	if speaker, ok := speakerRegistry.Lookup("Kids Room"); !ok || speaker.Address != fake.Address() {
+		t.Errorf("expected cached Kids Room at %s, got %+v", fake.Address(), speaker)
+	}
+
+	// Discovery changes are written back to the cache file
+	if _, _, err := speakerDiscoverer.Sweep(); err != nil {
+		t.Fatal(err)
+	}
+	saved := NewSpeakerRegistry()
+	if n, err := saved.Load(path); err != nil || n != 2 {
+		t.Errorf("expected 2 speakers in saved cache, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ianr0bkny/go-sonos"
+	"github.com/ianr0bkny/go-sonos/upnp"
+)
+
+// Sonos play modes go-sonos has no constants for
+const (
+	playModeRepeatOne        = "REPEAT_ONE"
+	playModeShuffleRepeatOne = "SHUFFLE_REPEAT_ONE"
+)
+
+// playModes maps the play mode names used by the API and preset manifests
+// to Sonos play modes, in the order /sonos/play-mode cycles through them
+var playModes = []struct {
+	name  string
+	sonos string
+}{
+	{"normal", upnp.PlayMode_NORMAL},
+	{"shuffle", upnp.PlayMode_SHUFFLE_NOREPEAT},
+	{"repeat-all", upnp.PlayMode_REPEAT_ALL},
+	{"repeat-one", playModeRepeatOne},
+	{"shuffle-repeat", upnp.PlayMode_SHUFFLE},
+}
+
+// parsePlayMode returns the Sonos play mode for a play mode name such as
+// "repeat-all". Sonos names such as REPEAT_ALL are accepted too.
+func parsePlayMode(name string) (string, error) {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), "_", "-"))
+	for _, mode := range playModes {
+		if normalized == mode.name || normalized == strings.ToLower(strings.ReplaceAll(mode.sonos, "_", "-")) {
+			return mode.sonos, nil
+		}
+	}
+	if normalized == "shuffle-repeat-one" {
+		return playModeShuffleRepeatOne, nil
+	}
+	return "", fmt.Errorf("unknown play mode %q, expected normal, shuffle, repeat-all, repeat-one or shuffle-repeat", name)
+}
+
+// playModeName returns the API name of a Sonos play mode
+func playModeName(sonosMode string) string {
+	for _, mode := range playModes {
+		if mode.sonos == sonosMode {
+			return mode.name
+		}
+	}
+	if sonosMode == playModeShuffleRepeatOne {
+		return "shuffle-repeat-one"
+	}
+	return strings.ToLower(sonosMode)
+}
+
+// nextPlayMode returns the play mode after sonosMode in the cycle of
+// playModes, starting over at normal
+func nextPlayMode(sonosMode string) string {
+	for i, mode := range playModes {
+		if mode.sonos == sonosMode {
+			return playModes[(i+1)%len(playModes)].sonos
+		}
+	}
+	return playModes[0].sonos
+}
+
+// playModeHandler reports the play mode of a speaker on GET and sets or
+// toggles it on POST
+func playModeHandler(w http.ResponseWriter, r *http.Request) {
+	cmd := speakerCommand{
+		name:     "Play mode",
+		action:   "play-mode",
+		services: sonos.SVC_AV_TRANSPORT,
+	}
+	switch r.Method {
+	case http.MethodGet:
+		cmd.run = getPlayModeCommand
+	case http.MethodPost:
+		cmd.run = setPlayModeCommand
+	default:
+		writeError(w, r, cmd.action, "", commandRejected(http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	runCommand(w, r, cmd)
+}
+
+// playModeRequest is the body accepted by /sonos/play-mode
+type playModeRequest struct {
+	Mode string `json:"mode"`
+}
+
+// getPlayModeCommand reports the speaker's play mode
+func getPlayModeCommand(c *commandContext) error {
+	settings, err := c.s.GetTransportSettings()
+	if err != nil {
+		return commandFailed("Failed to get play mode", err)
+	}
+	c.state.PlayMode = playModeName(settings.PlayMode)
+	return c.reply("Play mode on %s is %s", c.speaker.Name, c.state.PlayMode)
+}
+
+// setPlayModeCommand sets the play mode given in the request body, or moves
+// to the next play mode in the cycle when the body names none, so a single
+// button can step through them
+func setPlayModeCommand(c *commandContext) error {
+	var req playModeRequest
+	if err := c.decode(&req); err != nil {
+		return commandRejected(http.StatusBadRequest, codeInvalidRequest, "Invalid JSON request")
+	}
+
+	var mode string
+	if req.Mode != "" {
+		var err error
+		if mode, err = parsePlayMode(req.Mode); err != nil {
+			return commandRejected(http.StatusBadRequest, codeInvalidRequest, err.Error())
+		}
+	} else {
+		settings, err := c.s.GetTransportSettings()
+		if err != nil {
+			return commandFailed("Failed to get play mode", err)
+		}
+		mode = nextPlayMode(settings.PlayMode)
+	}
+
+	if story, ok := currentStory(c); ok {
+		if err := rejectStoryPlayMode(story.preset, mode); err != nil {
+			return err
+		}
+	}
+
+	if err := c.s.SetPlayMode(mode); err != nil {
+		return commandFailed("Failed to set play mode", err)
+	}
+	log.Printf("Set play mode on %s to %s", c.speaker.Name, mode)
+	c.state.PlayMode = playModeName(mode)
+	return c.reply("Play mode on %s set to %s", c.speaker.Name, c.state.PlayMode)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParsePlayMode(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"normal", "NORMAL"},
+		{"shuffle", "SHUFFLE_NOREPEAT"},
+		{"repeat-all", "REPEAT_ALL"},
+		{"repeat-one", "REPEAT_ONE"},
+		{"shuffle-repeat", "SHUFFLE"},
+		{" Repeat_All ", "REPEAT_ALL"},
+		{"SHUFFLE_NOREPEAT", "SHUFFLE_NOREPEAT"},
+		{"shuffle-repeat-one", "SHUFFLE_REPEAT_ONE"},
+		{"loop", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := parsePlayMode(tt.name)
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("%q: expected %q, got %q, %v", tt.name, tt.want, got, err)
+		}
+		if err == nil && playModeName(got) != playModeName(tt.want) {
+			t.Errorf("%q: name %q does not round trip", tt.name, playModeName(got))
+		}
+	}
+}
+
+func TestPlayModeEndpoint(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 2)
+	useMusicDir(t, dir)
+
+	// Sonos only takes a play mode while playing from the queue
+	if rr := serve(t, "POST", "/sonos/preset/7", ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr, response := serveJSON(t, "GET", "/sonos/play-mode", "")
+	if rr.Code != http.StatusOK || response.State == nil || response.State.PlayMode != "normal" {
+		t.Fatalf("expected play mode normal, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr, response = serveJSON(t, "POST", "/sonos/play-mode", `{"mode": "repeat-one"}`)
+	if rr.Code != http.StatusOK || response.State == nil || response.State.PlayMode != "repeat-one" {
+		t.Fatalf("expected play mode repeat-one, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if mode := fake.PlayMode(); mode != "REPEAT_ONE" {
+		t.Errorf("expected REPEAT_ONE on the speaker, got %s", mode)
+	}
+
+	// Without a mode each POST steps to the next one, wrapping around
+	for _, want := range []string{"SHUFFLE", "NORMAL", "SHUFFLE_NOREPEAT"} {
+		if rr := serve(t, "POST", "/sonos/play-mode", ""); rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if mode := fake.PlayMode(); mode != want {
+			t.Errorf("expected %s after toggling, got %s", want, mode)
+		}
+	}
+
+	rr, response = serveJSON(t, "POST", "/sonos/play-mode", `{"mode": "loop"}`)
+	if rr.Code != http.StatusBadRequest || response.Error != codeInvalidRequest {
+		t.Errorf("expected 400 invalid_request, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(t, "DELETE", "/sonos/play-mode", ""); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", rr.Code)
+	}
+}
+
+func TestPresetPlayMode(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 2)
+	writeMusicFile(t, dir, "presets/7/preset.json", `{"play_mode": "repeat-all", "shuffle": true}`)
+	useMusicDir(t, dir)
+
+	if rr := serve(t, "POST", "/sonos/preset/7", ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if mode := fake.PlayMode(); mode != "REPEAT_ALL" {
+		t.Errorf("expected the manifest's REPEAT_ALL, got %s", mode)
+	}
+
+	// The request body overrides the manifest
+	rr, response := serveJSON(t, "POST", "/sonos/preset/7", `{"play_mode": "shuffle-repeat"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if mode := fake.PlayMode(); mode != "SHUFFLE" {
+		t.Errorf("expected SHUFFLE from the request, got %s", mode)
+	}
+	if response.State == nil || response.State.PlayMode != "shuffle-repeat" {
+		t.Errorf("expected play mode shuffle-repeat in the state, got %s", rr.Body.String())
+	}
+
+	queued := len(fake.Queue())
+	rr, response = serveJSON(t, "POST", "/sonos/preset/7", `{"play_mode": "backwards"}`)
+	if rr.Code != http.StatusBadRequest || response.Error != codeInvalidRequest {
+		t.Errorf("expected 400 invalid_request, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(fake.Queue()) != queued {
+		t.Errorf("expected the queue left alone after an invalid play mode")
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/ianr0bkny/go-sonos/upnp"
+)
+
+// presetManifestName is the optional file in a preset directory describing
+// the preset
+const presetManifestName = "preset.json"
+
+// PresetManifest is the preset.json file of a preset directory. Every field
+// is optional; without a manifest a preset plays its files in name order at
+// the speaker's current volume and play mode.
+type PresetManifest struct {
+	// Name is the display name, e.g. "Bedtime Songs"
+	Name string `json:"name,omitempty"`
+	// Tracks lists files in play order with optional titles. Files not
+	// listed play after the listed ones, in name order.
+	Tracks []PresetTrack `json:"tracks,omitempty"`
+	// Volume is set before playback starts, 0-100
+	Volume *uint16 `json:"volume,omitempty"`
+	// PlayMode selects the speaker's play mode: normal, shuffle,
+	// repeat-all, repeat-one or shuffle-repeat
+	PlayMode string `json:"play_mode,omitempty"`
+	// Shuffle and Repeat select the play mode when PlayMode is not set
+	Shuffle bool `json:"shuffle,omitempty"`
+	Repeat  bool `json:"repeat,omitempty"`
+	// Speaker plays the preset when the request does not name a speaker
+	Speaker string `json:"speaker,omitempty"`
+	// Resume picks the preset up where it was left off on the speaker
+	// unless the request says otherwise
+	Resume bool `json:"resume,omitempty"`
+	// Type is "story" for audiobooks, which always play in order, resume
+	// by default and skip by chapter; music is the default
+	Type string `json:"type,omitempty"`
+	// Chapters marks chapters within the files of a story
+	Chapters []PresetChapter `json:"chapters,omitempty"`
+}
+
+// PresetTrack is one entry of a manifest's track order
+type PresetTrack struct {
+	File  string `json:"file"`
+	Title string `json:"title,omitempty"`
+}
+
+// Preset is a preset directory resolved into its playlist
+type Preset struct {
+	Number string
+	Name   string
+	Items  []ListItem
+	// AlbumArtURI is the preset's folder image, or else the cover of its
+	// first track with cover art
+	AlbumArtURI string
+	Manifest    *PresetManifest
+}
+
+// playMode returns the Sonos play mode selected by the manifest's play_mode,
+// or else its shuffle and repeat settings, or "" to leave the speaker's play
+// mode alone when the manifest sets none of them
+func (m *PresetManifest) playMode() string {
+	if m == nil {
+		return ""
+	}
+	if m.isStory() {
+		return upnp.PlayMode_NORMAL
+	}
+	if m.PlayMode != "" {
+		// Validated by loadPresetManifest
+		mode, _ := parsePlayMode(m.PlayMode)
+		return mode
+	}
+	switch {
+	case m.Shuffle && m.Repeat:
+		return upnp.PlayMode_SHUFFLE
+	case m.Shuffle:
+		return upnp.PlayMode_SHUFFLE_NOREPEAT
+	case m.Repeat:
+		return upnp.PlayMode_REPEAT_ALL
+	default:
+		return ""
+	}
+}
+
+// resume reports whether the manifest resumes the preset by default, as
+// stories always do
+func (m *PresetManifest) resume() bool {
+	return m != nil && (m.Resume || m.isStory())
+}
+
+// volume returns the volume the manifest sets, or nil when there is no
+// manifest or it does not set a volume
+func (m *PresetManifest) volume() *uint16 {
+	if m == nil {
+		return nil
+	}
+	return m.Volume
+}
+
+// loadPresetManifest reads the manifest of a preset in fsys. It returns nil
+// without an error if the preset has no manifest.
+func loadPresetManifest(fsys fs.FS, presetNum string) (*PresetManifest, error) {
+	data, err := fs.ReadFile(fsys, fmt.Sprintf("presets/%s/%s", presetNum, presetManifestName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest PresetManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Volume != nil && *manifest.Volume > 100 {
+		return nil, fmt.Errorf("volume %d is not between 0 and 100", *manifest.Volume)
+	}
+	if manifest.PlayMode != "" {
+		if _, err := parsePlayMode(manifest.PlayMode); err != nil {
+			return nil, err
+		}
+	}
+	if err := validatePresetType(&manifest); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(manifest.Tracks))
+	for i, track := range manifest.Tracks {
+		if track.File == "" {
+			return nil, fmt.Errorf("track %d has no file", i+1)
+		}
+		if seen[track.File] {
+			return nil, fmt.Errorf("track %s is listed more than once", track.File)
+		}
+		seen[track.File] = true
+	}
+	return &manifest, nil
+}
+
+// loadPreset reads the files and manifest of a preset in library and builds
+// its playlist, with URLs using scheme. Errors are commandErrors ready to be
+// written to the client.
+func loadPreset(library *Library, presetNum string, scheme string) (*Preset, error) {
+	fsys := library.FS()
+	files, err := getPresetFiles(fsys, presetNum)
+	if err != nil {
+		return nil, commandRejected(http.StatusNotFound, codeNotFound, err.Error())
+	}
+	manifest, err := loadPresetManifest(fsys, presetNum)
+	if err != nil {
+		return nil, &commandError{
+			status:  http.StatusInternalServerError,
+			code:    codeInvalidPreset,
+			message: fmt.Sprintf("Preset %s has an invalid %s", presetNum, presetManifestName),
+			err:     err,
+		}
+	}
+
+	preset := &Preset{
+		Number:   presetNum,
+		Name:     fmt.Sprintf("Preset %s", presetNum),
+		Items:    presetPlaylistItems(library, presetNum, scheme, files, manifest),
+		Manifest: manifest,
+	}
+	if manifest != nil && manifest.Name != "" {
+		preset.Name = manifest.Name
+	}
+	preset.AlbumArtURI = library.artURL(fmt.Sprintf("%s://%s", scheme, resourceHost), fmt.Sprintf("presets/%s", presetNum))
+	for _, item := range preset.Items {
+		if preset.AlbumArtURI != "" {
+			break
+		}
+		preset.AlbumArtURI = item.AlbumArtURI
+	}
+	return preset, nil
+}
+
+// presetPlaylistItems builds the playlist of a preset from its files in name
+// order, applying the track order and titles of the manifest if there is one
+func presetPlaylistItems(library *Library, presetNum string, scheme string, files []string, manifest *PresetManifest) []ListItem {
+	titles := make(map[string]string)
+	ordered := files
+	if manifest != nil && len(manifest.Tracks) > 0 {
+		present := make(map[string]bool, len(files))
+		for _, file := range files {
+			present[file] = true
+		}
+		ordered = make([]string, 0, len(files))
+		listed := make(map[string]bool, len(manifest.Tracks))
+		for _, track := range manifest.Tracks {
+			if !present[track.File] {
+				log.Printf("Warning: preset %s lists missing track %s", presetNum, track.File)
+				continue
+			}
+			ordered = append(ordered, track.File)
+			listed[track.File] = true
+			titles[track.File] = track.Title
+		}
+		for _, file := range files {
+			if !listed[file] {
+				ordered = append(ordered, file)
+			}
+		}
+	}
+
+	baseURL := fmt.Sprintf("%s://%s", scheme, resourceHost)
+	items := make([]ListItem, 0, len(ordered))
+	for i, file := range ordered {
+		items = append(items, library.trackItem(i, fmt.Sprintf("presets/%s/%s", presetNum, file), baseURL, titles[file]))
+	}
+	return items
+}
+
+// PresetStatus describes a preset directory for clients building a preset
+// menu: its name, length and whether it has anything to play and, if not,
+// why
+type PresetStatus struct {
+	Number          string `json:"number"`
+	Name            string `json:"name"`
+	Valid           bool   `json:"valid"`
+	TrackCount      int    `json:"track_count"`
+	DurationSeconds int    `json:"duration_seconds"`
+	Duration        string `json:"duration"`
+	// DurationPartial is set when some tracks have no known duration, such
+	// as formats whose tags are not read, so Duration leaves them out
+	DurationPartial bool   `json:"duration_partial,omitempty"`
+	Problem         string `json:"problem,omitempty"`
+}
+
+// presetNumbers returns the names of the preset directories in fsys, sorted
+func presetNumbers(fsys fs.FS) ([]string, error) {
+	entries, err := fs.ReadDir(fsys, "presets")
+	if err != nil {
+		return nil, err
+	}
+	var numbers []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			numbers = append(numbers, entry.Name())
+		}
+	}
+	sort.Strings(numbers)
+	return numbers, nil
+}
+
+// checkPreset describes a preset in library and reports whether it can be
+// played: it must exist, have a valid manifest if it has one, and hold at
+// least one playable file. The duration is the sum of the durations in the
+// tracks' tags, marked partial when any track has none.
+func checkPreset(library *Library, presetNum string) PresetStatus {
+	fsys := library.FS()
+	status := PresetStatus{Number: presetNum, Name: fmt.Sprintf("Preset %s", presetNum), Duration: formatTrackTime(0)}
+	files, err := getPresetFiles(fsys, presetNum)
+	if err != nil {
+		status.Problem = "not found"
+		return status
+	}
+	status.TrackCount = len(files)
+
+	var duration time.Duration
+	for _, file := range files {
+		tags, err := library.Tags(fmt.Sprintf("presets/%s/%s", presetNum, file))
+		if err != nil {
+			log.Printf("Warning: failed to read tags of %s in preset %s: %v", file, presetNum, err)
+		}
+		if tags.Duration <= 0 {
+			status.DurationPartial = true
+			continue
+		}
+		duration += tags.Duration
+	}
+	status.DurationSeconds = int(duration.Round(time.Second) / time.Second)
+	status.Duration = formatTrackTime(status.DurationSeconds)
+
+	manifest, err := loadPresetManifest(fsys, presetNum)
+	if err != nil {
+		status.Problem = fmt.Sprintf("invalid %s: %v", presetManifestName, err)
+		return status
+	}
+	if manifest != nil && manifest.Name != "" {
+		status.Name = manifest.Name
+	}
+	if len(files) == 0 {
+		status.Problem = "no playable tracks"
+		return status
+	}
+	status.Valid = true
+	return status
+}
+
+// presetStatuses describes every preset in library
+func presetStatuses(library *Library) ([]PresetStatus, error) {
+	numbers, err := presetNumbers(library.FS())
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]PresetStatus, 0, len(numbers))
+	for _, number := range numbers {
+		statuses = append(statuses, checkPreset(library, number))
+	}
+	return statuses, nil
+}
+
+// validatePresets checks every preset in library, logging a warning for each
+// one that cannot be played
+func validatePresets(library *Library) {
+	statuses, err := presetStatuses(library)
+	if err != nil {
+		log.Printf("Warning: no presets directory in the music library: %v", err)
+		return
+	}
+	valid := 0
+	for _, status := range statuses {
+		if status.Valid {
+			valid++
+		} else {
+			log.Printf("Warning: preset %s cannot be played: %s", status.Number, status.Problem)
+		}
+	}
+	log.Printf("Found %d presets, %d playable", len(statuses), valid)
+}
+
+// presetsHandler lists every preset directory with its name, length and
+// health
+func presetsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "presets", "", commandRejected(http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	presets, err := presetStatuses(musicLibrary)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		writeError(w, r, "presets", "", commandFailed("Failed to read presets", err))
+		return
+	}
+	if presets == nil {
+		presets = []PresetStatus{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Presets []PresetStatus `json:"presets"`
+	}{presets})
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadPresetManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		wantErr  bool
+	}{
+		{"valid", `{"name": "Bedtime", "volume": 20, "tracks": [{"file": "a.mp3", "title": "A"}]}`, false},
+		{"invalid json", `{"name": `, true},
+		{"volume too high", `{"volume": 101}`, true},
+		{"track without file", `{"tracks": [{"title": "A"}]}`, true},
+		{"duplicate track", `{"tracks": [{"file": "a.mp3"}, {"file": "a.mp3"}]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{
+				"presets/3/a.mp3":       {},
+				"presets/3/preset.json": {Data: []byte(tt.manifest)},
+			}
+			manifest, err := loadPresetManifest(fsys, "3")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %+v", manifest)
+				}
+				return
+			}
+			if err != nil || manifest == nil {
+				t.Fatalf("expected manifest, got %v", err)
+			}
+		})
+	}
+
+	manifest, err := loadPresetManifest(fstest.MapFS{"presets/3/a.mp3": {}}, "3")
+	if manifest != nil || err != nil {
+		t.Errorf("expected no manifest and no error, got %+v, %v", manifest, err)
+	}
+}
+
+func TestPresetManifestPlayMode(t *testing.T) {
+	tests := []struct {
+		manifest *PresetManifest
+		want     string
+	}{
+		{nil, ""},
+		// A manifest that only names the preset leaves the play mode alone
+		{&PresetManifest{Name: "Bedtime"}, ""},
+		{&PresetManifest{Shuffle: true}, "SHUFFLE_NOREPEAT"},
+		{&PresetManifest{Repeat: true}, "REPEAT_ALL"},
+		{&PresetManifest{Shuffle: true, Repeat: true}, "SHUFFLE"},
+		{&PresetManifest{PlayMode: "repeat-one"}, "REPEAT_ONE"},
+		// play_mode wins over shuffle and repeat
+		{&PresetManifest{PlayMode: "normal", Shuffle: true}, "NORMAL"},
+	}
+	for _, tt := range tests {
+		if got := tt.manifest.playMode(); got != tt.want {
+			t.Errorf("%+v: expected %q, got %q", tt.manifest, tt.want, got)
+		}
+	}
+}
+
+func TestLoadPresetManifestOrder(t *testing.T) {
+	fsys := fstest.MapFS{
+		"presets/3/01 Alpha.mp3": {},
+		"presets/3/02 Beta.mp3":  {},
+		"presets/3/03 Gamma.mp3": {},
+		"presets/3/preset.json": {Data: []byte(`{
+			"name": "Bedtime",
+			"tracks": [
+				{"file": "03 Gamma.mp3", "title": "Gamma Ray"},
+				{"file": "99 Missing.mp3"},
+				{"file": "01 Alpha.mp3"}
+			]
+		}`)},
+	}
+	preset, err := loadPreset(NewLibrary(fsys), "3", "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preset.Name != "Bedtime" {
+		t.Errorf("expected name Bedtime, got %s", preset.Name)
+	}
+
+	var titles []string
+	for i, item := range preset.Items {
+		if item.Index != i {
+			t.Errorf("item %d has index %d", i, item.Index)
+		}
+		titles = append(titles, item.Title)
+	}
+	// Listed tracks first, missing ones skipped, the rest in name order
+	if want := []string{"Gamma Ray", "01 Alpha", "02 Beta"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("expected titles %v, got %v", want, titles)
+	}
+
+	if _, err := loadPreset(NewLibrary(fsys), "4", "http"); err == nil {
+		t.Error("expected error for missing preset")
+	}
+}
+
+func TestPresetManifestSettings(t *testing.T) {
+	kidsRoom := useFakeSpeaker(t)
+	livingRoom := newFakeSonos(t, "Living Room")
+	speakerRegistry.Put(livingRoom.Speaker())
+	t.Cleanup(func() { speakerRegistry.Remove(livingRoom.UUID()) })
+
+	dir := t.TempDir()
+	writeMusicFile(t, dir, "presets/7/01 First.mp3", "first")
+	writeMusicFile(t, dir, "presets/7/02 Second.mp3", "second")
+	writeMusicFile(t, dir, "presets/7/preset.json", `{
+		"name": "Road Trip",
+		"tracks": [{"file": "02 Second.mp3", "title": "Second Song"}],
+		"volume": 35,
+		"shuffle": true,
+		"repeat": true,
+		"speaker": "Living Room"
+	}`)
+	useMusicDir(t, dir)
+
+	rr := serve(t, "GET", "/sonos/preset/7", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		Name          string     `json:"name"`
+		Volume        *uint16    `json:"volume"`
+		Shuffle       bool       `json:"shuffle"`
+		Repeat        bool       `json:"repeat"`
+		TargetSpeaker string     `json:"target_speaker"`
+		PlaylistItems []ListItem `json:"playlist_items"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Name != "Road Trip" || response.Volume == nil || *response.Volume != 35 ||
+		!response.Shuffle || !response.Repeat || response.TargetSpeaker != "Living Room" {
+		t.Errorf("unexpected preset settings %+v", response)
+	}
+	if len(response.PlaylistItems) != 2 || response.PlaylistItems[0].Title != "Second Song" {
+		t.Errorf("expected manifest order and titles, got %+v", response.PlaylistItems)
+	}
+
+	// The manifest's speaker is used when the request names none
+	rr = serve(t, "POST", "/sonos/preset/7", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got, want := rr.Body.String(), "Playing preset 7 (Road Trip) on Living Room\n"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if len(kidsRoom.Queue()) != 0 {
+		t.Error("expected the default speaker to be left alone")
+	}
+	queue := livingRoom.Queue()
+	if len(queue) != 2 || fakeTrackTitle(queue[0].Metadata) != "Second Song" {
+		t.Errorf("expected manifest order in queue, got %+v", queue)
+	}
+	if state, _, volume, _ := livingRoom.State(); state != "PLAYING" || volume != 35 {
+		t.Errorf("expected PLAYING at volume 35, got %s at %d", state, volume)
+	}
+	if mode := livingRoom.PlayMode(); mode != "SHUFFLE" {
+		t.Errorf("expected play mode SHUFFLE, got %s", mode)
+	}
+
+	// A speaker in the request still wins
+	rr = serve(t, "POST", "/sonos/preset/7", `{"speaker": "Kids Room"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(kidsRoom.Queue()) != 2 {
+		t.Errorf("expected preset queued on Kids Room, got %d tracks", len(kidsRoom.Queue()))
+	}
+}
+
+func TestPresetInvalidManifest(t *testing.T) {
+	dir := t.TempDir()
+	writeMusicFile(t, dir, "presets/7/01 First.mp3", "first")
+	writeMusicFile(t, dir, "presets/7/preset.json", `{"volume": 500}`)
+	useMusicDir(t, dir)
+
+	req := httptest.NewRequest("GET", "/sonos/preset/7", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	setupRoutes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response commandResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Error != codeInvalidPreset {
+		t.Errorf("expected error %s, got %+v", codeInvalidPreset, response)
+	}
+}
+
+func TestCheckPreset(t *testing.T) {
+	// 384 frames of 128 kbit/s audio last 10 seconds
+	tenSeconds := mpegFrames(384)
+	fsys := fstest.MapFS{
+		"presets/1/.gitignore":   {Data: []byte("*.mp3\n")},
+		"presets/2/01 Song.mp3":  {Data: tenSeconds},
+		"presets/2/02 Song.flac": {Data: []byte("fLaC")},
+		"presets/3/01 Song.mp3":  {},
+		"presets/3/preset.json":  {Data: []byte(`{"volume": 500}`)},
+		"presets/4/notes.txt":    {},
+		"presets/4/01 Song.wma":  {},
+		"presets/6/01 Song.mp3":  {Data: tenSeconds},
+		"presets/6/02 Song.mp3":  {Data: append(tenSeconds, tenSeconds...)},
+		"presets/6/preset.json":  {Data: []byte(`{"name": "Bedtime"}`)},
+	}
+	tests := []struct {
+		preset string
+		want   PresetStatus
+	}{
+		{"1", PresetStatus{Number: "1", Name: "Preset 1", Duration: "0:00:00", Problem: "no playable tracks"}},
+		{"2", PresetStatus{Number: "2", Name: "Preset 2", Valid: true, TrackCount: 2, DurationSeconds: 10, Duration: "0:00:10", DurationPartial: true}},
+		{"3", PresetStatus{Number: "3", Name: "Preset 3", TrackCount: 1, Duration: "0:00:00", DurationPartial: true, Problem: "invalid preset.json: volume 500 is not between 0 and 100"}},
+		{"4", PresetStatus{Number: "4", Name: "Preset 4", Duration: "0:00:00", Problem: "no playable tracks"}},
+		{"5", PresetStatus{Number: "5", Name: "Preset 5", Duration: "0:00:00", Problem: "not found"}},
+		{"6", PresetStatus{Number: "6", Name: "Bedtime", Valid: true, TrackCount: 2, DurationSeconds: 30, Duration: "0:00:30"}},
+	}
+	library := NewLibrary(fsys)
+	for _, tt := range tests {
+		if got := checkPreset(library, tt.preset); got != tt.want {
+			t.Errorf("preset %s: expected %+v, got %+v", tt.preset, tt.want, got)
+		}
+	}
+
+	numbers, err := presetNumbers(fsys)
+	if err != nil || !reflect.DeepEqual(numbers, []string{"1", "2", "3", "4", "6"}) {
+		t.Errorf("expected presets 1-4 and 6, got %v (%v)", numbers, err)
+	}
+}
+
+func TestEmptyPresetLeavesQueueAlone(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 2)
+	writeMusicFile(t, dir, "presets/8/.gitignore", "*.mp3\n")
+	useMusicDir(t, dir)
+
+	if rr := serve(t, "POST", "/sonos/preset/7", ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	queue, actions := fake.Queue(), len(fake.Actions())
+
+	rr, response := serveJSON(t, "POST", "/sonos/preset/8", "")
+	if rr.Code != http.StatusConflict || response.Error != codePresetEmpty {
+		t.Errorf("expected 409 %s, got %d: %s", codePresetEmpty, rr.Code, rr.Body.String())
+	}
+	// The envelope is sent without an Accept header too
+	rr = serve(t, "POST", "/sonos/preset/8", "")
+	response = commandResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusConflict || response.Error != codePresetEmpty {
+		t.Errorf("expected a 409 %s envelope by default, got %d: %s", codePresetEmpty, rr.Code, rr.Body.String())
+	}
+	rr, response = serveJSON(t, "POST", "/sonos/preset/9", "")
+	if rr.Code != http.StatusNotFound || response.Error != codeNotFound {
+		t.Errorf("expected 404 %s, got %d: %s", codeNotFound, rr.Code, rr.Body.String())
+	}
+
+	if got := fake.Actions(); len(got) != actions {
+		t.Errorf("expected no speaker calls for a preset without tracks, got %v", got[actions:])
+	}
+	if got := fake.Queue(); !reflect.DeepEqual(got, queue) {
+		t.Errorf("expected the queue untouched, got %+v", got)
+	}
+}
+
+func TestPresetsHandler(t *testing.T) {
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 2)
+	writeMusicFile(t, dir, "presets/8/.gitignore", "*.mp3\n")
+	useMusicDir(t, dir)
+
+	rr := serve(t, "GET", "/api/presets", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var response struct {
+		Presets []PresetStatus `json:"presets"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]PresetStatus)
+	for _, preset := range response.Presets {
+		got[preset.Number] = preset
+	}
+	for _, want := range []PresetStatus{
+		{Number: "7", Name: "Preset 7", Valid: true, TrackCount: 2, Duration: "0:00:00"},
+		{Number: "8", Name: "Preset 8", Duration: "0:00:00", Problem: "no playable tracks"},
+		// Embedded presets are listed alongside those on disk
+		{Number: "1", Name: "Preset 1", Duration: "0:00:00", Problem: "no playable tracks"},
+	} {
+		if got[want.Number] != want {
+			t.Errorf("expected %+v, got %+v", want, got[want.Number])
+		}
+	}
+
+	if rr := serve(t, "POST", "/api/presets", ""); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ianr0bkny/go-sonos"
+	"github.com/ianr0bkny/go-sonos/upnp"
+)
+
+// presetProgress remembers where each preset was left off on each speaker
+var presetProgress = newProgressStore()
+
+// PresetPosition is the place a speaker reached in a preset: the file that
+// was playing and the time within it
+type PresetPosition struct {
+	Preset  string `json:"preset"`
+	Speaker string `json:"speaker"`
+	// File is the name of the track within the preset directory
+	File string `json:"file"`
+	// Track is the track's number in the speaker's queue
+	Track     int       `json:"track"`
+	RelTime   string    `json:"rel_time"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// progressFile is the on-disk format of the progress store
+type progressFile struct {
+	Positions []PresetPosition `json:"positions"`
+}
+
+// progressStore records positions in presets per speaker. Positions are
+// captured from the speaker while one of its presets is the active one:
+// started by a preset request and not yet replaced by another.
+type progressStore struct {
+	mu        sync.Mutex
+	path      string
+	positions map[string]PresetPosition
+	active    map[string]activePreset
+}
+
+// activePreset is the preset a speaker was last asked to play
+type activePreset struct {
+	speaker Speaker
+	preset  string
+}
+
+// newProgressStore returns an empty store that is not saved to disk
+func newProgressStore() *progressStore {
+	return &progressStore{
+		positions: make(map[string]PresetPosition),
+		active:    make(map[string]activePreset),
+	}
+}
+
+// progressKey identifies the position of a preset on the speaker with the
+// given speakerKey, as saved in PresetPosition.Speaker
+func progressKey(preset, speaker string) string {
+	return preset + "@" + speaker
+}
+
+// defaultProgressPath returns the progress file location under the user's
+// config directory, or "" if there is none
+func defaultProgressPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sonoserve", "progress.json")
+}
+
+// Load reads the positions saved at path and saves every later change back
+// to it. A missing file loads nothing and is not an error.
+func (p *progressStore) Load(path string) (int, error) {
+	var file progressFile
+	err := readJSONFile(path, &file)
+	if err != nil && !isNotExist(err) {
+		return 0, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.path = path
+	for _, position := range file.Positions {
+		p.positions[progressKey(position.Preset, position.Speaker)] = position
+	}
+	return len(file.Positions), nil
+}
+
+// saveLocked writes the positions to the store's file, if it has one. The
+// caller holds p.mu.
+func (p *progressStore) saveLocked() {
+	if p.path == "" {
+		return
+	}
+	file := progressFile{Positions: make([]PresetPosition, 0, len(p.positions))}
+	for _, position := range p.positions {
+		file.Positions = append(file.Positions, position)
+	}
+	if err := writeJSONFile(p.path, file); err != nil {
+		log.Printf("Failed to save preset progress: %v", err)
+	}
+}
+
+// Started makes preset the active preset of speaker
+func (p *progressStore) Started(speaker Speaker, preset string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active[speakerKey(speaker)] = activePreset{speaker: speaker, preset: preset}
+}
+
+// Active returns the preset speaker was last asked to play, unless it has
+// been seen playing something else since
+func (p *progressStore) Active(speaker Speaker) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	active, ok := p.active[speakerKey(speaker)]
+	return active.preset, ok
+}
+
+// Position returns the saved position of preset on speaker
+func (p *progressStore) Position(preset string, speaker Speaker) (PresetPosition, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	position, ok := p.positions[progressKey(preset, speakerKey(speaker))]
+	return position, ok
+}
+
+// Capture saves the position of speaker in its active preset, read from s.
+// Nothing is saved when no preset is active or the speaker has moved on to
+// something outside the preset.
+func (p *progressStore) Capture(speaker Speaker, s SpeakerController) {
+	p.mu.Lock()
+	active, ok := p.active[speakerKey(speaker)]
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	info, err := s.GetPositionInfo()
+	if err != nil {
+		log.Printf("Warning: failed to read the position of %s in preset %s: %v", speaker.Name, active.preset, err)
+		return
+	}
+	file, ok := presetTrackFile(info.TrackURI, active.preset)
+	if !ok || info.Track == 0 {
+		// Playing something else now, so there is nothing to remember until
+		// the next preset request
+		// Only forget the preset if no other was started meanwhile,
+		// comparing the speaker by key as its other fields change with
+		// discovery
+		p.mu.Lock()
+		if current, ok := p.active[speakerKey(speaker)]; ok && current.preset == active.preset && speakerKey(current.speaker) == speakerKey(active.speaker) {
+			delete(p.active, speakerKey(speaker))
+		}
+		p.mu.Unlock()
+		return
+	}
+
+	position := PresetPosition{
+		Preset:    active.preset,
+		Speaker:   speakerKey(speaker),
+		File:      file,
+		Track:     int(info.Track),
+		RelTime:   info.RelTime,
+		UpdatedAt: time.Now(),
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if previous := p.positions[progressKey(active.preset, speakerKey(speaker))]; previous.File == position.File && previous.RelTime == position.RelTime {
+		return
+	}
+	p.positions[progressKey(active.preset, speakerKey(speaker))] = position
+	p.saveLocked()
+	log.Printf("Saved position of %s in preset %s: %s at %s", speaker.Name, active.preset, file, info.RelTime)
+}
+
+// Run captures the position of every speaker playing a preset each interval
+// until ctx is done, so a long preset is remembered even if nobody presses
+// pause
+func (p *progressStore) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.captureAll()
+		}
+	}
+}
+
+// captureAll captures the position of each speaker with an active preset
+// that is playing
+func (p *progressStore) captureAll() {
+	p.mu.Lock()
+	speakers := make([]Speaker, 0, len(p.active))
+	for _, active := range p.active {
+		speakers = append(speakers, active.speaker)
+	}
+	p.mu.Unlock()
+
+	for _, speaker := range speakers {
+		s, err := openSpeaker(speaker, sonos.SVC_AV_TRANSPORT)
+		if err != nil {
+			log.Printf("Warning: failed to connect to %s to save its preset position: %v", speaker.Name, err)
+			continue
+		}
+		info, err := s.GetTransportInfo()
+		if err != nil || info.CurrentTransportState != upnp.State_PLAYING {
+			continue
+		}
+		p.Capture(speaker, s)
+	}
+}
+
+// presetTrackFile returns the name within the directory of preset of the
+// file a track URI served from /music/ points at
+func presetTrackFile(trackURI, preset string) (string, bool) {
+	u, err := url.Parse(trackURI)
+	if err != nil {
+		return "", false
+	}
+	name, ok := strings.CutPrefix(u.Path, "/music/presets/"+preset+"/")
+	return name, ok && name != ""
+}
+
+// resumePoint is where in a playlist playback resumes: the index of an item
+// and the time within it
+type resumePoint struct {
+	index   int
+	relTime string
+}
+
+// resumePointIn returns where to resume position in items, or nil if its
+// file is no longer there. The saved file is matched rather than the track
+// number, so tracks added or reordered since do not matter.
+func resumePointIn(items []ListItem, position PresetPosition) *resumePoint {
+	for i, item := range items {
+		if item.Filename == position.File {
+			return &resumePoint{index: i, relTime: position.RelTime}
+		}
+	}
+	return nil
+}
+
+// seekResume moves playback to track, the queue number of item, and to
+// relTime within it, reporting the track in the command's state. A failed
+// seek is logged and playback starts where the queue is, since losing the
+// place is better than not playing at all.
+func seekResume(c *commandContext, item ListItem, track int, relTime string) {
+	if err := c.s.Seek("TRACK_NR", strconv.Itoa(track)); err != nil {
+		log.Printf("Warning: failed to resume %s at track %d: %v", c.speaker.Name, track, err)
+		return
+	}
+	state := &trackState{Index: track, Title: item.Title, URI: item.URL, DurationSeconds: item.DurationSeconds}
+	if item.DurationSeconds > 0 {
+		state.Duration = formatTrackTime(item.DurationSeconds)
+	}
+	if seconds := parseTrackTime(relTime); seconds > 0 {
+		if err := c.s.Seek("REL_TIME", relTime); err != nil {
+			log.Printf("Warning: failed to resume %s at %s: %v", c.speaker.Name, relTime, err)
+		} else {
+			state.Elapsed = relTime
+			state.ElapsedSeconds = seconds
+		}
+	}
+	c.state.Track = state
+}
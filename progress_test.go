@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useProgressFile replaces the preset progress store with one saved at a
+// temporary file for the duration of the test and returns the file's path
+func useProgressFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "progress.json")
+	old := presetProgress
+	presetProgress = newProgressStore()
+	if _, err := presetProgress.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { presetProgress = old })
+	return path
+}
+
+// playTrack plays preset num and moves to track at relTime
+func playTrack(t *testing.T, fake *fakeSonos, num string, track int, relTime string) {
+	t.Helper()
+	if rr := serve(t, "POST", "/sonos/preset/"+num, ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	for i := 1; i < track; i++ {
+		if rr := serve(t, "POST", "/sonos/next", ""); rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+	fake.SetPosition(relTime)
+}
+
+func TestResumePresetAfterPause(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	path := useProgressFile(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 4)
+	useMusicDir(t, dir)
+
+	playTrack(t, fake, "7", 3, "0:02:10")
+	if rr := serve(t, "POST", "/sonos/pause", ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr, response := serveJSON(t, "POST", "/sonos/preset/7", `{"resume": true}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := queueFiles(fake.Queue()); len(got) != 4 {
+		t.Errorf("expected the whole preset queued, got %v", got)
+	}
+	state, track, _, _ := fake.State()
+	if state != "PLAYING" || track != 3 || fake.Position() != "0:02:10" {
+		t.Errorf("expected track 3 playing at 0:02:10, got %s track %d at %s", state, track, fake.Position())
+	}
+	if response.State == nil || response.State.Track == nil || response.State.Track.Index != 3 || response.State.Track.Elapsed != "0:02:10" {
+		t.Errorf("expected the resumed track in the state, got %s", rr.Body.String())
+	}
+	if !strings.HasPrefix(response.Message, "Resumed preset 7 at track 3") {
+		t.Errorf("unexpected message %q", response.Message)
+	}
+
+	// The position survives a restart
+	restarted := newProgressStore()
+	if n, err := restarted.Load(path); err != nil || n != 1 {
+		t.Fatalf("expected 1 saved position, got %d, %v", n, err)
+	}
+	position, ok := restarted.Position("7", fake.Speaker())
+	if !ok || position.File != "03 Track.mp3" || position.RelTime != "0:02:10" {
+		t.Errorf("unexpected saved position %+v", position)
+	}
+
+	// Without resume the preset starts over
+	if rr := serve(t, "POST", "/sonos/preset/7", ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, track, _, _ := fake.State(); track != 1 {
+		t.Errorf("expected track 1 without resume, got %d", track)
+	}
+}
+
+func TestResumePresetAfterSwitch(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	useProgressFile(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 3)
+	writePreset(t, dir, "8", 2)
+	// Preset 7 resumes by default, but a request can start it over
+	writeMusicFile(t, dir, "presets/7/preset.json", `{"resume": true}`)
+	useMusicDir(t, dir)
+
+	playTrack(t, fake, "7", 2, "0:01:00")
+	playTrack(t, fake, "8", 1, "0:00:30")
+
+	if rr := serve(t, "POST", "/sonos/preset/7", ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, track, _, _ := fake.State(); track != 2 || fake.Position() != "0:01:00" {
+		t.Errorf("expected track 2 at 0:01:00, got track %d at %s", track, fake.Position())
+	}
+
+	if rr := serve(t, "POST", "/sonos/preset/7", `{"resume": false}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, track, _, _ := fake.State(); track != 1 {
+		t.Errorf("expected track 1 when resume is turned off, got %d", track)
+	}
+}
+
+func TestCapturePlayingPresets(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	useProgressFile(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 3)
+	useMusicDir(t, dir)
+
+	playTrack(t, fake, "7", 2, "0:00:45")
+	presetProgress.captureAll()
+	if position, ok := presetProgress.Position("7", fake.Speaker()); !ok || position.File != "02 Track.mp3" || position.RelTime != "0:00:45" {
+		t.Errorf("expected track 2 at 0:00:45 saved, got %+v", position)
+	}
+
+	// Once the speaker plays something else the preset is left alone, even
+	// after the queue plays again
+	_, _, volume, mute := fake.State()
+	fake.SetSource("x-rincon-mp3radio://radio.example.com/kids.mp3", "")
+	fake.SetState("PLAYING", 0, volume, mute)
+	presetProgress.captureAll()
+	fake.SetState("PLAYING", 3, volume, mute)
+	fake.SetPosition("0:01:00")
+	presetProgress.captureAll()
+	if position, _ := presetProgress.Position("7", fake.Speaker()); position.File != "02 Track.mp3" || position.RelTime != "0:00:45" {
+		t.Errorf("expected the saved position kept, got %+v", position)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// SpeakerRegistry is the set of known speakers, keyed by UUID. It is safe for
+// concurrent use by the discovery goroutine and the HTTP handlers.
+type SpeakerRegistry struct {
+	mu       sync.RWMutex
+	speakers map[string]Speaker
+	ready    bool
+}
+
+// NewSpeakerRegistry returns an empty registry that is not yet ready
+func NewSpeakerRegistry() *SpeakerRegistry {
+	return &SpeakerRegistry{speakers: make(map[string]Speaker)}
+}
+
+// Put adds or replaces a speaker. A zero LastSeen is set to the current time.
+func (r *SpeakerRegistry) Put(speaker Speaker) {
+	if speaker.LastSeen.IsZero() {
+		speaker.LastSeen = time.Now()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.speakers[speaker.UUID] = speaker
+}
+
+// Get returns the speaker with the given UUID
+func (r *SpeakerRegistry) Get(uuid string) (Speaker, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	speaker, ok := r.speakers[uuid]
+	return speaker, ok
+}
+
+// Lookup returns the speaker matching a UUID or, failing that, a speaker
+// name. Clients such as the CardPuter address speakers by room name.
+func (r *SpeakerRegistry) Lookup(nameOrUUID string) (Speaker, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if speaker, ok := r.speakers[nameOrUUID]; ok {
+		return speaker, true
+	}
+	for _, speaker := range r.speakers {
+		if speaker.Name == nameOrUUID {
+			return speaker, true
+		}
+	}
+	return Speaker{}, false
+}
+
+// List returns all speakers sorted by name
+func (r *SpeakerRegistry) List() []Speaker {
+	r.mu.RLock()
+	speakers := make([]Speaker, 0, len(r.speakers))
+	for _, speaker := range r.speakers {
+		speakers = append(speakers, speaker)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(speakers, func(i, j int) bool {
+		if speakers[i].Name != speakers[j].Name {
+			return speakers[i].Name < speakers[j].Name
+		}
+		return speakers[i].UUID < speakers[j].UUID
+	})
+	return speakers
+}
+
+// Remove deletes the speaker with the given UUID, reporting whether it was
+// present.
+func (r *SpeakerRegistry) Remove(uuid string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.speakers[uuid]
+	delete(r.speakers, uuid)
+	return ok
+}
+
+// Ready reports whether initial discovery has completed
+func (r *SpeakerRegistry) Ready() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ready
+}
+
+// SetReady marks initial discovery as complete
+func (r *SpeakerRegistry) SetReady() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ready = true
+}
+
+// speakerCacheFile is the on-disk format written by Save
+type speakerCacheFile struct {
+	Speakers []Speaker `json:"speakers"`
+}
+
+// Save writes all speakers to a JSON file at path
+func (r *SpeakerRegistry) Save(path string) error {
+	return writeJSONFile(path, speakerCacheFile{Speakers: r.List()})
+}
+
+// Load adds the speakers saved at path to the registry, keeping their
+// last-seen timestamps, and returns how many were loaded. A missing file
+// loads nothing and is not an error.
+func (r *SpeakerRegistry) Load(path string) (int, error) {
+	var file speakerCacheFile
+	if err := readJSONFile(path, &file); err != nil {
+		if isNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	loaded := 0
+	for _, speaker := range file.Speakers {
+		if speaker.UUID == "" || speaker.Address == "" {
+			continue
+		}
+		r.Put(speaker)
+		loaded++
+	}
+	return loaded, nil
+}
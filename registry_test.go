@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpeakerRegistry(t *testing.T) {
+	r := NewSpeakerRegistry()
+	r.Put(Speaker{UUID: "RINCON_B", Name: "Kids Room", Address: "192.168.4.129"})
+	r.Put(Speaker{UUID: "RINCON_A", Name: "Kitchen", Address: "192.168.4.130"})
+
+	speaker, ok := r.Lookup("Kids Room")
+	if !ok || speaker.UUID != "RINCON_B" {
+		t.Errorf("expected lookup by name to find RINCON_B, got %+v", speaker)
+	}
+	if speaker.LastSeen.IsZero() {
+		t.Error("expected Put to set LastSeen")
+	}
+	if speaker, ok := r.Lookup("RINCON_A"); !ok || speaker.Name != "Kitchen" {
+		t.Errorf("expected lookup by UUID to find Kitchen, got %+v", speaker)
+	}
+	if _, ok := r.Lookup("Garage"); ok {
+		t.Error("expected lookup of unknown speaker to fail")
+	}
+
+	// Re-adding the same UUID at a new address replaces the entry
+	r.Put(Speaker{UUID: "RINCON_B", Name: "Kids Room", Address: "192.168.4.200"})
+	list := r.List()
+	if len(list) != 2 {
+		t.Fatalf("expected 2 speakers, got %d", len(list))
+	}
+	if list[0].Name != "Kids Room" || list[0].Address != "192.168.4.200" || list[1].Name != "Kitchen" {
+		t.Errorf("unexpected list order or contents: %+v", list)
+	}
+
+	if !r.Remove("RINCON_B") {
+		t.Error("expected Remove to report the speaker was present")
+	}
+	if r.Remove("RINCON_B") {
+		t.Error("expected second Remove to report the speaker was absent")
+	}
+	if _, ok := r.Get("RINCON_B"); ok {
+		t.Error("expected removed speaker to be gone")
+	}
+}
+
+func TestSpeakerRegistryPreservesLastSeen(t *testing.T) {
+	r := NewSpeakerRegistry()
+	seen := time.Date(2025, 7, 6, 14, 53, 7, 0, time.UTC)
+	r.Put(Speaker{UUID: "RINCON_A", Name: "Kitchen", LastSeen: seen})
+
+	if speaker, _ := r.Get("RINCON_A"); !speaker.LastSeen.Equal(seen) {
+		t.Errorf("expected LastSeen %v, got %v", seen, speaker.LastSeen)
+	}
+}
+
+func TestSpeakerRegistryReady(t *testing.T) {
+	r := NewSpeakerRegistry()
+	if r.Ready() {
+		t.Error("expected new registry not to be ready")
+	}
+	r.SetReady()
+	if !r.Ready() {
+		t.Error("expected registry to be ready")
+	}
+}
+
+func TestSpeakerRegistryConcurrentAccess(t *testing.T) {
+	r := NewSpeakerRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.Put(Speaker{UUID: fmt.Sprintf("RINCON_%d_%d", i, j), Name: "Kids Room"})
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.Lookup("Kids Room")
+				r.List()
+				r.Ready()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(r.List()); n != 800 {
+		t.Errorf("expected 800 speakers, got %d", n)
+	}
+}
+
+func TestSpeakerRegistrySaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sonoserve", "speakers.json")
+	seen := time.Date(2025, 7, 6, 14, 53, 7, 0, time.UTC)
+
+	r := NewSpeakerRegistry()
+	r.Put(Speaker{UUID: "RINCON_A", Name: "Kids Room", Address: "192.168.4.129", Room: "Kids Room", LastSeen: seen})
+	r.Put(Speaker{UUID: "RINCON_B", Name: "Kitchen", Address: "192.168.4.130", Room: "Kitchen", LastSeen: seen})
+	if err := r.Save(path); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	loaded := NewSpeakerRegistry()
+	n, err := loaded.Load(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 speakers loaded, got %d", n)
+	}
+	got, want := loaded.List(), r.List()
+	for i := range want {
+		if !got[i].LastSeen.Equal(want[i].LastSeen) || got[i].UUID != want[i].UUID || got[i].Address != want[i].Address {
+			t.Errorf("speaker %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestSpeakerRegistryLoadMissingFile(t *testing.T) {
+	r := NewSpeakerRegistry()
+	n, err := r.Load(filepath.Join(t.TempDir(), "speakers.json"))
+	if err != nil || n != 0 {
+		t.Errorf("expected missing file to load nothing without error, got %d, %v", n, err)
+	}
+}
+
+func TestSpeakerRegistryLoadSkipsIncompleteEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "speakers.json")
+	data := `{"speakers": [{"name": "Kids Room", "address": "192.168.4.129"}, {"uuid": "RINCON_A", "name": "Kitchen", "address": "192.168.4.130"}]}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSpeakerRegistry()
+	if n, err := r.Load(path); err != nil || n != 1 {
+		t.Errorf("expected 1 speaker loaded, got %d, %v", n, err)
+	}
+}
+
+func TestSpeakerRegistryLoadCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "speakers.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewSpeakerRegistry().Load(path); err == nil {
+		t.Error("expected corrupt file to return an error")
+	}
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schedules runs the scheduled actions configured with -schedules-file and
+// /api/schedules
+var schedules = newScheduler()
+
+// Actions a schedule rule can run, each a POST to the /sonos/ endpoint in
+// scheduleActionPaths
+const (
+	scheduleActionPreset     = "preset"
+	scheduleActionPlay       = "play"
+	scheduleActionPause      = "pause"
+	scheduleActionSleepTimer = "sleep-timer"
+)
+
+// scheduleActionPaths maps each action to the endpoint it runs. Play resumes
+// what the speaker has loaded, since /sonos/play would replace its queue
+// with the whole library.
+var scheduleActionPaths = map[string]string{
+	scheduleActionPreset:     "/sonos/preset/",
+	scheduleActionPlay:       "/sonos/resume",
+	scheduleActionPause:      "/sonos/pause",
+	scheduleActionSleepTimer: "/sonos/sleep-timer",
+}
+
+// scheduleAllSpeakers as a rule's speaker runs the rule on every known
+// speaker
+const scheduleAllSpeakers = "all"
+
+// ScheduleRule runs an action at the times its cron schedule matches, e.g.
+//
+//	{"id": "alarm", "schedule": "0 7 * * 1-5", "action": "preset", "preset": "3", "volume": 15}
+type ScheduleRule struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Schedule is a cron expression: minute, hour, day of month, month and
+	// day of week (0 or 7 is Sunday)
+	Schedule string `json:"schedule"`
+	// Action is preset, play, pause or sleep-timer
+	Action string `json:"action"`
+	// Speaker is the speaker to act on, "all" for every known speaker, or
+	// empty for the default speaker
+	Speaker string `json:"speaker,omitempty"`
+	// Preset is the preset the preset action plays
+	Preset string `json:"preset,omitempty"`
+	// Volume is set when the preset action starts playing
+	Volume *uint16 `json:"volume,omitempty"`
+	// Duration is the time the sleep-timer action sets
+	Duration string `json:"duration,omitempty"`
+}
+
+// scheduleFile is the format of the -schedules-file config file
+type scheduleFile struct {
+	// Timezone is the IANA time zone rules are evaluated in, such as
+	// America/Los_Angeles; the server's local time zone when empty
+	Timezone string         `json:"timezone,omitempty"`
+	Rules    []ScheduleRule `json:"rules"`
+}
+
+// Scheduler runs schedule rules through the server's own routes, so a rule
+// does exactly what the matching HTTP request would
+type Scheduler struct {
+	mu   sync.Mutex
+	path string
+	// timezone is the time zone of the schedules file, saved back with it
+	timezone string
+	location *time.Location
+	rules    []ScheduleRule
+	crons    map[string]*cronSchedule
+	handler  http.Handler
+}
+
+// newScheduler returns a scheduler with no rules in the local time zone
+func newScheduler() *Scheduler {
+	return &Scheduler{location: time.Local, crons: make(map[string]*cronSchedule)}
+}
+
+// defaultSchedulesPath returns the schedules file location under the user's
+// config directory, or "" if there is none
+func defaultSchedulesPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sonoserve", "schedules.json")
+}
+
+// Load reads the rules and time zone saved at path and saves every later
+// change back to it. A missing file loads nothing and is not an error.
+func (s *Scheduler) Load(path string) (int, error) {
+	var file scheduleFile
+	if err := readJSONFile(path, &file); err != nil && !isNotExist(err) {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	if file.Timezone != "" {
+		if err := s.setTimezoneLocked(file.Timezone); err != nil {
+			return 0, err
+		}
+		s.timezone = file.Timezone
+	}
+	for _, rule := range file.Rules {
+		if err := s.addLocked(rule); err != nil {
+			return 0, fmt.Errorf("rule %q: %w", rule.ID, err)
+		}
+	}
+	return len(file.Rules), nil
+}
+
+// SetTimezone evaluates rules in the IANA time zone name from now on,
+// overriding the time zone of the schedules file without changing it
+func (s *Scheduler) SetTimezone(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setTimezoneLocked(name)
+}
+
+// setTimezoneLocked evaluates rules in the time zone name. The caller holds
+// s.mu.
+func (s *Scheduler) setTimezoneLocked(name string) error {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("unknown time zone %q: %w", name, err)
+	}
+	s.location = location
+	return nil
+}
+
+// SetHandler sets the routes rules are run through
+func (s *Scheduler) SetHandler(handler http.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = handler
+}
+
+// Add validates rule and adds it, choosing an ID if it has none
+func (s *Scheduler) Add(rule ScheduleRule) (ScheduleRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rule.ID == "" {
+		rule.ID = s.newIDLocked()
+	}
+	if err := s.addLocked(rule); err != nil {
+		return rule, err
+	}
+	s.saveLocked()
+	log.Printf("Added schedule %s: %s %s", rule.ID, rule.Schedule, rule.Action)
+	return rule, nil
+}
+
+// errDuplicateSchedule is returned by Add for an ID that is already taken
+var errDuplicateSchedule = errors.New("a schedule with this id already exists")
+
+// addLocked validates and adds rule. The caller holds s.mu.
+func (s *Scheduler) addLocked(rule ScheduleRule) error {
+	if _, exists := s.crons[rule.ID]; exists {
+		return errDuplicateSchedule
+	}
+	cron, err := rule.validate()
+	if err != nil {
+		return err
+	}
+	s.rules = append(s.rules, rule)
+	s.crons[rule.ID] = cron
+	return nil
+}
+
+// newIDLocked returns the first unused ID of the form schedule-N. The
+// caller holds s.mu.
+func (s *Scheduler) newIDLocked() string {
+	for n := len(s.rules) + 1; ; n++ {
+		id := "schedule-" + strconv.Itoa(n)
+		if _, exists := s.crons[id]; !exists {
+			return id
+		}
+	}
+}
+
+// Remove deletes the rule with id and reports whether there was one
+func (s *Scheduler) Remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.crons[id]; !exists {
+		return false
+	}
+	delete(s.crons, id)
+	for i, rule := range s.rules {
+		if rule.ID == id {
+			s.rules = append(s.rules[:i], s.rules[i+1:]...)
+			break
+		}
+	}
+	s.saveLocked()
+	log.Printf("Removed schedule %s", id)
+	return true
+}
+
+// saveLocked writes the rules to the scheduler's file, if it has one. The
+// caller holds s.mu.
+func (s *Scheduler) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	file := scheduleFile{Timezone: s.timezone, Rules: s.rules}
+	if file.Rules == nil {
+		file.Rules = []ScheduleRule{}
+	}
+	if err := writeJSONFile(s.path, file); err != nil {
+		log.Printf("Failed to save schedules: %v", err)
+	}
+}
+
+// ScheduleStatus is a rule as listed by /api/schedules, with the next time
+// it runs
+type ScheduleStatus struct {
+	ScheduleRule
+	NextRun *time.Time `json:"next_run,omitempty"`
+}
+
+// List returns the rules with their next run after now
+func (s *Scheduler) List(now time.Time) (timezone string, statuses []ScheduleStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses = make([]ScheduleStatus, 0, len(s.rules))
+	for _, rule := range s.rules {
+		status := ScheduleStatus{ScheduleRule: rule}
+		if next, ok := s.crons[rule.ID].next(now.In(s.location)); ok {
+			status.NextRun = &next
+		}
+		statuses = append(statuses, status)
+	}
+	return s.location.String(), statuses
+}
+
+// Run runs the rules due at the start of each minute until ctx is done
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		go s.RunDue(next)
+	}
+}
+
+// RunDue runs every rule whose schedule matches minute t in the scheduler's
+// time zone
+func (s *Scheduler) RunDue(t time.Time) {
+	s.mu.Lock()
+	t = t.In(s.location)
+	var due []ScheduleRule
+	for _, rule := range s.rules {
+		if s.crons[rule.ID].matches(t) {
+			due = append(due, rule)
+		}
+	}
+	handler := s.handler
+	s.mu.Unlock()
+
+	for _, rule := range due {
+		s.run(handler, rule)
+	}
+}
+
+// run performs rule on each of its speakers, logging the outcome
+func (s *Scheduler) run(handler http.Handler, rule ScheduleRule) {
+	if handler == nil {
+		log.Printf("Schedule %s is due but the scheduler has no routes", rule.ID)
+		return
+	}
+	speakers := []string{rule.Speaker}
+	if strings.EqualFold(rule.Speaker, scheduleAllSpeakers) {
+		speakers = nil
+		for _, speaker := range speakerRegistry.List() {
+			speakers = append(speakers, speaker.Name)
+		}
+	}
+
+	for _, speaker := range speakers {
+		log.Printf("Running schedule %s: %s on %s", rule.ID, rule.Action, scheduleTarget(speaker))
+		resp, err := perform(handler, rule, speaker)
+		if err != nil {
+			log.Printf("Schedule %s failed on %s: %v", rule.ID, scheduleTarget(speaker), err)
+			continue
+		}
+		log.Printf("Schedule %s: %s", rule.ID, resp.Message)
+	}
+}
+
+// scheduleTarget names speaker in logs, where "" is the default speaker
+func scheduleTarget(speaker string) string {
+	if speaker == "" {
+		return "the default speaker"
+	}
+	return speaker
+}
+
+// scheduledRequest is the body of the request a rule sends
+type scheduledRequest struct {
+	Speaker  string  `json:"speaker,omitempty"`
+	Volume   *uint16 `json:"volume,omitempty"`
+	Duration string  `json:"duration,omitempty"`
+}
+
+// perform sends the request for rule on speaker through handler and returns
+// the command response
+func perform(handler http.Handler, rule ScheduleRule, speaker string) (commandResponse, error) {
+	path := scheduleActionPaths[rule.Action]
+	if rule.Action == scheduleActionPreset {
+		path += rule.Preset
+	}
+	body, err := json.Marshal(scheduledRequest{Speaker: speaker, Volume: rule.Volume, Duration: rule.Duration})
+	if err != nil {
+		return commandResponse{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return commandResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	w := &scheduledResponse{header: make(http.Header), status: http.StatusOK}
+	handler.ServeHTTP(w, req)
+
+	var resp commandResponse
+	if err := json.Unmarshal(w.body.Bytes(), &resp); err != nil {
+		return resp, fmt.Errorf("status %d: %s", w.status, strings.TrimSpace(w.body.String()))
+	}
+	if w.status >= 400 {
+		return resp, fmt.Errorf("%s (%s)", resp.Message, resp.Error)
+	}
+	return resp, nil
+}
+
+// scheduledResponse collects the response to a rule's request
+type scheduledResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *scheduledResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *scheduledResponse) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *scheduledResponse) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+// validate checks rule and returns its parsed schedule
+func (rule ScheduleRule) validate() (*cronSchedule, error) {
+	if rule.ID == "" || strings.ContainsAny(rule.ID, "/?#") {
+		return nil, fmt.Errorf("invalid id %q", rule.ID)
+	}
+	cron, err := parseCron(rule.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	switch rule.Action {
+	case scheduleActionPreset:
+		if rule.Preset == "" || strings.Contains(rule.Preset, "/") {
+			return nil, fmt.Errorf("the preset action needs a preset")
+		}
+	case scheduleActionPlay, scheduleActionPause:
+	case scheduleActionSleepTimer:
+		if _, err := parseSleepDuration(rule.Duration); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q, expected %s, %s, %s or %s", rule.Action,
+			scheduleActionPreset, scheduleActionPlay, scheduleActionPause, scheduleActionSleepTimer)
+	}
+	if rule.Volume != nil && (*rule.Volume > 100 || rule.Action != scheduleActionPreset) {
+		return nil, fmt.Errorf("volume must be between 0 and 100 and is only used by the preset action")
+	}
+	return cron, nil
+}
+
+// cronSchedule is a parsed cron expression, each field a bit set of the
+// values it matches
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	// anyDay and anyWeekday are set for a * day of month or day of week.
+	// As in cron, when both are restricted a time matching either matches.
+	anyDay, anyWeekday bool
+}
+
+// parseCron parses a five field cron expression. Fields take *, values,
+// ranges such as 1-5, lists such as 1,3 and steps such as */15.
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, expected minute hour day month weekday", spec)
+	}
+	var cron cronSchedule
+	var err error
+	for i, field := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&cron.minutes, 0, 59},
+		{&cron.hours, 0, 23},
+		{&cron.days, 1, 31},
+		{&cron.months, 1, 12},
+		{&cron.weekdays, 0, 7},
+	} {
+		if *field.bits, err = parseCronField(fields[i], field.min, field.max); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+	}
+	// Sunday is both 0 and 7
+	if cron.weekdays&(1<<7) != 0 {
+		cron.weekdays = cron.weekdays&^(1<<7) | 1
+	}
+	cron.anyDay = fields[2] == "*"
+	cron.anyWeekday = fields[4] == "*"
+	return &cron, nil
+}
+
+// parseCronField returns the set of values between min and max that field
+// matches
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		values, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if values != "*" {
+			first, last, isRange := strings.Cut(values, "-")
+			var err error
+			if lo, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			switch {
+			case isRange:
+				if hi, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			case !hasStep:
+				hi = lo
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether the minute of t is in the schedule
+func (c *cronSchedule) matches(t time.Time) bool {
+	return c.minutes&(1<<t.Minute()) != 0 &&
+		c.hours&(1<<t.Hour()) != 0 &&
+		c.months&(1<<int(t.Month())) != 0 &&
+		c.matchesDay(t)
+}
+
+// matchesDay reports whether the day of t is in the schedule's days of the
+// month and week
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	day := c.days&(1<<t.Day()) != 0
+	weekday := c.weekdays&(1<<int(t.Weekday())) != 0
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// next returns the first minute after t the schedule matches, within the
+// next four years, in the location of t
+func (c *cronSchedule) next(t time.Time) (time.Time, bool) {
+	start := t.Truncate(time.Minute).Add(time.Minute)
+	for d := 0; d < 4*366; d++ {
+		day := time.Date(start.Year(), start.Month(), start.Day()+d, 0, 0, 0, 0, start.Location())
+		if c.months&(1<<int(day.Month())) == 0 || !c.matchesDay(day) {
+			continue
+		}
+		for hours := c.hours; hours != 0; hours &= hours - 1 {
+			hour := bits.TrailingZeros64(hours)
+			for minutes := c.minutes; minutes != 0; minutes &= minutes - 1 {
+				candidate := time.Date(day.Year(), day.Month(), day.Day(), hour, bits.TrailingZeros64(minutes), 0, 0, day.Location())
+				if !candidate.Before(start) && candidate.Hour() == hour {
+					return candidate, true
+				}
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// schedulesHandler lists rules on GET and creates one on POST at
+// /api/schedules, and deletes one on DELETE at /api/schedules/{id}. Every
+// reply is JSON, errors included, whatever the Accept header.
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/schedules"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		timezone, statuses := schedules.List(time.Now())
+		writeJSON(w, http.StatusOK, struct {
+			Timezone  string           `json:"timezone"`
+			Schedules []ScheduleStatus `json:"schedules"`
+		}{timezone, statuses})
+
+	case id == "" && r.Method == http.MethodPost:
+		var rule ScheduleRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			writeScheduleError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid JSON request")
+			return
+		}
+		rule, err := schedules.Add(rule)
+		if errors.Is(err, errDuplicateSchedule) {
+			writeScheduleError(w, http.StatusConflict, codeInvalidRequest, fmt.Sprintf("Schedule %s already exists", rule.ID))
+			return
+		}
+		if err != nil {
+			writeScheduleError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, rule)
+
+	case id != "" && r.Method == http.MethodDelete:
+		if !schedules.Remove(id) {
+			writeScheduleError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("Schedule %s not found", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, commandResponse{OK: true, Action: "schedules", Message: fmt.Sprintf("Schedule %s deleted", id)})
+
+	default:
+		writeScheduleError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// writeScheduleError replies to an /api/schedules request with the error
+// envelope
+func writeScheduleError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, commandResponse{Action: "schedules", Message: message, Error: code})
+}
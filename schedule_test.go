@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	// Monday 2026-03-02 07:00
+	monday := time.Date(2026, 3, 2, 7, 0, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		at   time.Time
+		want bool
+	}{
+		{"0 7 * * 1-5", monday, true},
+		{"0 7 * * 1-5", monday.AddDate(0, 0, 5), false},
+		{"0 7 * * 1-5", monday.Add(time.Minute), false},
+		{"*/15 * * * *", monday.Add(45 * time.Minute), true},
+		{"*/15 * * * *", monday.Add(50 * time.Minute), false},
+		{"30 20 * * *", time.Date(2026, 3, 7, 20, 30, 0, 0, time.UTC), true},
+		{"0 7 * * 0", monday.AddDate(0, 0, 6), true},
+		{"0 7 * * 7", monday.AddDate(0, 0, 6), true},
+		{"0 7,19 * 3 *", monday.Add(12 * time.Hour), true},
+		{"0 7 * 4 *", monday, false},
+		// A restricted day of month and day of week match either
+		{"0 7 15 * 1", monday, true},
+		{"0 7 2 * 5", monday, true},
+		{"0 7 3 * 5", monday, false},
+	}
+	for _, tt := range tests {
+		cron, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		if got := cron.matches(tt.at); got != tt.want {
+			t.Errorf("%s at %s: expected %v, got %v", tt.spec, tt.at.Format(time.RFC1123), tt.want, got)
+		}
+	}
+
+	for _, spec := range []string{"", "0 7 * *", "60 * * * *", "0 24 * * *", "0 7 0 * *", "0 7 * 13 *", "0 7 * * 8", "0 7 * * 5-1", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	friday := time.Date(2026, 3, 6, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"0 7 * * 1-5", time.Date(2026, 3, 9, 7, 0, 0, 0, time.UTC)},
+		{"45 19 * * *", time.Date(2026, 3, 6, 19, 45, 0, 0, time.UTC)},
+		{"0 8 * * *", time.Date(2026, 3, 7, 8, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		cron, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := cron.next(friday); !ok || !got.Equal(tt.want) {
+			t.Errorf("%s: expected %s, got %s", tt.spec, tt.want, got)
+		}
+	}
+}
+
+func TestScheduledActions(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "3", 2)
+	useMusicDir(t, dir)
+
+	scheduler := newScheduler()
+	if err := scheduler.SetTimezone("America/Los_Angeles"); err != nil {
+		t.Fatal(err)
+	}
+	scheduler.SetHandler(setupRoutes())
+	volume := uint16(15)
+	for _, rule := range []ScheduleRule{
+		{ID: "alarm", Schedule: "0 7 * * 1-5", Action: "preset", Preset: "3", Volume: &volume},
+		{ID: "quiet", Schedule: "30 20 * * *", Action: "pause", Speaker: "all"},
+		{ID: "morning", Schedule: "0 8 * * *", Action: "play"},
+	} {
+		if _, err := scheduler.Add(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 07:00 in Los Angeles on a Saturday, then a Monday
+	scheduler.RunDue(time.Date(2026, 3, 7, 15, 0, 0, 0, time.UTC))
+	if queue := fake.Queue(); len(queue) != 0 {
+		t.Fatalf("expected nothing on a Saturday, got %+v", queue)
+	}
+	scheduler.RunDue(time.Date(2026, 3, 9, 14, 0, 0, 0, time.UTC))
+	queueFillers.Wait()
+	state, _, gotVolume, _ := fake.State()
+	if state != "PLAYING" || gotVolume != 15 || len(fake.Queue()) != 2 {
+		t.Errorf("expected preset 3 playing at volume 15, got %s at %d with %d tracks", state, gotVolume, len(fake.Queue()))
+	}
+
+	// 20:30 pauses every speaker
+	scheduler.RunDue(time.Date(2026, 3, 10, 3, 30, 0, 0, time.UTC))
+	if state, _, _, _ := fake.State(); state != "PAUSED_PLAYBACK" {
+		t.Errorf("expected quiet hours to pause, got %s", state)
+	}
+
+	// 08:00 resumes the preset rather than queueing the whole library
+	scheduler.RunDue(time.Date(2026, 3, 10, 15, 0, 0, 0, time.UTC))
+	if state, _, _, _ := fake.State(); state != "PLAYING" || len(fake.Queue()) != 2 {
+		t.Errorf("expected preset 3 to resume, got %s with %d tracks", state, len(fake.Queue()))
+	}
+}
+
+func TestSchedulesAPI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedules.json")
+	writeMusicFile(t, filepath.Dir(path), "schedules.json", `{
+		"timezone": "America/Los_Angeles",
+		"rules": [{"id": "lullaby", "schedule": "45 19 * * *", "action": "preset", "preset": "5"}]
+	}`)
+	old := schedules
+	schedules = newScheduler()
+	t.Cleanup(func() { schedules = old })
+	if n, err := schedules.Load(path); err != nil || n != 1 {
+		t.Fatalf("expected 1 schedule loaded, got %d, %v", n, err)
+	}
+
+	rr := serve(t, "POST", "/api/schedules", `{"schedule": "0 21 * * *", "action": "sleep-timer", "duration": "30m", "speaker": "Kids Room"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var created ScheduleRule
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil || created.ID != "schedule-2" {
+		t.Errorf("expected the new schedule with an id, got %s", rr.Body.String())
+	}
+
+	for body, status := range map[string]int{
+		`{"id": "lullaby", "schedule": "0 7 * * *", "action": "play"}`: http.StatusConflict,
+		`{"schedule": "0 25 * * *", "action": "play"}`:                 http.StatusBadRequest,
+		`{"schedule": "0 7 * * *", "action": "dance"}`:                 http.StatusBadRequest,
+		`{"schedule": "0 7 * * *", "action": "preset"}`:                http.StatusBadRequest,
+		`{"schedule": "0 7 * * *", "action": "pause", "volume": 10}`:   http.StatusBadRequest,
+		`not json`: http.StatusBadRequest,
+	} {
+		if rr := serve(t, "POST", "/api/schedules", body); rr.Code != status {
+			t.Errorf("%s: expected status %d, got %d: %s", body, status, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr = serve(t, "GET", "/api/schedules", "")
+	var list struct {
+		Timezone  string           `json:"timezone"`
+		Schedules []ScheduleStatus `json:"schedules"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatalf("invalid JSON %s: %v", rr.Body.String(), err)
+	}
+	if list.Timezone != "America/Los_Angeles" || len(list.Schedules) != 2 {
+		t.Fatalf("unexpected schedules %s", rr.Body.String())
+	}
+	if next := list.Schedules[0].NextRun; next == nil || next.Hour() != 19 || next.Minute() != 45 {
+		t.Errorf("expected the next run at 19:45, got %v", next)
+	}
+
+	// Deletes reply with the JSON envelope like the other methods
+	rr = serve(t, "DELETE", "/api/schedules/lullaby", "")
+	var deleted commandResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &deleted); err != nil || rr.Code != http.StatusOK || !deleted.OK {
+		t.Errorf("expected a 200 JSON reply, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = serve(t, "DELETE", "/api/schedules/lullaby", "")
+	var missing commandResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &missing); err != nil || rr.Code != http.StatusNotFound || missing.Error != codeNotFound {
+		t.Errorf("expected a 404 %s JSON reply, got %d: %s", codeNotFound, rr.Code, rr.Body.String())
+	}
+	if rr := serve(t, "PUT", "/api/schedules", ""); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", rr.Code)
+	}
+
+	// Changes are saved for the next start
+	restarted := newScheduler()
+	if n, err := restarted.Load(path); err != nil || n != 1 {
+		t.Fatalf("expected 1 saved schedule, got %d, %v", n, err)
+	}
+	if _, saved := restarted.List(time.Now()); saved[0].ID != "schedule-2" || saved[0].Duration != "30m" {
+		t.Errorf("unexpected saved schedules %+v", saved)
+	}
+}
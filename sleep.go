@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ianr0bkny/go-sonos"
+)
+
+// Sleep timer modes: the speaker's own timer, or one run by the server that
+// fades the volume out before pausing
+const (
+	sleepModeNative = "native"
+	sleepModeFade   = "fade"
+)
+
+// maxSleepDuration is the longest sleep timer, the most an H:MM:SS duration
+// under a day can hold
+const maxSleepDuration = 24*time.Hour - time.Second
+
+// sleepFadeDuration is how long before the end a fade sleep timer starts
+// turning the volume down, in sleepFadeSteps steps
+var (
+	sleepFadeDuration = time.Minute
+	sleepFadeSteps    = 12
+)
+
+// sleepTimers runs the fade sleep timers of all speakers
+var sleepTimers = newSleepTimerSet()
+
+// sleepTimerSet tracks at most one fade sleep timer per speaker
+type sleepTimerSet struct {
+	mu     sync.Mutex
+	timers map[string]*sleepTimer
+}
+
+// sleepTimer is a running fade sleep timer
+type sleepTimer struct {
+	speaker Speaker
+	ends    time.Time
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// sleepTimerState reports a sleep timer in a command's state
+type sleepTimerState struct {
+	Mode             string    `json:"mode"`
+	Remaining        string    `json:"remaining"`
+	RemainingSeconds int       `json:"remaining_seconds"`
+	EndsAt           time.Time `json:"ends_at"`
+}
+
+// newSleepTimerSet returns a set with no timers
+func newSleepTimerSet() *sleepTimerSet {
+	return &sleepTimerSet{timers: make(map[string]*sleepTimer)}
+}
+
+// Start replaces the fade sleep timer of speaker with one that pauses it
+// after d
+func (t *sleepTimerSet) Start(speaker Speaker, d time.Duration) *sleepTimer {
+	t.Stop(speaker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := &sleepTimer{speaker: speaker, ends: time.Now().Add(d), cancel: cancel, done: make(chan struct{})}
+	key := speakerKey(speaker)
+
+	t.mu.Lock()
+	t.timers[key] = timer
+	t.mu.Unlock()
+
+	go func() {
+		defer close(timer.done)
+		defer func() {
+			t.mu.Lock()
+			if t.timers[key] == timer {
+				delete(t.timers, key)
+			}
+			t.mu.Unlock()
+		}()
+		timer.run(ctx)
+	}()
+	return timer
+}
+
+// Stop cancels the fade sleep timer of speaker, putting the volume back if
+// it was fading, and reports whether there was one
+func (t *sleepTimerSet) Stop(speaker Speaker) bool {
+	t.mu.Lock()
+	timer := t.timers[speakerKey(speaker)]
+	t.mu.Unlock()
+	if timer == nil {
+		return false
+	}
+	timer.cancel()
+	<-timer.done
+	return true
+}
+
+// Get returns the running fade sleep timer of speaker, if any
+func (t *sleepTimerSet) Get(speaker Speaker) (*sleepTimer, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timer, ok := t.timers[speakerKey(speaker)]
+	return timer, ok
+}
+
+// run waits until the fade is due, turns the volume down step by step and
+// pauses, then puts the volume back so the next play is not silent
+func (timer *sleepTimer) run(ctx context.Context) {
+	speaker := timer.speaker
+	fade := sleepFadeDuration
+	wait := time.Until(timer.ends) - fade
+	if wait < 0 {
+		fade += wait
+		wait = 0
+	}
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(wait):
+	}
+
+	s, err := openSpeaker(speaker, sonos.SVC_AV_TRANSPORT|sonos.SVC_RENDERING_CONTROL)
+	if err != nil {
+		log.Printf("Sleep timer failed to connect to %s: %v", speaker.Name, err)
+		return
+	}
+	volume, volumeErr := s.GetVolume()
+	if volumeErr != nil {
+		log.Printf("Sleep timer failed to get the volume of %s, pausing without a fade: %v", speaker.Name, volumeErr)
+	}
+	restore := func() {
+		if volumeErr == nil {
+			if err := s.SetVolume(volume); err != nil {
+				log.Printf("Sleep timer failed to restore the volume of %s: %v", speaker.Name, err)
+			}
+		}
+	}
+
+	log.Printf("Sleep timer fading out %s from volume %d", speaker.Name, volume)
+	steps := sleepFadeSteps
+	for i := 1; i <= steps; i++ {
+		select {
+		case <-ctx.Done():
+			restore()
+			return
+		case <-time.After(fade / time.Duration(steps)):
+		}
+		if volumeErr == nil {
+			if err := s.SetVolume(volume * uint16(steps-i) / uint16(steps)); err != nil {
+				log.Printf("Sleep timer failed to lower the volume of %s: %v", speaker.Name, err)
+			}
+		}
+	}
+
+	if err := s.Pause(); err != nil {
+		log.Printf("Sleep timer failed to pause %s: %v", speaker.Name, err)
+	} else {
+		log.Printf("Sleep timer paused %s", speaker.Name)
+	}
+	restore()
+}
+
+// state reports the timer's remaining time
+func (timer *sleepTimer) state() *sleepTimerState {
+	remaining := time.Until(timer.ends)
+	if remaining < 0 {
+		remaining = 0
+	}
+	seconds := int((remaining + time.Second - 1) / time.Second)
+	return &sleepTimerState{
+		Mode:             sleepModeFade,
+		Remaining:        formatTrackTime(seconds),
+		RemainingSeconds: seconds,
+		EndsAt:           timer.ends,
+	}
+}
+
+// nativeSleepTimerState reports a native sleep timer with remaining time
+// remaining, as returned by GetRemainingSleepTimerDuration
+func nativeSleepTimerState(remaining string) *sleepTimerState {
+	seconds := parseTrackTime(remaining)
+	return &sleepTimerState{
+		Mode:             sleepModeNative,
+		Remaining:        formatTrackTime(seconds),
+		RemainingSeconds: seconds,
+		EndsAt:           time.Now().Add(time.Duration(seconds) * time.Second),
+	}
+}
+
+// sleepTimerHandler sets a sleep timer on POST, reports it on GET and
+// cancels it on DELETE
+func sleepTimerHandler(w http.ResponseWriter, r *http.Request) {
+	cmd := speakerCommand{
+		name:     "Sleep timer",
+		action:   "sleep-timer",
+		services: sonos.SVC_AV_TRANSPORT | sonos.SVC_RENDERING_CONTROL,
+	}
+	switch r.Method {
+	case http.MethodGet:
+		cmd.run = getSleepTimerCommand
+	case http.MethodPost:
+		cmd.run = setSleepTimerCommand
+	case http.MethodDelete:
+		cmd.run = cancelSleepTimerCommand
+	default:
+		writeError(w, r, cmd.action, "", commandRejected(http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	runCommand(w, r, cmd)
+}
+
+// sleepTimerRequest is the body accepted by POST /sonos/sleep-timer
+type sleepTimerRequest struct {
+	// Duration is a Go duration such as "30m" or an H:MM:SS time
+	Duration string `json:"duration"`
+	Mode     string `json:"mode"`
+}
+
+// parseSleepDuration parses a Go duration such as "45m" or an H:MM:SS time
+func parseSleepDuration(value string) (time.Duration, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return d, nil
+	}
+	if seconds := parseTrackTime(value); seconds > 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, fmt.Errorf("invalid duration %q, expected e.g. 30m or 0:30:00", value)
+}
+
+// setSleepTimerCommand starts a sleep timer, replacing any other
+func setSleepTimerCommand(c *commandContext) error {
+	var req sleepTimerRequest
+	if err := c.decode(&req); err != nil {
+		return commandRejected(http.StatusBadRequest, codeInvalidRequest, "Invalid JSON request")
+	}
+	d, err := parseSleepDuration(req.Duration)
+	if err != nil {
+		return commandRejected(http.StatusBadRequest, codeInvalidRequest, err.Error())
+	}
+	if d < time.Second || d > maxSleepDuration {
+		return commandRejected(http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("duration must be between 1s and %s", maxSleepDuration))
+	}
+
+	switch req.Mode {
+	case "", sleepModeNative:
+		sleepTimers.Stop(c.speaker)
+		remaining := formatTrackTime(int(d / time.Second))
+		if err := c.s.ConfigureSleepTimer(remaining); err != nil {
+			return commandFailed("Failed to set sleep timer", err)
+		}
+		c.state.SleepTimer = nativeSleepTimerState(remaining)
+	case sleepModeFade:
+		// Only one timer may stop the speaker
+		if err := c.s.ConfigureSleepTimer(""); err != nil {
+			return commandFailed("Failed to clear the speaker's sleep timer", err)
+		}
+		c.state.SleepTimer = sleepTimers.Start(c.speaker, d).state()
+	default:
+		return commandRejected(http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("unknown mode %q, expected %s or %s", req.Mode, sleepModeNative, sleepModeFade))
+	}
+
+	log.Printf("Set %s sleep timer on %s for %s", c.state.SleepTimer.Mode, c.speaker.Name, d)
+	return c.reply("Sleep timer on %s ends in %s", c.speaker.Name, c.state.SleepTimer.Remaining)
+}
+
+// getSleepTimerCommand reports the time left on the speaker's sleep timer
+func getSleepTimerCommand(c *commandContext) error {
+	if timer, ok := sleepTimers.Get(c.speaker); ok {
+		c.state.SleepTimer = timer.state()
+	} else {
+		remaining, err := c.s.GetRemainingSleepTimerDuration()
+		if err != nil {
+			return commandFailed("Failed to get sleep timer", err)
+		}
+		if remaining == "" {
+			return c.reply("No sleep timer on %s", c.speaker.Name)
+		}
+		c.state.SleepTimer = nativeSleepTimerState(remaining)
+	}
+	return c.reply("Sleep timer on %s ends in %s", c.speaker.Name, c.state.SleepTimer.Remaining)
+}
+
+// cancelSleepTimerCommand turns off the speaker's sleep timer
+func cancelSleepTimerCommand(c *commandContext) error {
+	sleepTimers.Stop(c.speaker)
+	if err := c.s.ConfigureSleepTimer(""); err != nil {
+		return commandFailed("Failed to cancel sleep timer", err)
+	}
+	log.Printf("Cancelled sleep timer on %s", c.speaker.Name)
+	return c.reply("Sleep timer on %s cancelled", c.speaker.Name)
+}
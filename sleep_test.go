@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useQuickFade shortens the fade of fade sleep timers for the duration of
+// the test and cancels any timer left on fake
+func useQuickFade(t *testing.T, fake *fakeSonos) {
+	t.Helper()
+	oldDuration, oldSteps := sleepFadeDuration, sleepFadeSteps
+	sleepFadeDuration, sleepFadeSteps = 500*time.Millisecond, 5
+	t.Cleanup(func() {
+		sleepTimers.Stop(fake.Speaker())
+		sleepFadeDuration, sleepFadeSteps = oldDuration, oldSteps
+	})
+}
+
+func TestNativeSleepTimer(t *testing.T) {
+	fake := useFakeSpeaker(t)
+
+	rr, response := serveJSON(t, "GET", "/sonos/sleep-timer", "")
+	if rr.Code != http.StatusOK || response.State != nil || response.Message != "No sleep timer on Kids Room" {
+		t.Errorf("expected no sleep timer, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr, response = serveJSON(t, "POST", "/sonos/sleep-timer", `{"duration": "45m"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if timer := fake.SleepTimer(); timer != "0:45:00" {
+		t.Errorf("expected the speaker's timer set to 0:45:00, got %q", timer)
+	}
+	if state := response.State.SleepTimer; state == nil || state.Mode != "native" || state.RemainingSeconds != 2700 {
+		t.Errorf("unexpected sleep timer state %s", rr.Body.String())
+	}
+
+	rr, response = serveJSON(t, "GET", "/sonos/sleep-timer", "")
+	if rr.Code != http.StatusOK || response.State == nil || response.State.SleepTimer.Remaining != "0:45:00" {
+		t.Errorf("expected 0:45:00 remaining, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := serve(t, "DELETE", "/sonos/sleep-timer", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if timer := fake.SleepTimer(); timer != "" {
+		t.Errorf("expected the speaker's timer cancelled, got %q", timer)
+	}
+
+	for _, body := range []string{`{}`, `{"duration": "soon"}`, `{"duration": "25h"}`, `{"duration": "10m", "mode": "snooze"}`} {
+		if rr := serve(t, "POST", "/sonos/sleep-timer", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, rr.Code)
+		}
+	}
+}
+
+func TestFadeSleepTimer(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	useQuickFade(t, fake)
+	fake.SetState("PLAYING", 0, 40, false)
+
+	// A fade timer replaces the speaker's own
+	if rr := serve(t, "POST", "/sonos/sleep-timer", `{"duration": "1h"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr, response := serveJSON(t, "POST", "/sonos/sleep-timer", `{"duration": "0:00:01", "mode": "fade"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if state := response.State.SleepTimer; state == nil || state.Mode != "fade" || state.RemainingSeconds != 1 {
+		t.Errorf("unexpected sleep timer state %s", rr.Body.String())
+	}
+	if timer := fake.SleepTimer(); timer != "" {
+		t.Errorf("expected the speaker's timer cleared, got %q", timer)
+	}
+	if rr, response := serveJSON(t, "GET", "/sonos/sleep-timer", ""); response.State == nil || response.State.SleepTimer.Mode != "fade" {
+		t.Errorf("expected the fade timer reported, got %s", rr.Body.String())
+	}
+
+	timer, ok := sleepTimers.Get(fake.Speaker())
+	if !ok {
+		t.Fatal("expected a running fade timer")
+	}
+	select {
+	case <-timer.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sleep timer did not finish")
+	}
+
+	state, _, volume, _ := fake.State()
+	if state != "PAUSED_PLAYBACK" || volume != 40 {
+		t.Errorf("expected paused with the volume restored to 40, got %s at %d", state, volume)
+	}
+	if fades := strings.Count(strings.Join(fake.Actions(), " "), "SetVolume"); fades < 5 {
+		t.Errorf("expected the volume lowered in steps, got %v", fake.Actions())
+	}
+	if _, ok := sleepTimers.Get(fake.Speaker()); ok {
+		t.Error("expected the finished timer removed")
+	}
+}
+
+func TestCancelFadeSleepTimer(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	useQuickFade(t, fake)
+	fake.SetState("PLAYING", 0, 30, false)
+
+	// Cancel part way through the fade
+	if rr := serve(t, "POST", "/sonos/sleep-timer", `{"duration": "1s", "mode": "fade"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	time.Sleep(800 * time.Millisecond)
+	if rr := serve(t, "DELETE", "/sonos/sleep-timer", ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	state, _, volume, _ := fake.State()
+	if state != "PLAYING" || volume != 30 {
+		t.Errorf("expected playing on at volume 30, got %s at %d", state, volume)
+	}
+}
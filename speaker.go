@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/ianr0bkny/go-sonos"
+	"github.com/ianr0bkny/go-sonos/didl"
+	"github.com/ianr0bkny/go-sonos/model"
+	"github.com/ianr0bkny/go-sonos/ssdp"
+	"github.com/ianr0bkny/go-sonos/upnp"
+)
+
+// sonosPort is the port Sonos devices serve UPnP on
+const sonosPort = "1400"
+
+// SpeakerController is the set of Sonos UPnP operations used by the HTTP
+// handlers. Instance IDs and channels are fixed to the values a Play:1 uses
+// (instance 0, Master channel).
+type SpeakerController interface {
+	// AVTransport
+	Play() error
+	Pause() error
+	Next() error
+	Previous() error
+	Seek(unit, target string) error
+	GetTransportInfo() (*upnp.TransportInfo, error)
+	GetPositionInfo() (*upnp.PositionInfo, error)
+	GetMediaInfo() (*upnp.MediaInfo, error)
+	GetTransportSettings() (*upnp.TransportSettings, error)
+	SetPlayMode(playMode string) error
+	SetAVTransportURI(uri, metadata string) error
+	AddURIToQueue(req *upnp.AddURIToQueueIn) (*upnp.AddURIToQueueOut, error)
+	RemoveAllTracksFromQueue() error
+	ConfigureSleepTimer(duration string) error
+	GetRemainingSleepTimerDuration() (string, error)
+
+	// RenderingControl
+	GetVolume() (uint16, error)
+	SetVolume(volume uint16) error
+	GetMute() (bool, error)
+	SetMute(mute bool) error
+
+	// ContentDirectory
+	GetQueueContents() ([]model.Object, error)
+	GetQueueItems() ([]didl.Item, error)
+	GetMetadata(objectID string) ([]model.Object, error)
+
+	// DeviceProperties
+	GetZoneAttributes() (zoneName string, icon string, err error)
+}
+
+// speakerLocation returns the device description URL for a speaker address.
+// The address is normally a bare IP, in which case the standard Sonos port is
+// used, but an explicit host:port is honored.
+func speakerLocation(address string) ssdp.Location {
+	host := address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		host = net.JoinHostPort(address, sonosPort)
+	}
+	return ssdp.Location(fmt.Sprintf("http://%s/xml/device_description.xml", host))
+}
+
+// connectSpeaker describes the device at address and returns a controller
+// for the requested go-sonos services (e.g. sonos.SVC_AV_TRANSPORT).
+func connectSpeaker(address string, services int) (SpeakerController, error) {
+	svcMap, err := describeSpeaker(address)
+	if err != nil {
+		return nil, err
+	}
+	return newSonosController(svcMap, services, nil)
+}
+
+// describeSpeaker fetches the device description at address and returns its
+// services. Their SCPD documents are not fetched here: sonos.MakeSonos
+// fetches one for every requested service when newSonosController builds a
+// controller, skipping services of the map that were described before.
+func describeSpeaker(address string) (upnp.ServiceMap, error) {
+	svcMap, err := upnp.Describe(speakerLocation(address))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe device at %s: %w", address, err)
+	}
+	// upnp.Describe returns an empty map without an error when it times out
+	if len(svcMap) == 0 {
+		return nil, fmt.Errorf("no services described for device at %s", address)
+	}
+	return svcMap, nil
+}
+
+// newSonosController returns a controller for the requested services of a
+// described device. failed, if not nil, is called when a call cannot reach
+// the device.
+func newSonosController(svcMap upnp.ServiceMap, services int, failed func(error)) (SpeakerController, error) {
+	// Create the connection WITHOUT a reactor to avoid the /eventSub handler
+	// registration conflict in go-sonos
+	s := sonos.MakeSonos(svcMap, nil, services)
+	if s == nil {
+		return nil, fmt.Errorf("failed to create Sonos connection")
+	}
+	return &sonosController{s: s, failed: failed}, nil
+}
+
+// sonosController implements SpeakerController with go-sonos.
+type sonosController struct {
+	s      *sonos.Sonos
+	failed func(error)
+}
+
+// recoverCall converts a panic from go-sonos into an error. go-sonos panics
+// rather than returning an error when the HTTP request to the speaker fails
+// or when a service was not described. SOAP faults are returned as errors
+// and do not count as a failure to reach the device.
+func (c *sonosController) recoverCall(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("sonos call failed: %v", r)
+		if c.failed != nil {
+			c.failed(*err)
+		}
+	}
+}
+
+func (c *sonosController) Play() (err error) {
+	defer c.recoverCall(&err)
+	return c.s.Play(0, upnp.PlaySpeed_1)
+}
+
+func (c *sonosController) Pause() (err error) {
+	defer c.recoverCall(&err)
+	return c.s.Pause(0)
+}
+
+func (c *sonosController) Next() (err error) {
+	defer c.recoverCall(&err)
+	return c.s.Next(0)
+}
+
+func (c *sonosController) Previous() (err error) {
+	defer c.recoverCall(&err)
+	return c.s.Previous(0)
+}
+
+func (c *sonosController) Seek(unit, target string) (err error) {
+	defer c.recoverCall(&err)
+	return c.s.Seek(0, unit, target)
+}
+
+func (c *sonosController) GetTransportInfo() (info *upnp.TransportInfo, err error) {
+	defer c.recoverCall(&err)
+	return c.s.GetTransportInfo(0)
+}
+
+func (c *sonosController) GetPositionInfo() (info *upnp.PositionInfo, err error) {
+	defer c.recoverCall(&err)
+	return c.s.GetPositionInfo(0)
+}
+
+func (c *sonosController) GetMediaInfo() (info *upnp.MediaInfo, err error) {
+	defer c.recoverCall(&err)
+	return c.s.GetMediaInfo(0)
+}
+
+func (c *sonosController) GetTransportSettings() (settings *upnp.TransportSettings, err error) {
+	defer c.recoverCall(&err)
+	return c.s.GetTransportSettings(0)
+}
+
+func (c *sonosController) SetPlayMode(playMode string) (err error) {
+	defer c.recoverCall(&err)
+	return c.s.SetPlayMode(0, playMode)
+}
+
+func (c *sonosController) SetAVTransportURI(uri, metadata string) (err error) {
+	defer c.recoverCall(&err)
+	return c.s.SetAVTransportURI(0, uri, metadata)
+}
+
+func (c *sonosController) AddURIToQueue(req *upnp.AddURIToQueueIn) (out *upnp.AddURIToQueueOut, err error) {
+	defer c.recoverCall(&err)
+	return c.s.AddURIToQueue(0, req)
+}
+
+func (c *sonosController) RemoveAllTracksFromQueue() (err error) {
+	defer c.recoverCall(&err)
+	return c.s.RemoveAllTracksFromQueue(0)
+}
+
+func (c *sonosController) ConfigureSleepTimer(duration string) (err error) {
+	defer c.recoverCall(&err)
+	return c.s.ConfigureSleepTimer(0, duration)
+}
+
+func (c *sonosController) GetRemainingSleepTimerDuration() (remaining string, err error) {
+	defer c.recoverCall(&err)
+	remaining, _, err = c.s.GetRemainingSleepTimerDuration(0)
+	return remaining, err
+}
+
+func (c *sonosController) GetVolume() (volume uint16, err error) {
+	defer c.recoverCall(&err)
+	return c.s.GetVolume(0, upnp.Channel_Master)
+}
+
+func (c *sonosController) SetVolume(volume uint16) (err error) {
+	defer c.recoverCall(&err)
+	return c.s.SetVolume(0, upnp.Channel_Master, volume)
+}
+
+func (c *sonosController) GetMute() (mute bool, err error) {
+	defer c.recoverCall(&err)
+	return c.s.GetMute(0, upnp.Channel_Master)
+}
+
+func (c *sonosController) SetMute(mute bool) (err error) {
+	defer c.recoverCall(&err)
+	return c.s.SetMute(0, upnp.Channel_Master, mute)
+}
+
+func (c *sonosController) GetQueueContents() (objects []model.Object, err error) {
+	defer c.recoverCall(&err)
+	return c.s.GetQueueContents()
+}
+
+// GetQueueItems browses the queue like GetQueueContents but keeps the DIDL
+// items, whose resources carry the protocolInfo model.Object leaves out
+func (c *sonosController) GetQueueItems() (items []didl.Item, err error) {
+	defer c.recoverCall(&err)
+	result, err := c.s.Browse(&upnp.BrowseRequest{
+		ObjectID:     sonos.ObjectID_Queue_AVT_Instance_0,
+		BrowseFlag:   upnp.BrowseFlag_BrowseDirectChildren,
+		Filter:       upnp.BrowseFilter_All,
+		SortCriteria: upnp.BrowseSortCriteria_None,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Doc.Item, nil
+}
+
+func (c *sonosController) GetMetadata(objectID string) (objects []model.Object, err error) {
+	defer c.recoverCall(&err)
+	return c.s.GetMetadata(objectID)
+}
+
+func (c *sonosController) GetZoneAttributes() (zoneName string, icon string, err error) {
+	defer c.recoverCall(&err)
+	return c.s.GetZoneAttributes()
+}
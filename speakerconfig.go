@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// staticSpeakerAddresses are probed on every discovery sweep in addition to
+// SSDP, for networks that drop multicast
+var staticSpeakerAddresses []string
+
+// sweepSubnets are swept for devices answering on the Sonos port when SSDP
+// finds no speakers
+var sweepSubnets []*net.IPNet
+
+// maxSweepHosts bounds the size of a single subnet sweep
+const maxSweepHosts = 1024
+
+// sweepDialTimeout is how long a sweep waits for each host to accept a
+// connection on the Sonos port
+const sweepDialTimeout = 500 * time.Millisecond
+
+// sweepConcurrency is the number of hosts dialed at once during a sweep
+const sweepConcurrency = 64
+
+// speakerConfigFile is the format of the -speakers-file config file, e.g.
+//
+//	{
+//	  "speakers": ["192.168.4.120", "192.168.4.121"],
+//	  "subnets": ["192.168.4.0/24"]
+//	}
+type speakerConfigFile struct {
+	Speakers []string `json:"speakers"`
+	Subnets  []string `json:"subnets"`
+}
+
+// loadSpeakerConfig reads speaker addresses and sweep subnets from a config
+// file
+func loadSpeakerConfig(path string) (addresses []string, subnets []string, err error) {
+	var file speakerConfigFile
+	if err := readJSONFile(path, &file); err != nil {
+		return nil, nil, fmt.Errorf("failed to read speaker config %s: %w", path, err)
+	}
+	return file.Speakers, file.Subnets, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseSubnets parses CIDR subnets to sweep. The special value "auto" expands
+// to the IPv4 subnets of the local network interfaces.
+func parseSubnets(specs []string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+	for _, spec := range specs {
+		if spec == "auto" {
+			subnets = append(subnets, localSubnets()...)
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %w", spec, err)
+		}
+		if subnet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid subnet %q: only IPv4 subnets can be swept", spec)
+		}
+		if _, err := subnetHosts(subnet); err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// localSubnets returns the IPv4 subnets of the up, non-loopback interfaces.
+// Subnets larger than a /24 are narrowed to the /24 around the interface
+// address to keep the sweep short.
+func localSubnets() []*net.IPNet {
+	netInterfaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("Failed to get network interfaces: %v", err)
+		return nil
+	}
+
+	var subnets []*net.IPNet
+	for _, iface := range netInterfaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			mask := ipNet.Mask
+			if ones, _ := mask.Size(); ones < 24 {
+				mask = net.CIDRMask(24, 32)
+			}
+			subnets = append(subnets, &net.IPNet{IP: ipNet.IP.To4().Mask(mask), Mask: mask})
+		}
+	}
+	return subnets
+}
+
+// subnetHosts returns the host addresses in an IPv4 subnet, excluding the
+// network and broadcast addresses
+func subnetHosts(subnet *net.IPNet) ([]string, error) {
+	ip := subnet.IP.To4()
+	ones, bits := subnet.Mask.Size()
+	if ip == nil || bits != 32 {
+		return nil, fmt.Errorf("subnet %s is not IPv4", subnet)
+	}
+	size := uint32(1) << (32 - ones)
+	if size > maxSweepHosts {
+		return nil, fmt.Errorf("subnet %s is too large to sweep (more than %d addresses)", subnet, maxSweepHosts)
+	}
+
+	first, last := uint32(0), size-1
+	if size > 2 {
+		first, last = 1, size-2
+	}
+	base := binary.BigEndian.Uint32(ip)
+	hosts := make([]string, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		host := make(net.IP, 4)
+		binary.BigEndian.PutUint32(host, base+i)
+		hosts = append(hosts, host.String())
+	}
+	return hosts, nil
+}
+
+// sweepSubnet returns the hosts in subnet accepting TCP connections on port
+func sweepSubnet(subnet *net.IPNet, port string) []string {
+	hosts, err := subnetHosts(subnet)
+	if err != nil {
+		log.Printf("Skipping sweep: %v", err)
+		return nil
+	}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		open []string
+	)
+	sem := make(chan struct{}, sweepConcurrency)
+	for _, host := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(host string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), sweepDialTimeout)
+			if err != nil {
+				return
+			}
+			conn.Close()
+			mu.Lock()
+			open = append(open, host)
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+	return open
+}
+
+// probeSpeakerAddresses probes each address not already in seen, registers
+// the speakers that answer, adds their addresses to seen and returns them
+func probeSpeakerAddresses(addresses []string, seen map[string]bool) []SpeakerInfo {
+	var speakers []SpeakerInfo
+	for _, address := range addresses {
+		if seen[address] {
+			continue
+		}
+		speaker, err := probeSpeaker(address)
+		if err != nil {
+			log.Printf("Failed to probe Sonos device at %s: %v", address, err)
+			continue
+		}
+		speakerRegistry.Put(speaker)
+		seen[address] = true
+		speakers = append(speakers, SpeakerInfo{
+			Name: speaker.Name,
+			IP:   address,
+		})
+		log.Printf("Found Sonos device: %s (room: %s) at %s", speaker.Name, speaker.Room, address)
+	}
+	return speakers
+}
+
+// sweepForSpeakers sweeps each subnet for the Sonos port and probes the hosts
+// that answer, skipping addresses already in seen
+func sweepForSpeakers(subnets []*net.IPNet, seen map[string]bool) []SpeakerInfo {
+	var speakers []SpeakerInfo
+	for _, subnet := range subnets {
+		log.Printf("Sweeping %s for Sonos devices on port %s", subnet, sonosPort)
+		hosts := sweepSubnet(subnet, sonosPort)
+		log.Printf("Found %d hosts answering on port %s in %s", len(hosts), sonosPort, subnet)
+		speakers = append(speakers, probeSpeakerAddresses(hosts, seen)...)
+	}
+	return speakers
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSubnetHosts(t *testing.T) {
+	tests := []struct {
+		cidr  string
+		count int
+		first string
+		last  string
+	}{
+		{"192.168.4.0/24", 254, "192.168.4.1", "192.168.4.254"},
+		{"192.168.4.0/30", 2, "192.168.4.1", "192.168.4.2"},
+		{"192.168.4.8/31", 2, "192.168.4.8", "192.168.4.9"},
+		{"192.168.4.120/32", 1, "192.168.4.120", "192.168.4.120"},
+		{"10.0.0.0/22", 1022, "10.0.0.1", "10.0.3.254"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			_, subnet, err := net.ParseCIDR(tt.cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hosts, err := subnetHosts(subnet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hosts) != tt.count {
+				t.Fatalf("expected %d hosts, got %d", tt.count, len(hosts))
+			}
+			if hosts[0] != tt.first || hosts[len(hosts)-1] != tt.last {
+				t.Errorf("expected %s..%s, got %s..%s", tt.first, tt.last, hosts[0], hosts[len(hosts)-1])
+			}
+		})
+	}
+}
+
+func TestParseSubnets(t *testing.T) {
+	subnets, err := parseSubnets([]string{"192.168.4.0/24", "10.0.0.5/30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, subnet := range subnets {
+		got = append(got, subnet.String())
+	}
+	if want := []string{"192.168.4.0/24", "10.0.0.4/30"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	for _, spec := range []string{"192.168.4.0", "10.0.0.0/8", "fd00::/120"} {
+		if _, err := parseSubnets([]string{spec}); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	got := splitList(" 192.168.4.120, ,192.168.4.121:1400 ")
+	if want := []string{"192.168.4.120", "192.168.4.121:1400"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if got := splitList(""); len(got) != 0 {
+		t.Errorf("expected no items, got %v", got)
+	}
+}
+
+func TestLoadSpeakerConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "speakers.json")
+	config := `{"speakers": ["192.168.4.120", "192.168.4.121"], "subnets": ["192.168.4.0/24"]}`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, subnets, err := loadSpeakerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"192.168.4.120", "192.168.4.121"}; !reflect.DeepEqual(addresses, want) {
+		t.Errorf("expected addresses %v, got %v", want, addresses)
+	}
+	if want := []string{"192.168.4.0/24"}; !reflect.DeepEqual(subnets, want) {
+		t.Errorf("expected subnets %v, got %v", want, subnets)
+	}
+
+	if _, _, err := loadSpeakerConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected error for missing config file")
+	}
+}
+
+func TestSweepSubnet(t *testing.T) {
+	fake := newFakeSonos(t, "Kitchen")
+	_, port, err := net.SplitHostPort(fake.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, subnet, _ := net.ParseCIDR("127.0.0.1/32")
+	if got := sweepSubnet(subnet, port); !reflect.DeepEqual(got, []string{"127.0.0.1"}) {
+		t.Errorf("expected sweep to find 127.0.0.1, got %v", got)
+	}
+
+	fake.server.Close()
+	if got := sweepSubnet(subnet, port); len(got) != 0 {
+		t.Errorf("expected sweep to find nothing after close, got %v", got)
+	}
+}
+
+func TestProbeSpeakerAddresses(t *testing.T) {
+	oldRegistry := speakerRegistry
+	speakerRegistry = NewSpeakerRegistry()
+	t.Cleanup(func() { speakerRegistry = oldRegistry })
+
+	kitchen := newFakeSonos(t, "Kitchen")
+	office := newFakeSonos(t, "Office")
+	gone := newFakeSonos(t, "Garage")
+	gone.server.Close()
+
+	// Office was already found by SSDP, Garage does not answer
+	seen := map[string]bool{office.Address(): true}
+	found := probeSpeakerAddresses([]string{kitchen.Address(), office.Address(), gone.Address()}, seen)
+
+	want := []SpeakerInfo{{Name: "Kitchen", IP: kitchen.Address()}}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("expected %v, got %v", want, found)
+	}
+	if speaker, ok := speakerRegistry.Get(kitchen.UUID()); !ok || speaker.Address != kitchen.Address() {
+		t.Errorf("expected Kitchen registered at %s, got %+v", kitchen.Address(), speaker)
+	}
+	if _, ok := speakerRegistry.Get(office.UUID()); ok {
+		t.Error("expected already seen address to be skipped")
+	}
+	if !seen[kitchen.Address()] {
+		t.Error("expected probed address to be marked seen")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// trackState is the current track as reported by GetPositionInfo
+type trackState struct {
+	// Index is the 1-based position of the track in the queue
+	Index           int    `json:"index"`
+	Title           string `json:"title,omitempty"`
+	URI             string `json:"uri,omitempty"`
+	Duration        string `json:"duration,omitempty"`
+	Elapsed         string `json:"elapsed,omitempty"`
+	DurationSeconds int    `json:"duration_seconds"`
+	ElapsedSeconds  int    `json:"elapsed_seconds"`
+}
+
+// statusCommand reports what the speaker is doing: transport state, current
+// track and position, volume and mute
+func statusCommand(c *commandContext) error {
+	transportInfo, err := c.s.GetTransportInfo()
+	if err != nil {
+		return commandFailed("Failed to get playback state", err)
+	}
+	positionInfo, err := c.s.GetPositionInfo()
+	if err != nil {
+		return commandFailed("Failed to get track position", err)
+	}
+	volume, err := c.s.GetVolume()
+	if err != nil {
+		return commandFailed("Failed to get volume", err)
+	}
+	mute, err := c.s.GetMute()
+	if err != nil {
+		return commandFailed("Failed to get mute state", err)
+	}
+
+	c.state.TransportState = transportInfo.CurrentTransportState
+	c.state.Volume = &volume
+	c.state.Mute = &mute
+	if positionInfo.Track > 0 {
+		c.state.Track = &trackState{
+			Index:           int(positionInfo.Track),
+			Title:           didlTitle(positionInfo.TrackMetaData),
+			URI:             positionInfo.TrackURI,
+			Duration:        positionInfo.TrackDuration,
+			Elapsed:         positionInfo.RelTime,
+			DurationSeconds: parseTrackTime(positionInfo.TrackDuration),
+			ElapsedSeconds:  parseTrackTime(positionInfo.RelTime),
+		}
+	}
+
+	c.state.QueueFill, _ = queueFillers.Status(c.speaker)
+
+	return c.reply("%s", statusLine(c.speaker.Name, c.state))
+}
+
+// statusLine summarizes a speaker's state on one line for plain-text clients
+// such as the CardPuter
+func statusLine(name string, state speakerState) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s", name, state.TransportState)
+	if track := state.Track; track != nil {
+		fmt.Fprintf(&b, " track %d", track.Index)
+		if track.Title != "" {
+			fmt.Fprintf(&b, " %q", track.Title)
+		}
+		if track.Elapsed != "" && track.Duration != "" {
+			fmt.Fprintf(&b, " %s/%s", track.Elapsed, track.Duration)
+		}
+	}
+	if state.Volume != nil {
+		fmt.Fprintf(&b, ", volume %d", *state.Volume)
+	}
+	if state.Mute != nil && *state.Mute {
+		b.WriteString(", muted")
+	}
+	if fill := state.QueueFill; fill != nil {
+		if fill.Filling {
+			fmt.Fprintf(&b, ", queueing %d more tracks", fill.Remaining)
+		}
+		if len(fill.FailedTracks) > 0 {
+			fmt.Fprintf(&b, ", %d tracks failed to queue", len(fill.FailedTracks))
+		}
+	}
+	return b.String()
+}
+
+// didlTitle returns the dc:title of the first item in a DIDL-Lite document,
+// or "" if there is none
+func didlTitle(metadata string) string {
+	var doc struct {
+		Items []struct {
+			Title string `xml:"title"`
+		} `xml:"item"`
+	}
+	if err := xml.Unmarshal([]byte(metadata), &doc); err != nil || len(doc.Items) == 0 {
+		return ""
+	}
+	return doc.Items[0].Title
+}
+
+// parseTrackTime converts an H:MM:SS track time to seconds. Values Sonos
+// uses for unknown times, such as NOT_IMPLEMENTED, parse as 0.
+func parseTrackTime(value string) int {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0
+	}
+	seconds := 0
+	for _, part := range parts {
+		// Fractional seconds such as 0:01:02.500 are truncated
+		part, _, _ = strings.Cut(part, ".")
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds
+}
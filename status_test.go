@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrackTime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"0:00:00", 0},
+		{"0:03:25", 205},
+		{"1:02:03", 3723},
+		{"0:01:02.500", 62},
+		{"NOT_IMPLEMENTED", 0},
+		{"", 0},
+		{"3:25", 0},
+	}
+	for _, tt := range tests {
+		if got := parseTrackTime(tt.value); got != tt.want {
+			t.Errorf("parseTrackTime(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDIDLTitle(t *testing.T) {
+	metadata := `<DIDL-Lite xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/"><item id="-1" parentID="-1"><dc:title>Baby Shark &amp; Friends</dc:title></item></DIDL-Lite>`
+	if got := didlTitle(metadata); got != "Baby Shark & Friends" {
+		t.Errorf("expected title, got %q", got)
+	}
+	if got := didlTitle(""); got != "" {
+		t.Errorf("expected no title for empty metadata, got %q", got)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	fake := useFakeSpeaker(t)
+
+	if rr := serve(t, "POST", "/sonos/preset/5", ""); rr.Code != http.StatusOK {
+		t.Fatalf("failed to play preset: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(t, "POST", "/sonos/next", ""); rr.Code != http.StatusOK {
+		t.Fatalf("failed to skip track: %d %s", rr.Code, rr.Body.String())
+	}
+	fake.SetPosition("0:01:05")
+
+	req := httptest.NewRequest("GET", "/sonos/status?speaker=Kids+Room", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	corsMiddleware(setupRoutes()).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp commandResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	state := resp.State
+	if state == nil || state.TransportState != "PLAYING" || state.Volume == nil || *state.Volume != 20 || state.Mute == nil || *state.Mute {
+		t.Fatalf("unexpected state %+v", state)
+	}
+	track := state.Track
+	queue := fake.Queue()
+	if track == nil || track.Index != 2 || track.URI != queue[1].URI || track.Title == "" {
+		t.Fatalf("expected second queued track, got %+v", track)
+	}
+	if track.ElapsedSeconds != 65 || track.DurationSeconds != 180 {
+		t.Errorf("expected 65s of 180s, got %+v", track)
+	}
+
+	// Plain text for curl and the CardPuter
+	rr = serve(t, "GET", "/sonos/status", "")
+	want := "Kids Room: PLAYING track 2 \"" + track.Title + "\" 0:01:05/0:03:00, volume 20\n"
+	if rr.Body.String() != want {
+		t.Errorf("expected %q, got %q", want, rr.Body.String())
+	}
+
+	if rr := serve(t, "POST", "/sonos/status", ""); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 for POST, got %d", rr.Code)
+	}
+}
+
+func TestStatusHandlerStopped(t *testing.T) {
+	useFakeSpeaker(t)
+
+	rr := serve(t, "GET", "/sonos/status", "")
+	if want := "Kids Room: STOPPED, volume 20\n"; rr.Body.String() != want {
+		t.Errorf("expected %q, got %q", want, rr.Body.String())
+	}
+}
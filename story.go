@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ianr0bkny/go-sonos/upnp"
+)
+
+// Preset types set by a manifest's type
+const (
+	presetTypeMusic = "music"
+	presetTypeStory = "story"
+)
+
+// defaultSeekSeconds is how far /sonos/seek-forward and /sonos/seek-back
+// move when the request does not say
+const defaultSeekSeconds = 30
+
+// PresetChapter marks where a chapter starts within a file of a story
+// preset, for audiobooks that come as a single long MP3
+type PresetChapter struct {
+	// File is the track the chapter is in. A chapter without one is in
+	// every file, which suits a preset of a single long file.
+	File  string `json:"file,omitempty"`
+	Title string `json:"title,omitempty"`
+	// Start is the H:MM:SS time the chapter starts at
+	Start string `json:"start"`
+}
+
+// presetType returns the type of the preset of manifest
+func presetType(m *PresetManifest) string {
+	if m.isStory() {
+		return presetTypeStory
+	}
+	return presetTypeMusic
+}
+
+// isStory reports whether the manifest makes its preset a story
+func (m *PresetManifest) isStory() bool {
+	return m != nil && m.Type == presetTypeStory
+}
+
+// chaptersOf returns the chapters of file in the order they start
+func (m *PresetManifest) chaptersOf(file string) []PresetChapter {
+	if m == nil {
+		return nil
+	}
+	var chapters []PresetChapter
+	for _, chapter := range m.Chapters {
+		if chapter.File == "" || chapter.File == file {
+			chapters = append(chapters, chapter)
+		}
+	}
+	sort.SliceStable(chapters, func(i, j int) bool {
+		return parseTrackTime(chapters[i].Start) < parseTrackTime(chapters[j].Start)
+	})
+	return chapters
+}
+
+// validatePresetType checks the type and chapters of a manifest
+func validatePresetType(m *PresetManifest) error {
+	switch m.Type {
+	case "", presetTypeMusic, presetTypeStory:
+	default:
+		return fmt.Errorf("unknown type %q, expected %s or %s", m.Type, presetTypeMusic, presetTypeStory)
+	}
+	for i, chapter := range m.Chapters {
+		if parseTrackTime(chapter.Start) == 0 && strings.Trim(chapter.Start, "0:") != "" {
+			return fmt.Errorf("chapter %d starts at %q, expected H:MM:SS", i+1, chapter.Start)
+		}
+	}
+	if len(m.Chapters) > 0 && !m.isStory() {
+		return fmt.Errorf("chapters are only supported by %s presets", presetTypeStory)
+	}
+	if m.isStory() {
+		// An explicit normal play mode says what a story does anyway
+		if mode, _ := parsePlayMode(m.PlayMode); m.Shuffle || m.Repeat || m.PlayMode != "" && mode != upnp.PlayMode_NORMAL {
+			return fmt.Errorf("%s presets always play in order and cannot set play_mode, shuffle or repeat", presetTypeStory)
+		}
+	}
+	return nil
+}
+
+// storyPlayback is where a speaker is in the story preset it is playing
+type storyPlayback struct {
+	preset   string
+	manifest *PresetManifest
+	file     string
+	position *upnp.PositionInfo
+}
+
+// currentStory returns the story preset the speaker of c is playing and the
+// position in it, or false when it is playing anything else
+func currentStory(c *commandContext) (*storyPlayback, bool) {
+	preset, ok := presetProgress.Active(c.speaker)
+	if !ok {
+		return nil, false
+	}
+	manifest, err := loadPresetManifest(musicLibrary.FS(), preset)
+	if err != nil || !manifest.isStory() {
+		return nil, false
+	}
+	position, err := c.s.GetPositionInfo()
+	if err != nil {
+		return nil, false
+	}
+	file, ok := presetTrackFile(position.TrackURI, preset)
+	if !ok {
+		return nil, false
+	}
+	return &storyPlayback{preset: preset, manifest: manifest, file: file, position: position}, true
+}
+
+// rejectStoryPlayMode returns an error if mode would stop story preset
+// preset from playing in order
+func rejectStoryPlayMode(preset, mode string) error {
+	if mode == upnp.PlayMode_NORMAL {
+		return nil
+	}
+	return commandRejected(http.StatusConflict, codeInvalidRequest, fmt.Sprintf("Preset %s is a story and always plays in order", preset))
+}
+
+// nextChapter moves to the next chapter of the file the speaker is playing
+// when it is a story with chapters. It reports false, leaving the speaker
+// alone, when there is no later chapter in the file so the caller moves to
+// the next track instead.
+func nextChapter(c *commandContext) (bool, error) {
+	story, ok := currentStory(c)
+	if !ok {
+		return false, nil
+	}
+	now := parseTrackTime(story.position.RelTime)
+	for i, chapter := range story.manifest.chaptersOf(story.file) {
+		if parseTrackTime(chapter.Start) > now {
+			return true, seekChapter(c, story, i, chapter)
+		}
+	}
+	return false, nil
+}
+
+// previousChapter moves to the chapter before the one the speaker is in,
+// like nextChapter. It reports false in the first chapter of a file.
+func previousChapter(c *commandContext) (bool, error) {
+	story, ok := currentStory(c)
+	if !ok {
+		return false, nil
+	}
+	now := parseTrackTime(story.position.RelTime)
+	chapters := story.manifest.chaptersOf(story.file)
+	current := -1
+	for i, chapter := range chapters {
+		if parseTrackTime(chapter.Start) <= now {
+			current = i
+		}
+	}
+	if current < 1 {
+		return false, nil
+	}
+	return true, seekChapter(c, story, current-1, chapters[current-1])
+}
+
+// seekChapter moves playback to the start of chapter, the i-th of its file
+func seekChapter(c *commandContext, story *storyPlayback, i int, chapter PresetChapter) error {
+	if err := c.s.Seek("REL_TIME", chapter.Start); err != nil {
+		return commandFailed("Failed to skip to chapter", err)
+	}
+	title := chapter.Title
+	if title == "" {
+		title = fmt.Sprintf("Chapter %d", i+1)
+	}
+	log.Printf("Skipped to %s of %s in preset %s on %s", title, story.file, story.preset, c.speaker.Name)
+	c.state.Track = &trackState{
+		Index:           int(story.position.Track),
+		Title:           title,
+		URI:             story.position.TrackURI,
+		Duration:        story.position.TrackDuration,
+		Elapsed:         chapter.Start,
+		DurationSeconds: parseTrackTime(story.position.TrackDuration),
+		ElapsedSeconds:  parseTrackTime(chapter.Start),
+	}
+	return c.reply("%s on %s", title, c.speaker.Name)
+}
+
+// seekRequest is the body accepted by /sonos/seek-forward and
+// /sonos/seek-back
+type seekRequest struct {
+	Seconds int `json:"seconds"`
+}
+
+// seekCommand moves playback within the current track by the seconds in the
+// request, or defaultSeekSeconds, forward when direction is 1 and back when
+// it is -1. Playback stays within the track.
+func seekCommand(direction int) func(c *commandContext) error {
+	return func(c *commandContext) error {
+		var req seekRequest
+		if err := c.decode(&req); err != nil {
+			return commandRejected(http.StatusBadRequest, codeInvalidRequest, "Invalid JSON request")
+		}
+		if req.Seconds < 0 {
+			return commandRejected(http.StatusBadRequest, codeInvalidRequest, "seconds must not be negative")
+		}
+		if req.Seconds == 0 {
+			req.Seconds = defaultSeekSeconds
+		}
+
+		position, err := c.s.GetPositionInfo()
+		if err != nil {
+			return commandFailed("Failed to get position", err)
+		}
+		if position.Track == 0 {
+			return commandRejected(http.StatusConflict, codeInvalidRequest, fmt.Sprintf("Nothing is playing on %s", c.speaker.Name))
+		}
+
+		target := parseTrackTime(position.RelTime) + direction*req.Seconds
+		duration := parseTrackTime(position.TrackDuration)
+		if duration > 0 && target >= duration {
+			target = duration - 1
+		}
+		if target < 0 {
+			target = 0
+		}
+		if err := c.s.Seek("REL_TIME", formatTrackTime(target)); err != nil {
+			return commandFailed("Failed to seek", err)
+		}
+
+		log.Printf("Seeked %s to %s", c.speaker.Name, formatTrackTime(target))
+		c.state.Track = &trackState{
+			Index:           int(position.Track),
+			URI:             position.TrackURI,
+			Duration:        position.TrackDuration,
+			Elapsed:         formatTrackTime(target),
+			DurationSeconds: duration,
+			ElapsedSeconds:  target,
+		}
+		if direction > 0 {
+			return c.reply("Skipped forward %d seconds to %s on %s", req.Seconds, formatTrackTime(target), c.speaker.Name)
+		}
+		return c.reply("Skipped back %d seconds to %s on %s", req.Seconds, formatTrackTime(target), c.speaker.Name)
+	}
+}
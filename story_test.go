@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// storyManifest is a story of one long file with three chapters
+const storyManifest = `{
+	"type": "story",
+	"chapters": [
+		{"title": "The Woods", "start": "0:00:00"},
+		{"title": "The Cottage", "start": "0:01:00"},
+		{"start": "0:02:00"}
+	]
+}`
+
+func TestLoadStoryManifest(t *testing.T) {
+	tests := []struct {
+		manifest string
+		problem  string
+	}{
+		{storyManifest, ""},
+		{`{"type": "music"}`, ""},
+		{`{"type": "podcast"}`, "unknown type"},
+		{`{"type": "story", "chapters": [{"start": "soon"}]}`, "chapter 1 starts at"},
+		{`{"chapters": [{"start": "0:01:00"}]}`, "only supported by story presets"},
+		{`{"type": "story", "play_mode": "normal"}`, ""},
+		{`{"type": "story", "play_mode": "shuffle"}`, "always play in order"},
+		{`{"type": "story", "shuffle": true}`, "always play in order"},
+		{`{"type": "story", "repeat": true}`, "always play in order"},
+	}
+	for _, tt := range tests {
+		fsys := fstest.MapFS{"presets/3/preset.json": {Data: []byte(tt.manifest)}}
+		_, err := loadPresetManifest(fsys, "3")
+		if tt.problem == "" && err != nil || tt.problem != "" && (err == nil || !strings.Contains(err.Error(), tt.problem)) {
+			t.Errorf("%s: expected %q, got %v", tt.manifest, tt.problem, err)
+		}
+	}
+
+	story := &PresetManifest{Type: "story", PlayMode: "shuffle"}
+	if mode := story.playMode(); mode != "NORMAL" {
+		t.Errorf("expected stories to play in order, got %s", mode)
+	}
+	if !story.resume() {
+		t.Error("expected stories to resume by default")
+	}
+}
+
+func TestStoryChapters(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	useProgressFile(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "4", 2)
+	writeMusicFile(t, dir, "presets/4/preset.json", storyManifest)
+	useMusicDir(t, dir)
+
+	rr, response := serveJSON(t, "POST", "/sonos/preset/4", "")
+	if rr.Code != http.StatusOK || response.State.PlayMode != "normal" {
+		t.Fatalf("expected the story playing in order, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Next moves through the chapters of the file, then to the next file
+	fake.SetPosition("0:00:20")
+	for _, want := range []struct {
+		message string
+		track   int
+		time    string
+	}{
+		{"The Cottage on Kids Room", 1, "0:01:00"},
+		{"Chapter 3 on Kids Room", 1, "0:02:00"},
+		{"Next track on Kids Room", 2, "0:00:00"},
+	} {
+		rr, response := serveJSON(t, "POST", "/sonos/next", "")
+		if rr.Code != http.StatusOK || response.Message != want.message {
+			t.Errorf("expected %q, got %d: %s", want.message, rr.Code, rr.Body.String())
+		}
+		if _, track, _, _ := fake.State(); track != want.track || fake.Position() != want.time {
+			t.Errorf("expected track %d at %s, got track %d at %s", want.track, want.time, track, fake.Position())
+		}
+	}
+
+	// Previous goes back a chapter, and to the previous file from the first
+	fake.SetPosition("0:02:30")
+	if rr, response := serveJSON(t, "POST", "/sonos/previous", ""); response.Message != "The Cottage on Kids Room" || fake.Position() != "0:01:00" {
+		t.Errorf("expected the previous chapter, got %s at %s", rr.Body.String(), fake.Position())
+	}
+	fake.SetPosition("0:00:10")
+	if rr, response := serveJSON(t, "POST", "/sonos/previous", ""); response.Message != "Previous track on Kids Room" {
+		t.Errorf("expected the previous track, got %s", rr.Body.String())
+	}
+
+	// Stories cannot be shuffled
+	rr, response = serveJSON(t, "POST", "/sonos/play-mode", `{"mode": "shuffle"}`)
+	if rr.Code != http.StatusConflict || fake.PlayMode() != "NORMAL" {
+		t.Errorf("expected the play mode locked, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr, _ = serveJSON(t, "POST", "/sonos/preset/4", `{"play_mode": "shuffle"}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected status 409 for a shuffled story, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestSeekForwardAndBack(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	writePreset(t, dir, "7", 1)
+	useMusicDir(t, dir)
+
+	if rr := serve(t, "POST", "/sonos/seek-forward", ""); rr.Code != http.StatusConflict {
+		t.Errorf("expected status 409 with nothing playing, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve(t, "POST", "/sonos/preset/7", ""); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	tests := []struct {
+		path, body, from, want string
+	}{
+		{"/sonos/seek-forward", "", "0:01:00", "0:01:30"},
+		{"/sonos/seek-forward", `{"seconds": 90}`, "0:01:00", "0:02:30"},
+		// Seeks stay within the track
+		{"/sonos/seek-forward", "", "0:02:50", "0:02:59"},
+		{"/sonos/seek-back", `{"seconds": 10}`, "0:01:00", "0:00:50"},
+		{"/sonos/seek-back", "", "0:00:10", "0:00:00"},
+	}
+	for _, tt := range tests {
+		fake.SetPosition(tt.from)
+		rr, response := serveJSON(t, "POST", tt.path, tt.body)
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s %s: expected status 200, got %d: %s", tt.path, tt.body, rr.Code, rr.Body.String())
+			continue
+		}
+		if fake.Position() != tt.want || response.State.Track.Elapsed != tt.want {
+			t.Errorf("%s %s from %s: expected %s, got %s", tt.path, tt.body, tt.from, tt.want, fake.Position())
+		}
+	}
+
+	if rr := serve(t, "POST", "/sonos/seek-back", `{"seconds": -5}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for negative seconds, got %d", rr.Code)
+	}
+}
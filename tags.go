@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Tags is the metadata read from the ID3 tags and MPEG frames of an MP3
+// file. Fields the file does not have are left empty.
+type Tags struct {
+	Title    string
+	Artist   string
+	Album    string
+	Track    int
+	Duration time.Duration
+
+	// CoverMIME is the MIME type of the embedded cover art, if any. Cover
+	// holds the image itself only when requested from readTags.
+	CoverMIME string
+	Cover     []byte
+}
+
+const (
+	// id3v2HeaderSize is the size of the ID3v2 header and footer
+	id3v2HeaderSize = 10
+	// id3v1Size is the size of the ID3v1 tag at the end of a file
+	id3v1Size = 128
+	// mpegScanLimit is how far past the ID3v2 tag to look for the first
+	// MPEG frame
+	mpegScanLimit = 64 << 10
+	// pictureFrontCover is the APIC picture type of the front cover
+	pictureFrontCover = 3
+)
+
+// readTags reads the ID3v2 tag at the start of r, the ID3v1 tag at its end
+// and the first MPEG frame to find the duration. ID3v2 values take
+// precedence; ID3v1 fills in what ID3v2 lacks. The cover image is only kept
+// when withCover is set. size is the length of r.
+func readTags(r io.ReadSeeker, size int64, withCover bool) (Tags, error) {
+	var tags Tags
+
+	header := make([]byte, id3v2HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return tags, nil
+		}
+		return tags, err
+	}
+
+	// audioStart is where the MPEG frames begin, after any ID3v2 tag
+	var audioStart int64
+	if string(header[:3]) == "ID3" {
+		tagSize := int64(syncsafe(header[6:10]))
+		if id3v2HeaderSize+tagSize > size {
+			return tags, errors.New("ID3v2 tag is longer than the file")
+		}
+		body := make([]byte, tagSize)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return tags, err
+		}
+		parseID3v2(&tags, header, body, withCover)
+		audioStart = id3v2HeaderSize + tagSize
+		if header[3] == 4 && header[5]&0x10 != 0 {
+			audioStart += id3v2HeaderSize
+		}
+	}
+
+	audioEnd := size
+	if size >= audioStart+id3v1Size {
+		v1 := make([]byte, id3v1Size)
+		if _, err := r.Seek(size-id3v1Size, io.SeekStart); err != nil {
+			return tags, err
+		}
+		if _, err := io.ReadFull(r, v1); err != nil {
+			return tags, err
+		}
+		if parseID3v1(&tags, v1) {
+			audioEnd -= id3v1Size
+		}
+	}
+
+	if tags.Duration == 0 {
+		if _, err := r.Seek(audioStart, io.SeekStart); err != nil {
+			return tags, err
+		}
+		frames := make([]byte, min(mpegScanLimit, max(audioEnd-audioStart, 0)))
+		n, err := io.ReadFull(r, frames)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return tags, err
+		}
+		tags.Duration = mpegDuration(frames[:n], audioEnd-audioStart)
+	}
+	return tags, nil
+}
+
+// parseID3v2 reads the frames of an ID3v2.2, 2.3 or 2.4 tag body into tags
+func parseID3v2(tags *Tags, header, body []byte, withCover bool) {
+	version, flags := header[3], header[5]
+	if version < 2 || version > 4 {
+		return
+	}
+	// Version 2.2 uses this flag for compression, which has no defined
+	// scheme; earlier versions unsynchronise the whole tag
+	if version == 2 && flags&0x40 != 0 {
+		return
+	}
+	if version < 4 && flags&0x80 != 0 {
+		body = removeUnsync(body)
+	}
+	if version > 2 && flags&0x40 != 0 && len(body) >= 4 {
+		extended := int(binary.BigEndian.Uint32(body))
+		if version == 4 {
+			extended = int(syncsafe(body[:4]))
+		} else {
+			// The version 2.3 size excludes the size itself
+			extended += 4
+		}
+		if extended > len(body) {
+			return
+		}
+		body = body[extended:]
+	}
+
+	idSize, headerSize := 4, 10
+	if version == 2 {
+		idSize, headerSize = 3, 6
+	}
+	coverType := -1
+	for len(body) >= headerSize && body[0] != 0 {
+		id := string(body[:idSize])
+		var frameSize int
+		var frameFlags uint16
+		switch version {
+		case 2:
+			frameSize = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(body[4:8]))
+			frameFlags = binary.BigEndian.Uint16(body[8:10])
+		case 4:
+			frameSize = int(syncsafe(body[4:8]))
+			frameFlags = binary.BigEndian.Uint16(body[8:10])
+		}
+		if frameSize < 0 || headerSize+frameSize > len(body) {
+			return
+		}
+		data := body[headerSize : headerSize+frameSize]
+		body = body[headerSize+frameSize:]
+
+		data, ok := frameData(version, frameFlags, data)
+		if !ok {
+			continue
+		}
+
+		switch id {
+		case "TIT2", "TT2":
+			tags.Title = textFrame(data)
+		case "TPE1", "TP1":
+			tags.Artist = textFrame(data)
+		case "TALB", "TAL":
+			tags.Album = textFrame(data)
+		case "TRCK", "TRK":
+			tags.Track = trackNumber(textFrame(data))
+		case "TLEN", "TLE":
+			if ms, err := strconv.Atoi(textFrame(data)); err == nil && ms > 0 {
+				tags.Duration = time.Duration(ms) * time.Millisecond
+			}
+		case "APIC", "PIC":
+			mime, pictureType, image, ok := pictureFrame(id, data)
+			// Keep the front cover, or else the first picture
+			if !ok || coverType == pictureFrontCover || (coverType >= 0 && pictureType != pictureFrontCover) {
+				continue
+			}
+			coverType = pictureType
+			tags.CoverMIME = mime
+			if withCover {
+				tags.Cover = image
+			}
+		}
+	}
+}
+
+// frameData strips the extra header fields of a version 2.3 or 2.4 frame and
+// undoes its unsynchronisation. It reports false for compressed and
+// encrypted frames, which are skipped.
+func frameData(version byte, flags uint16, data []byte) ([]byte, bool) {
+	switch version {
+	case 3:
+		if flags&0x0080 != 0 || flags&0x0040 != 0 {
+			return nil, false
+		}
+		if flags&0x0020 != 0 {
+			if len(data) < 1 {
+				return nil, false
+			}
+			data = data[1:]
+		}
+	case 4:
+		if flags&0x0008 != 0 || flags&0x0004 != 0 {
+			return nil, false
+		}
+		if flags&0x0040 != 0 {
+			if len(data) < 1 {
+				return nil, false
+			}
+			data = data[1:]
+		}
+		if flags&0x0001 != 0 {
+			if len(data) < 4 {
+				return nil, false
+			}
+			data = data[4:]
+		}
+		if flags&0x0002 != 0 {
+			data = removeUnsync(data)
+		}
+	}
+	return data, true
+}
+
+// textFrame decodes the first value of a text frame
+func textFrame(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	text, _ := decodeText(data[0], data[1:])
+	return strings.TrimSpace(text)
+}
+
+// pictureFrame decodes an APIC frame, or a PIC frame in version 2.2, into
+// the image MIME type, picture type and image data
+func pictureFrame(id string, data []byte) (mime string, pictureType int, image []byte, ok bool) {
+	if len(data) < 2 {
+		return "", 0, nil, false
+	}
+	encoding, data := data[0], data[1:]
+	if id == "PIC" {
+		if len(data) < 4 {
+			return "", 0, nil, false
+		}
+		switch strings.ToUpper(string(data[:3])) {
+		case "PNG":
+			mime = "image/png"
+		default:
+			mime = "image/jpeg"
+		}
+		data = data[3:]
+	} else {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			return "", 0, nil, false
+		}
+		mime = strings.ToLower(string(data[:end]))
+		data = data[end+1:]
+		// Some taggers write the bare format rather than a MIME type
+		if !strings.Contains(mime, "/") {
+			mime = "image/" + mime
+		}
+		if mime == "image/jpg" {
+			mime = "image/jpeg"
+		}
+	}
+	if len(data) < 1 {
+		return "", 0, nil, false
+	}
+	pictureType, data = int(data[0]), data[1:]
+	_, rest := decodeText(encoding, data)
+	if len(rest) == 0 {
+		return "", 0, nil, false
+	}
+	return mime, pictureType, rest, true
+}
+
+// decodeText decodes a string terminated by the null character of its
+// encoding, returning the string and the bytes after the terminator
+func decodeText(encoding byte, data []byte) (string, []byte) {
+	switch encoding {
+	case 1, 2:
+		end := len(data) &^ 1
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				end = i
+				break
+			}
+		}
+		rest := data[min(end+2, len(data)):]
+		text := data[:end]
+		bigEndian := encoding == 2
+		if len(text) >= 2 {
+			switch {
+			case text[0] == 0xFE && text[1] == 0xFF:
+				bigEndian, text = true, text[2:]
+			case text[0] == 0xFF && text[1] == 0xFE:
+				bigEndian, text = false, text[2:]
+			}
+		}
+		units := make([]uint16, len(text)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = binary.BigEndian.Uint16(text[2*i:])
+			} else {
+				units[i] = binary.LittleEndian.Uint16(text[2*i:])
+			}
+		}
+		return string(utf16.Decode(units)), rest
+	default:
+		end := bytes.IndexByte(data, 0)
+		rest := []byte(nil)
+		if end < 0 {
+			end = len(data)
+		} else {
+			rest = data[end+1:]
+		}
+		if encoding == 3 {
+			return string(data[:end]), rest
+		}
+		return latin1(data[:end]), rest
+	}
+}
+
+// parseID3v1 fills the fields tags lacks from an ID3v1 or ID3v1.1 tag. It
+// reports whether tag is an ID3v1 tag.
+func parseID3v1(tags *Tags, tag []byte) bool {
+	if len(tag) != id3v1Size || string(tag[:3]) != "TAG" {
+		return false
+	}
+	field := func(b []byte) string {
+		if end := bytes.IndexByte(b, 0); end >= 0 {
+			b = b[:end]
+		}
+		return strings.TrimSpace(latin1(b))
+	}
+	if tags.Title == "" {
+		tags.Title = field(tag[3:33])
+	}
+	if tags.Artist == "" {
+		tags.Artist = field(tag[33:63])
+	}
+	if tags.Album == "" {
+		tags.Album = field(tag[63:93])
+	}
+	// ID3v1.1 stores the track number in the last byte of the comment
+	if tags.Track == 0 && tag[125] == 0 && tag[126] != 0 {
+		tags.Track = int(tag[126])
+	}
+	return true
+}
+
+// mpegDuration estimates the playing time of an MPEG audio stream of
+// audioSize bytes from its first frame, found in frames. A Xing, Info or
+// VBRI header gives the exact frame count of variable bitrate files;
+// otherwise the bitrate of the first frame is assumed throughout.
+func mpegDuration(frames []byte, audioSize int64) time.Duration {
+	for i := 0; i+4 <= len(frames); i++ {
+		h, ok := parseMPEGHeader(frames[i:])
+		if !ok {
+			continue
+		}
+		// Require the next frame to follow, to skip stray sync bits
+		if next := i + h.frameSize; next+4 <= len(frames) {
+			if _, ok := parseMPEGHeader(frames[next:]); !ok {
+				continue
+			}
+		}
+
+		frame := frames[i:]
+		if count := vbrFrameCount(frame, h); count > 0 {
+			return seconds(float64(count) * float64(h.samples) / float64(h.sampleRate))
+		}
+		audioSize -= int64(i)
+		return seconds(float64(audioSize*8) / float64(h.bitrate))
+	}
+	return 0
+}
+
+// mpegHeader is the decoded header of an MPEG audio Layer III frame
+type mpegHeader struct {
+	mpeg1      bool
+	mono       bool
+	bitrate    int
+	sampleRate int
+	samples    int
+	frameSize  int
+}
+
+var (
+	// mpeg1Bitrates and mpeg2Bitrates are the Layer III bitrates in kbit/s
+	// by bitrate index
+	mpeg1Bitrates = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	mpeg2Bitrates = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+	// mpegSampleRates are the MPEG-1 sample rates by index; MPEG-2 halves
+	// them and MPEG-2.5 quarters them
+	mpegSampleRates = [4]int{44100, 48000, 32000, 0}
+)
+
+// parseMPEGHeader decodes the four byte header at the start of b, reporting
+// false unless it is a valid Layer III frame header
+func parseMPEGHeader(b []byte) (mpegHeader, bool) {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return mpegHeader{}, false
+	}
+	version := (b[1] >> 3) & 0x03
+	layer := (b[1] >> 1) & 0x03
+	bitrateIndex := b[2] >> 4
+	rateIndex := (b[2] >> 2) & 0x03
+	padding := int(b[2]>>1) & 0x01
+	if version == 1 || layer != 1 || rateIndex == 3 || bitrateIndex == 0 || bitrateIndex == 15 {
+		return mpegHeader{}, false
+	}
+
+	h := mpegHeader{mpeg1: version == 3, mono: b[3]>>6 == 3}
+	h.sampleRate = mpegSampleRates[rateIndex]
+	switch version {
+	case 3:
+		h.bitrate = mpeg1Bitrates[bitrateIndex] * 1000
+		h.samples = 1152
+	case 2:
+		h.bitrate = mpeg2Bitrates[bitrateIndex] * 1000
+		h.sampleRate /= 2
+		h.samples = 576
+	case 0:
+		h.bitrate = mpeg2Bitrates[bitrateIndex] * 1000
+		h.sampleRate /= 4
+		h.samples = 576
+	}
+	h.frameSize = h.samples/8*h.bitrate/h.sampleRate + padding
+	return h, true
+}
+
+// vbrFrameCount returns the frame count in the Xing, Info or VBRI header of
+// the first frame, or 0 if it has none
+func vbrFrameCount(frame []byte, h mpegHeader) int {
+	// The Xing header follows the side information
+	offset := 4 + 17
+	switch {
+	case h.mpeg1 && !h.mono:
+		offset = 4 + 32
+	case !h.mpeg1 && h.mono:
+		offset = 4 + 9
+	}
+	if len(frame) >= offset+12 {
+		tag := string(frame[offset : offset+4])
+		flags := binary.BigEndian.Uint32(frame[offset+4:])
+		if (tag == "Xing" || tag == "Info") && flags&0x01 != 0 {
+			return int(binary.BigEndian.Uint32(frame[offset+8:]))
+		}
+	}
+	// The VBRI header is always 32 bytes after the frame header
+	if vbri := 4 + 32; len(frame) >= vbri+18 && string(frame[vbri:vbri+4]) == "VBRI" {
+		return int(binary.BigEndian.Uint32(frame[vbri+14:]))
+	}
+	return 0
+}
+
+// seconds converts fractional seconds to a duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// syncsafe decodes a 28-bit integer stored in the low seven bits of four
+// bytes
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
+
+// removeUnsync undoes ID3v2 unsynchronisation, which inserts a zero byte
+// after every 0xFF
+func removeUnsync(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xFF, 0x00}, []byte{0xFF})
+}
+
+// latin1 decodes ISO-8859-1 text
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// trackNumber parses a track number such as "3" or "3/12"
+func trackNumber(s string) int {
+	s, _, _ = strings.Cut(s, "/")
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// cbrFrameHeader is an MPEG-1 Layer III frame header at 128 kbit/s and
+// 44.1 kHz, whose frames are 417 bytes and last 1152 samples
+var cbrFrameHeader = []byte{0xFF, 0xFB, 0x90, 0x64}
+
+// mpegFrames returns n silent frames with cbrFrameHeader
+func mpegFrames(n int) []byte {
+	frame := make([]byte, 417)
+	copy(frame, cbrFrameHeader)
+	return bytes.Repeat(frame, n)
+}
+
+// id3v2Tag builds an ID3v2 tag of the given major version from frames
+// built by id3v2Frame
+func id3v2Tag(version byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	tag := []byte{'I', 'D', '3', version, 0, 0}
+	return append(append(tag, syncsafeBytes(len(body))...), body...)
+}
+
+// id3v2Frame builds a frame for a tag of the given major version
+func id3v2Frame(version byte, id string, data []byte) []byte {
+	var frame []byte
+	switch version {
+	case 2:
+		frame = append([]byte(id), byte(len(data)>>16), byte(len(data)>>8), byte(len(data)))
+	case 3:
+		frame = binary.BigEndian.AppendUint32([]byte(id), uint32(len(data)))
+		frame = append(frame, 0, 0)
+	case 4:
+		frame = append(append([]byte(id), syncsafeBytes(len(data))...), 0, 0)
+	}
+	return append(frame, data...)
+}
+
+func syncsafeBytes(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+}
+
+// utf16Text encodes s as a UTF-16 text frame with a byte order mark
+func utf16Text(s string) []byte {
+	data := []byte{1, 0xFF, 0xFE}
+	for _, u := range utf16.Encode([]rune(s)) {
+		data = binary.LittleEndian.AppendUint16(data, u)
+	}
+	return append(data, 0, 0)
+}
+
+// id3v1Tag builds an ID3v1.1 tag
+func id3v1Tag(title, artist, album string, track byte) []byte {
+	tag := make([]byte, id3v1Size)
+	copy(tag, "TAG")
+	copy(tag[3:33], title)
+	copy(tag[33:63], artist)
+	copy(tag[63:93], album)
+	tag[126] = track
+	return tag
+}
+
+func TestReadTags(t *testing.T) {
+	cover := []byte("\xFF\xD8\xFFfront cover")
+	backCover := []byte("\xFF\xD8\xFFback cover")
+	// 38 frames last about a second; without a Xing header the duration
+	// is estimated from the size at 128 kbit/s
+	oneSecond := 38
+	estimate := time.Duration(oneSecond*417*8) * time.Second / 128000
+
+	tests := []struct {
+		name string
+		file []byte
+		want Tags
+	}{
+		{
+			name: "id3v2.3",
+			file: append(id3v2Tag(3,
+				id3v2Frame(3, "TIT2", []byte("\x00Wheels on the Bus")),
+				id3v2Frame(3, "TPE1", utf16Text("Küken & Co")),
+				id3v2Frame(3, "TALB", []byte("\x00Sing Along\x00")),
+				id3v2Frame(3, "TRCK", []byte("\x003/12")),
+				id3v2Frame(3, "APIC", append([]byte("\x00image/jpeg\x00\x04back\x00"), backCover...)),
+				id3v2Frame(3, "APIC", append([]byte("\x00image/jpeg\x00\x03front\x00"), cover...)),
+			), mpegFrames(oneSecond)...),
+			want: Tags{
+				Title:     "Wheels on the Bus",
+				Artist:    "Küken & Co",
+				Album:     "Sing Along",
+				Track:     3,
+				Duration:  estimate,
+				CoverMIME: "image/jpeg",
+				Cover:     cover,
+			},
+		},
+		{
+			name: "id3v2.4 utf-8 with length",
+			file: append(id3v2Tag(4,
+				id3v2Frame(4, "TIT2", []byte("\x03Über")),
+				id3v2Frame(4, "TLEN", []byte("\x03185000")),
+				id3v2Frame(4, "APIC", append([]byte("\x03png\x00\x00\x00"), cover...)),
+			), mpegFrames(oneSecond)...),
+			want: Tags{
+				Title:     "Über",
+				Duration:  185 * time.Second,
+				CoverMIME: "image/png",
+				Cover:     cover,
+			},
+		},
+		{
+			name: "id3v2.2",
+			file: append(id3v2Tag(2,
+				id3v2Frame(2, "TT2", []byte("\x00Old Song")),
+				id3v2Frame(2, "TP1", []byte("\x00Old Artist")),
+				id3v2Frame(2, "PIC", append([]byte("\x00JPG\x03\x00"), cover...)),
+			), mpegFrames(oneSecond)...),
+			want: Tags{
+				Title:     "Old Song",
+				Artist:    "Old Artist",
+				Duration:  estimate,
+				CoverMIME: "image/jpeg",
+				Cover:     cover,
+			},
+		},
+		{
+			name: "id3v1 fills in missing fields",
+			file: append(append(id3v2Tag(3,
+				id3v2Frame(3, "TIT2", []byte("\x00From v2")),
+			), mpegFrames(oneSecond)...), id3v1Tag("From v1", "V1 Artist", "V1 Album", 7)...),
+			want: Tags{
+				Title:    "From v2",
+				Artist:   "V1 Artist",
+				Album:    "V1 Album",
+				Track:    7,
+				Duration: estimate,
+			},
+		},
+		{
+			name: "no tags",
+			file: mpegFrames(oneSecond * 2),
+			want: Tags{Duration: 2 * estimate},
+		},
+		{
+			name: "not audio",
+			file: []byte("hello"),
+			want: Tags{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readTags(bytes.NewReader(tt.file), int64(len(tt.file)), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Title != tt.want.Title || got.Artist != tt.want.Artist || got.Album != tt.want.Album ||
+				got.Track != tt.want.Track || got.CoverMIME != tt.want.CoverMIME || !bytes.Equal(got.Cover, tt.want.Cover) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+			if diff := got.Duration - tt.want.Duration; diff < -time.Millisecond || diff > time.Millisecond {
+				t.Errorf("expected duration %s, got %s", tt.want.Duration, got.Duration)
+			}
+
+			// The cover is only kept when asked for
+			got, err = readTags(bytes.NewReader(tt.file), int64(len(tt.file)), false)
+			if err != nil || got.Cover != nil || got.CoverMIME != tt.want.CoverMIME {
+				t.Errorf("expected cover type without image, got %q %d bytes (%v)", got.CoverMIME, len(got.Cover), err)
+			}
+		})
+	}
+}
+
+func TestReadTagsXingFrameCount(t *testing.T) {
+	// A Xing header in the first frame gives the frame count of the whole
+	// file, whatever the size of the file
+	frames := mpegFrames(10)
+	copy(frames[4+32:], "Xing\x00\x00\x00\x01")
+	binary.BigEndian.PutUint32(frames[4+32+8:], 3828)
+
+	tags, err := readTags(bytes.NewReader(frames), int64(len(frames)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 100 * time.Second; tags.Duration.Round(time.Second) != want {
+		t.Errorf("expected %s, got %s", want, tags.Duration)
+	}
+}
+
+func TestReadTagsTruncated(t *testing.T) {
+	file := id3v2Tag(3, id3v2Frame(3, "TIT2", []byte("\x00Cut Off")))
+	file = file[:len(file)-4]
+	if _, err := readTags(bytes.NewReader(file), int64(len(file)), false); err == nil {
+		t.Error("expected error for a tag longer than the file")
+	}
+}
+
+func TestPresetTagsEnqueued(t *testing.T) {
+	fake := useFakeSpeaker(t)
+	dir := t.TempDir()
+	song := append(id3v2Tag(3,
+		id3v2Frame(3, "TIT2", []byte("\x00Tagged Title")),
+		id3v2Frame(3, "TPE1", []byte("\x00Tagged Artist")),
+		id3v2Frame(3, "TALB", []byte("\x00Tagged Album")),
+		id3v2Frame(3, "TRCK", []byte("\x002")),
+	), mpegFrames(38*3)...)
+	writeMusicFile(t, dir, "presets/7/01 Untitled.mp3", string(song))
+	useMusicDir(t, dir)
+
+	rr := serve(t, "POST", "/sonos/preset/7", "")
+	if rr.Code != 200 {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	queue := fake.Queue()
+	if len(queue) != 1 {
+		t.Fatalf("expected 1 queued track, got %d", len(queue))
+	}
+	for _, want := range []string{
+		"<dc:title>Tagged Title</dc:title>",
+		"<dc:creator>Tagged Artist</dc:creator>",
+		"<upnp:album>Tagged Album</upnp:album>",
+		"<upnp:originalTrackNumber>2</upnp:originalTrackNumber>",
+		`duration="0:00:03"`,
+	} {
+		if !strings.Contains(queue[0].Metadata, want) {
+			t.Errorf("expected %s in %s", want, queue[0].Metadata)
+		}
+	}
+}